@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"forum/config"
 	"forum/internal/auth"
 	"forum/internal/database"
 	"forum/internal/handlers"
+	"forum/internal/imaging"
+	"forum/internal/mail"
 	"forum/internal/middleware"
+	"forum/internal/ratelimit"
+	"forum/internal/storage"
 	"log"
 	"net/http"
 	"os"
@@ -22,17 +27,62 @@ func main() {
 	}
 	defer database.CloseDB()
 
+	if err := auth.InitKeyRing(database.DB); err != nil {
+		log.Fatal(err)
+	}
+	cfg := config.LoadConfig()
+	if err := database.EnsureSearchLanguage(cfg.SearchLanguage); err != nil {
+		log.Fatal(err)
+	}
+	stopKeyRotation := make(chan struct{})
+	go auth.RunKeyRotation(stopKeyRotation)
+
+	blobs, err := storage.NewBlobStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopBlobSweeper := make(chan struct{})
+	go storage.RunBlobSweeper(database.DB, blobs, stopBlobSweeper)
+	stopImageWorkers := make(chan struct{})
+	imageLimits := imaging.Limits{MaxPixels: cfg.MaxImagePixels, MaxSide: cfg.MaxImageSide}
+	go imaging.RunWorkers(database.DB, blobs, imageLimits, cfg.ImageWorkers, stopImageWorkers)
+
 	r := mux.NewRouter()
-	authService := auth.NewAuthService(database.DB)
+	mailer := mail.NewMailer(cfg, database.DB)
+	accountLimiter, ipLimiter := ratelimit.NewLoginLimiters(cfg, database.DB)
+	mailLimiter, mailIPLimiter := ratelimit.NewMailLimiters(cfg, database.DB)
+	authService := auth.NewAuthService(database.DB, mailer, accountLimiter, ipLimiter, mailLimiter, mailIPLimiter)
+	attachmentHandler := handlers.NewAttachmentHandler(database.DB, blobs)
+	r.HandleFunc("/.well-known/jwks.json", auth.JWKS).Methods("GET")
 	r.HandleFunc("/api/register", authService.Register).Methods("POST")
 	r.HandleFunc("/api/login", authService.Login).Methods("POST")
+	r.HandleFunc("/api/login/2fa", authService.LoginTwoFactor).Methods("POST")
+	r.HandleFunc("/api/oidc/login", authService.OIDCLogin).Methods("GET")
+	r.HandleFunc("/api/oidc/callback", authService.OIDCCallback).Methods("GET")
+	r.HandleFunc("/api/token/refresh", authService.RefreshToken).Methods("POST")
+	r.HandleFunc("/api/password/forgot", authService.ForgotPassword).Methods("POST")
+	r.HandleFunc("/api/password/reset", authService.ResetPassword).Methods("POST")
+	r.Handle("/api/logout", middleware.AuthMiddleware(http.HandlerFunc(authService.Logout))).Methods("POST")
+	r.HandleFunc("/api/email/verify", authService.VerifyEmail).Methods("POST")
+	r.Handle("/api/email/resend", middleware.AuthMiddleware(http.HandlerFunc(authService.ResendVerification))).Methods("POST")
 	r.Handle("/api/change-password", middleware.AuthMiddleware(http.HandlerFunc(authService.ChangePassword))).Methods("POST")
-	r.HandleFunc("/api/posts", handlers.GetPosts).Methods("GET")
-	r.HandleFunc("/api/posts/{id}", handlers.GetPost).Methods("GET")
-	r.HandleFunc("/api/posts/{post_id}/comments", handlers.GetComments).Methods("GET")
+	r.Handle("/api/categories", middleware.OptionalAuth(http.HandlerFunc(handlers.GetCategories))).Methods("GET")
+	r.Handle("/api/posts", middleware.OptionalAuth(http.HandlerFunc(handlers.GetPosts))).Methods("GET")
+	r.Handle("/api/posts/{id}", middleware.OptionalAuth(http.HandlerFunc(handlers.GetPost))).Methods("GET")
+	r.Handle("/api/posts/{post_id}/comments", middleware.OptionalAuth(http.HandlerFunc(handlers.GetComments))).Methods("GET")
+	r.Handle("/api/posts/{id}/revisions", middleware.OptionalAuth(http.HandlerFunc(handlers.GetPostRevisions))).Methods("GET")
+	r.Handle("/api/posts/{id}/revisions/diff", middleware.OptionalAuth(http.HandlerFunc(handlers.GetPostRevisionDiff))).Methods("GET")
+	r.Handle("/api/comments/{id}/revisions", middleware.OptionalAuth(http.HandlerFunc(handlers.GetCommentRevisions))).Methods("GET")
+	r.Handle("/api/comments/{id}/revisions/diff", middleware.OptionalAuth(http.HandlerFunc(handlers.GetCommentRevisionDiff))).Methods("GET")
+	r.Handle("/api/tags", middleware.OptionalAuth(http.HandlerFunc(handlers.GetTags))).Methods("GET")
+	r.Handle("/api/search", middleware.OptionalAuth(http.HandlerFunc(handlers.Search))).Methods("GET")
+	r.HandleFunc("/api/markdown/highlight.css", handlers.HighlightCSS).Methods("GET")
+	r.HandleFunc("/api/reactions", handlers.GetReactions).Methods("GET")
+	r.Handle("/api/attachments/{id}", middleware.OptionalAuth(http.HandlerFunc(attachmentHandler.DownloadAttachment))).Methods("GET")
+	r.Handle("/api/attachments/{id}/thumbnails/{name}", middleware.OptionalAuth(http.HandlerFunc(attachmentHandler.DownloadThumbnail))).Methods("GET")
 
 	// WebSocket routes
-	r.HandleFunc("/ws/chat", middleware.AuthMiddleware(handlers.HandleWebSocket))
+	r.Handle("/ws/chat", middleware.AuthMiddleware(middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.HandleWebSocket))))
 
 	authRouter := r.PathPrefix("/api").Subrouter()
 	authRouter.Use(middleware.AuthMiddleware)
@@ -41,21 +91,82 @@ func main() {
 	authRouter.HandleFunc("/profile", profileHandler.GetUserProfile).Methods("GET")
 	authRouter.HandleFunc("/profile/stats", profileHandler.GetUserStats).Methods("GET")
 	authRouter.HandleFunc("/profile/password", profileHandler.ChangePassword).Methods("PUT")
-
-	authRouter.HandleFunc("/posts", handlers.CreatePost).Methods("POST")
+	authRouter.HandleFunc("/profile/tokens", profileHandler.GetAccessTokens).Methods("GET")
+	authRouter.HandleFunc("/profile/tokens", profileHandler.CreateAccessToken).Methods("POST")
+	authRouter.HandleFunc("/profile/tokens/{id}", profileHandler.RevokeAccessToken).Methods("DELETE")
+	authRouter.HandleFunc("/profile/2fa/setup", authService.SetupTwoFactor).Methods("POST")
+	authRouter.HandleFunc("/profile/2fa/confirm", authService.ConfirmTwoFactor).Methods("POST")
+	authRouter.HandleFunc("/profile/2fa/recovery-codes", authService.RegenerateRecoveryCodes).Methods("POST")
+	authRouter.HandleFunc("/profile/2fa/disable", authService.DisableTwoFactor).Methods("POST")
+
+	authRouter.Handle("/posts", middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.CreatePost))).Methods("POST")
 	authRouter.HandleFunc("/posts/{id}", handlers.UpdatePost).Methods("PUT")
 	authRouter.HandleFunc("/posts/{id}", handlers.DeletePost).Methods("DELETE")
-	authRouter.HandleFunc("/posts/{post_id}/comments", handlers.CreateComment).Methods("POST")
+	authRouter.Handle("/posts/{post_id}/comments", middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.CreateComment))).Methods("POST")
 	authRouter.HandleFunc("/comments/{id}", handlers.UpdateComment).Methods("PUT")
 	authRouter.HandleFunc("/comments/{id}", handlers.DeleteComment).Methods("DELETE")
+	authRouter.Handle("/posts/{id}/revisions/{revision}/rollback", middleware.RequirePermission(auth.PermPostsEditAny)(http.HandlerFunc(handlers.RollbackPost))).Methods("POST")
+	authRouter.Handle("/comments/{id}/revisions/{revision}/rollback", middleware.RequirePermission(auth.PermCommentsEditAny)(http.HandlerFunc(handlers.RollbackComment))).Methods("POST")
+	authRouter.Handle("/posts/{id}/attachments", middleware.RequireVerifiedEmail(http.HandlerFunc(attachmentHandler.UploadPostAttachment))).Methods("POST")
+	authRouter.Handle("/comments/{id}/attachments", middleware.RequireVerifiedEmail(http.HandlerFunc(attachmentHandler.UploadCommentAttachment))).Methods("POST")
+	authRouter.HandleFunc("/attachments/{id}", attachmentHandler.DeleteAttachment).Methods("DELETE")
+	authRouter.Handle("/posts/{id}/vote", middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.VotePost))).Methods("PUT")
+	authRouter.HandleFunc("/posts/{id}/vote", handlers.UnvotePost).Methods("DELETE")
+	authRouter.Handle("/posts/{id}/reaction", middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.ReactToPost))).Methods("PUT")
+	authRouter.HandleFunc("/posts/{id}/reaction", handlers.UnreactToPost).Methods("DELETE")
+	authRouter.Handle("/comments/{id}/vote", middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.VoteComment))).Methods("PUT")
+	authRouter.HandleFunc("/comments/{id}/vote", handlers.UnvoteComment).Methods("DELETE")
+	authRouter.Handle("/comments/{id}/reaction", middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.ReactToComment))).Methods("PUT")
+	authRouter.HandleFunc("/comments/{id}/reaction", handlers.UnreactToComment).Methods("DELETE")
+	authRouter.HandleFunc("/chat/rooms", handlers.GetChatRooms).Methods("GET")
 
 	adminRouter := r.PathPrefix("/api/admin").Subrouter()
 	adminRouter.Use(middleware.AdminMiddleware)
 
-	adminRouter.HandleFunc("/users", handlers.GetAllUsers).Methods("GET")
-	adminRouter.HandleFunc("/users/{id}", handlers.GetUser).Methods("GET")
-	adminRouter.HandleFunc("/users/{id}", handlers.UpdateUser).Methods("PUT")
-	adminRouter.HandleFunc("/users/{id}", handlers.DeleteUser).Methods("DELETE")
+	usersRouter := adminRouter.PathPrefix("/users").Subrouter()
+	usersRouter.Use(middleware.RequirePermission(auth.PermUsersManage))
+	usersRouter.HandleFunc("", handlers.GetAllUsers).Methods("GET")
+	usersRouter.HandleFunc("/{id}", handlers.GetUser).Methods("GET")
+	usersRouter.HandleFunc("/{id}", handlers.UpdateUser).Methods("PUT")
+	usersRouter.HandleFunc("/{id}", handlers.DeleteUser).Methods("DELETE")
+	usersRouter.HandleFunc("/{id}/unlock", authService.UnlockUser).Methods("POST")
+
+	sanctionsRouter := adminRouter.PathPrefix("/sanctions").Subrouter()
+	sanctionsRouter.Use(middleware.RequirePermission(auth.PermUsersSanction))
+	sanctionsRouter.HandleFunc("", handlers.GetSanctions).Methods("GET")
+	sanctionsRouter.HandleFunc("", handlers.CreateSanction).Methods("POST")
+	sanctionsRouter.HandleFunc("/{id}", handlers.RevokeSanction).Methods("DELETE")
+
+	adminRouter.Handle("/audit", middleware.RequirePermission(auth.PermAuditRead)(http.HandlerFunc(handlers.GetAuditLog))).Methods("GET")
+	adminRouter.Handle("/permissions", middleware.RequirePermission(auth.PermRolesManage)(http.HandlerFunc(handlers.GetPermissions))).Methods("GET")
+	rolesRouter := adminRouter.PathPrefix("/roles").Subrouter()
+	rolesRouter.Use(middleware.RequirePermission(auth.PermRolesManage))
+	rolesRouter.HandleFunc("", handlers.GetRoles).Methods("GET")
+	rolesRouter.HandleFunc("", handlers.CreateRole).Methods("POST")
+	rolesRouter.HandleFunc("/{name}", handlers.UpdateRole).Methods("PUT")
+	rolesRouter.HandleFunc("/{name}", handlers.DeleteRole).Methods("DELETE")
+
+	categoriesRouter := adminRouter.PathPrefix("/categories").Subrouter()
+	categoriesRouter.Use(middleware.RequirePermission(auth.PermCategoriesManage))
+	categoriesRouter.HandleFunc("", handlers.GetAllCategories).Methods("GET")
+	categoriesRouter.HandleFunc("", handlers.CreateCategory).Methods("POST")
+	categoriesRouter.HandleFunc("/{id}", handlers.UpdateCategory).Methods("PUT")
+	categoriesRouter.HandleFunc("/{id}", handlers.DeleteCategory).Methods("DELETE")
+
+	tagsRouter := adminRouter.PathPrefix("/tags").Subrouter()
+	tagsRouter.Use(middleware.RequirePermission(auth.PermTagsManage))
+	tagsRouter.HandleFunc("/{id}", handlers.RenameTag).Methods("PUT")
+	tagsRouter.HandleFunc("/{id}/merge", handlers.MergeTag).Methods("POST")
+
+	chatRoomsRouter := adminRouter.PathPrefix("/chat/rooms").Subrouter()
+	chatRoomsRouter.Use(middleware.RequirePermission(auth.PermChatManage))
+	chatRoomsRouter.HandleFunc("", handlers.GetAllChatRooms).Methods("GET")
+	chatRoomsRouter.HandleFunc("", handlers.CreateChatRoom).Methods("POST")
+	chatRoomsRouter.HandleFunc("/{id}", handlers.UpdateChatRoom).Methods("PUT")
+	chatRoomsRouter.HandleFunc("/{id}", handlers.DeleteChatRoom).Methods("DELETE")
+	chatRoomsRouter.HandleFunc("/{id}/members", handlers.GetChatRoomMembers).Methods("GET")
+	chatRoomsRouter.HandleFunc("/{id}/members", handlers.AddChatRoomMember).Methods("POST")
+	chatRoomsRouter.HandleFunc("/{id}/members/{user_id}", handlers.RemoveChatRoomMember).Methods("DELETE")
 
 	adminRouter.HandleFunc("/posts", handlers.GetAllPosts).Methods("GET")
 	adminRouter.HandleFunc("/posts/{id}", handlers.GetPost).Methods("GET")
@@ -106,17 +217,28 @@ func main() {
 		}
 	}()
 
-	// Запускаем обработку широковещательных сообщений
-	go handlers.BroadcastMessages()
+	// Запускаем хаб чата
+	stopChat := make(chan struct{})
+	go handlers.RunChat(stopChat)
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
+	close(stopKeyRotation)
+	close(stopBlobSweeper)
+	close(stopImageWorkers)
+	close(stopChat)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// http.Server.Shutdown не ждёт WebSocket-соединений, поэтому сначала
+	// дожидаемся, пока хаб отправит всем клиентам close-фреймы
+	if err := handlers.WaitChat(ctx); err != nil {
+		log.Printf("Chat forced to shutdown: %v", err)
+	}
+
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
@@ -0,0 +1,75 @@
+// Command mockidp is a throwaway OpenID Connect provider for trying the forum
+// single sign-on locally. It approves every login without asking and issues
+// ID tokens for the identity configured through MOCK_IDP_* variables, e.g.
+//
+//	MOCK_IDP_EMAIL=alice@example.com MOCK_IDP_GROUPS=forum-admins go run ./cmd/mockidp
+//
+// and the forum started with OIDC_ISSUER=http://localhost:9090 OIDC_CLIENT_ID=forum.
+// Query parameters sub, email, groups and amr on the authorize URL override
+// the defaults for a single login.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"forum/internal/oidc/oidctest"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func main() {
+	addr := getEnv("MOCK_IDP_ADDR", ":9090")
+	issuer := getEnv("MOCK_IDP_ISSUER", "http://localhost:9090")
+
+	idp, err := oidctest.New(issuer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	idp.Claims = claims
+
+	log.Printf("Mock IdP %s listening on %s", issuer, addr)
+	log.Fatal(http.ListenAndServe(addr, idp))
+}
+
+// claims returns the configured identity with the overrides of the
+// authorize request.
+func claims(r *http.Request) jwt.MapClaims {
+	q := r.URL.Query()
+	email := pick(q.Get("email"), getEnv("MOCK_IDP_EMAIL", "alice@example.com"))
+	return jwt.MapClaims{
+		"sub":                pick(q.Get("sub"), getEnv("MOCK_IDP_SUBJECT", email)),
+		"email":              email,
+		"email_verified":     getEnv("MOCK_IDP_EMAIL_VERIFIED", "true") == "true",
+		"name":               getEnv("MOCK_IDP_NAME", "Alice Example"),
+		"preferred_username": strings.SplitN(email, "@", 2)[0],
+		"groups":             splitList(pick(q.Get("groups"), os.Getenv("MOCK_IDP_GROUPS"))),
+		"amr":                splitList(pick(q.Get("amr"), getEnv("MOCK_IDP_AMR", "pwd"))),
+	}
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func pick(value, def string) string {
+	if value != "" {
+		return value
+	}
+	return def
+}
+
+func getEnv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
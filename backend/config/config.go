@@ -1,12 +1,113 @@
 package config
 
 import (
+	"log"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Config struct {
-	JWTSecret string
+	// Алгоритм подписи JWT: "RS256" или "EdDSA"
+	JWTAlgorithm   string
+	JWTIssuer      string
+	JWTKeyRotation time.Duration
+	JWTRSAKeyBits  int
+
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// Адрес фронтенда, используется для ссылок в письмах
+	AppBaseURL       string
+	PasswordResetTTL time.Duration
+
+	EmailVerificationTTL time.Duration
+	// Запрещать создание постов, комментариев и чат неподтверждённым аккаунтам
+	RequireEmailVerification bool
+
+	// "memory" или "postgres" (общий для всех инстансов)
+	LoginLimiter          string
+	LoginAccountThreshold int
+	LoginIPThreshold      int
+	LoginLockoutBase      time.Duration
+	LoginLockoutMax       time.Duration
+	LoginFailureWindow    time.Duration
+
+	TOTPIssuer string
+	// Админский API доступен только сессиям, прошедшим вход с TOTP
+	RequireAdmin2FA bool
+
+	// Вход через OpenID Connect включается, если задан OIDCIssuer
+	OIDCIssuer        string
+	OIDCClientID      string
+	OIDCClientSecret  string
+	OIDCRedirectURL   string
+	OIDCScopes        []string
+	OIDCProviderName  string
+	OIDCGroupsClaim   string
+	OIDCRoleMapping   []string // "группа=роль", первое совпадение побеждает
+	OIDCAutoProvision bool
+
+	// Конфигурация полнотекстового поиска PostgreSQL. "russian" стеммит и
+	// английские слова, поэтому подходит для смешанного контента
+	SearchLanguage string
+
+	// Сколько отрендеренных Markdown-текстов держать в памяти
+	MarkdownCacheSize int
+	// Тема chroma для /api/markdown/highlight.css
+	MarkdownHighlightStyle string
+
+	// Хранилище вложений: "local" (каталог StorageDir) или "s3" (AWS S3, MinIO
+	// и другие S3-совместимые сервисы)
+	StorageDriver string
+	StorageDir    string
+	S3Endpoint    string
+	S3Region      string
+	S3Bucket      string
+	S3AccessKey   string
+	S3SecretKey   string
+	S3PathStyle   bool
+	// Ограничения на загрузку; тип определяется по содержимому файла
+	MaxUploadSize      int64
+	AllowedUploadTypes []string
+
+	// Обработка изображений. Лимиты проверяются по заголовку до декодирования
+	// и защищают от «бомб» — маленьких файлов с огромным разрешением
+	MaxImagePixels int
+	MaxImageSide   int
+	ImageWorkers   int
+
+	// Набор эмодзи, которыми можно реагировать на посты и комментарии
+	Reactions []string
+
+	// Максимальная вложенность ответов; 0 — комментарии без ответов
+	MaxCommentDepth int
+
+	// Чат: сервер шлёт ping каждые ChatPingInterval и закрывает соединение,
+	// если pong не пришёл за ChatPongWait. Интервал должен быть меньше ожидания
+	ChatPingInterval   time.Duration
+	ChatPongWait       time.Duration
+	ChatWriteWait      time.Duration
+	ChatMaxMessageSize int64
+
+	// Письма по запросу пользователя (сброс пароля, повторное подтверждение):
+	// столько писем на один адрес и с одного IP отправляются без задержки,
+	// дальше включается нарастающая блокировка, как при входе
+	MailRecipientThreshold int
+	MailIPThreshold        int
+	MailLockoutBase        time.Duration
+	MailLockoutMax         time.Duration
+	MailRequestWindow      time.Duration
+
+	MailDriver    string
+	MailFrom      string
+	MailOutboxDir string
+	SMTPHost      string
+	SMTPPort      int
+	SMTPUsername  string
+	SMTPPassword  string
 }
 
 var (
@@ -16,17 +117,163 @@ var (
 
 func LoadConfig() *Config {
 	once.Do(func() {
-		// Получаем секретный ключ из переменных окружения
-		// Если переменная не установлена, используем значение по умолчанию
-		jwtSecret := os.Getenv("JWT_SECRET")
-		if jwtSecret == "" {
-			jwtSecret = "ewstrdygihuoio[p'i;ulykewfrawsgrfhdgtuky" // Значение по умолчанию
-		}
-
 		instance = &Config{
-			JWTSecret: jwtSecret,
+			JWTAlgorithm:   getEnv("JWT_ALGORITHM", "RS256"),
+			JWTIssuer:      getEnv("JWT_ISSUER", "forum"),
+			JWTKeyRotation: getDuration("JWT_KEY_ROTATION", 30*24*time.Hour),
+			JWTRSAKeyBits:  getInt("JWT_RSA_KEY_BITS", 2048),
+
+			AccessTokenTTL:  getDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+			RefreshTokenTTL: getDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+
+			AppBaseURL:       getEnv("APP_BASE_URL", "http://localhost:5173"),
+			PasswordResetTTL: getDuration("PASSWORD_RESET_TTL", time.Hour),
+
+			EmailVerificationTTL:     getDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour),
+			RequireEmailVerification: getBool("REQUIRE_EMAIL_VERIFICATION", false),
+
+			LoginLimiter:          getEnv("LOGIN_LIMITER", "memory"),
+			LoginAccountThreshold: getInt("LOGIN_ACCOUNT_THRESHOLD", 5),
+			LoginIPThreshold:      getInt("LOGIN_IP_THRESHOLD", 20),
+			LoginLockoutBase:      getDuration("LOGIN_LOCKOUT_BASE", 30*time.Second),
+			LoginLockoutMax:       getDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+			LoginFailureWindow:    getDuration("LOGIN_FAILURE_WINDOW", 24*time.Hour),
+
+			TOTPIssuer:      getEnv("TOTP_ISSUER", "Forum"),
+			RequireAdmin2FA: getBool("REQUIRE_ADMIN_2FA", false),
+
+			OIDCIssuer:        os.Getenv("OIDC_ISSUER"),
+			OIDCClientID:      os.Getenv("OIDC_CLIENT_ID"),
+			OIDCClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			OIDCRedirectURL:   getEnv("OIDC_REDIRECT_URL", "http://localhost:8081/api/oidc/callback"),
+			OIDCScopes:        getList("OIDC_SCOPES", " ", []string{"openid", "email", "profile"}),
+			OIDCProviderName:  getEnv("OIDC_PROVIDER_NAME", "oidc"),
+			OIDCGroupsClaim:   getEnv("OIDC_GROUPS_CLAIM", "groups"),
+			OIDCRoleMapping:   getList("OIDC_ROLE_MAPPING", ",", nil),
+			OIDCAutoProvision: getBool("OIDC_AUTO_PROVISION", true),
+
+			SearchLanguage: getEnv("SEARCH_LANGUAGE", "russian"),
+
+			MarkdownCacheSize:      getInt("MARKDOWN_CACHE_SIZE", 1000),
+			MarkdownHighlightStyle: getEnv("MARKDOWN_HIGHLIGHT_STYLE", "github"),
+
+			StorageDriver: getEnv("STORAGE_DRIVER", "local"),
+			StorageDir:    getEnv("STORAGE_DIR", "uploads"),
+			S3Endpoint:    os.Getenv("S3_ENDPOINT"),
+			S3Region:      getEnv("S3_REGION", "us-east-1"),
+			S3Bucket:      os.Getenv("S3_BUCKET"),
+			S3AccessKey:   os.Getenv("S3_ACCESS_KEY"),
+			S3SecretKey:   os.Getenv("S3_SECRET_KEY"),
+			S3PathStyle:   getBool("S3_PATH_STYLE", true),
+
+			MaxUploadSize: int64(getInt("MAX_UPLOAD_SIZE", 10<<20)),
+			AllowedUploadTypes: getList("ALLOWED_UPLOAD_TYPES", ",", []string{
+				"image/jpeg", "image/png", "image/gif", "image/webp",
+				"application/pdf", "application/zip", "text/plain",
+			}),
+
+			MaxImagePixels: getInt("MAX_IMAGE_PIXELS", 40_000_000),
+			MaxImageSide:   getInt("MAX_IMAGE_SIDE", 16384),
+			ImageWorkers:   getInt("IMAGE_WORKERS", 2),
+
+			Reactions: getList("REACTIONS", ",", []string{"👍", "❤️", "😂", "😮", "😢", "🎉"}),
+
+			MaxCommentDepth: getInt("MAX_COMMENT_DEPTH", 6),
+
+			ChatPingInterval:   getDuration("CHAT_PING_INTERVAL", defaultChatPingInterval),
+			ChatPongWait:       getDuration("CHAT_PONG_WAIT", defaultChatPongWait),
+			ChatWriteWait:      getDuration("CHAT_WRITE_WAIT", 10*time.Second),
+			ChatMaxMessageSize: int64(getInt("CHAT_MAX_MESSAGE_SIZE", 8<<10)),
+
+			MailRecipientThreshold: getInt("MAIL_RECIPIENT_THRESHOLD", 3),
+			MailIPThreshold:        getInt("MAIL_IP_THRESHOLD", 10),
+			MailLockoutBase:        getDuration("MAIL_LOCKOUT_BASE", 5*time.Minute),
+			MailLockoutMax:         getDuration("MAIL_LOCKOUT_MAX", 24*time.Hour),
+			MailRequestWindow:      getDuration("MAIL_REQUEST_WINDOW", time.Hour),
+
+			MailDriver:    getEnv("MAIL_DRIVER", "file"),
+			MailFrom:      getEnv("MAIL_FROM", "forum@localhost"),
+			MailOutboxDir: getEnv("MAIL_OUTBOX_DIR", "mail_outbox"),
+			SMTPHost:      getEnv("SMTP_HOST", "localhost"),
+			SMTPPort:      getInt("SMTP_PORT", 25),
+			SMTPUsername:  os.Getenv("SMTP_USERNAME"),
+			SMTPPassword:  os.Getenv("SMTP_PASSWORD"),
 		}
+		instance.checkChat()
 	})
 
 	return instance
 }
+
+const (
+	defaultChatPingInterval = 30 * time.Second
+	defaultChatPongWait     = 60 * time.Second
+)
+
+// checkChat возвращает тайм-ауты чата к значениям по умолчанию, если они
+// не положительны или ping шлётся не чаще, чем истекает ожидание pong
+func (c *Config) checkChat() {
+	if c.ChatPongWait <= 0 || c.ChatPingInterval <= 0 || c.ChatPingInterval >= c.ChatPongWait {
+		log.Printf("Invalid chat timeouts (ping interval %v, pong wait %v), using %v and %v",
+			c.ChatPingInterval, c.ChatPongWait, defaultChatPingInterval, defaultChatPongWait)
+		c.ChatPingInterval, c.ChatPongWait = defaultChatPingInterval, defaultChatPongWait
+	}
+	if c.ChatWriteWait <= 0 {
+		c.ChatWriteWait = 10 * time.Second
+	}
+	if c.ChatMaxMessageSize <= 0 {
+		c.ChatMaxMessageSize = 8 << 10
+	}
+}
+
+func getEnv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+func getInt(key string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// getList splits the variable by sep and drops empty items.
+func getList(key, sep string, def []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getBool(key string, def bool) bool {
+	b, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// getDuration reads a time.ParseDuration value such as "15m" or "720h".
+func getDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return def
+	}
+	return d
+}
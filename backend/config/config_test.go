@@ -0,0 +1,29 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckChat(t *testing.T) {
+	tests := []struct {
+		ping, pong         time.Duration
+		wantPing, wantPong time.Duration
+	}{
+		{10 * time.Second, 20 * time.Second, 10 * time.Second, 20 * time.Second},
+		{30 * time.Second, 0, defaultChatPingInterval, defaultChatPongWait},
+		{0, 60 * time.Second, defaultChatPingInterval, defaultChatPongWait},
+		{60 * time.Second, 60 * time.Second, defaultChatPingInterval, defaultChatPongWait},
+		{90 * time.Second, 60 * time.Second, defaultChatPingInterval, defaultChatPongWait},
+		{30 * time.Second, -time.Second, defaultChatPingInterval, defaultChatPongWait},
+	}
+
+	for _, tt := range tests {
+		c := &Config{ChatPingInterval: tt.ping, ChatPongWait: tt.pong, ChatWriteWait: time.Second, ChatMaxMessageSize: 1}
+		c.checkChat()
+		if c.ChatPingInterval != tt.wantPing || c.ChatPongWait != tt.wantPong {
+			t.Errorf("ping %v, pong %v: got %v, %v; want %v, %v",
+				tt.ping, tt.pong, c.ChatPingInterval, c.ChatPongWait, tt.wantPing, tt.wantPong)
+		}
+	}
+}
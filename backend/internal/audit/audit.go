@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Actions recorded in the audit log.
+const (
+	UserUpdate       = "user.update"
+	UserDelete       = "user.delete"
+	UserUnlock       = "user.unlock"
+	RoleCreate       = "role.create"
+	RoleUpdate       = "role.update"
+	RoleDelete       = "role.delete"
+	CategoryCreate   = "category.create"
+	CategoryUpdate   = "category.update"
+	CategoryDelete   = "category.delete"
+	TagRename        = "tag.rename"
+	TagMerge         = "tag.merge"
+	ChatRoomCreate   = "chat_room.create"
+	ChatRoomUpdate   = "chat_room.update"
+	ChatRoomDelete   = "chat_room.delete"
+	ChatMemberAdd    = "chat_member.add"
+	ChatMemberRemove = "chat_member.remove"
+	SanctionCreate   = "sanction.create"
+	SanctionRevoke   = "sanction.revoke"
+	PostUpdate       = "post.update"
+	PostDelete       = "post.delete"
+	PostRollback     = "post.rollback"
+	CommentUpdate    = "comment.update"
+	CommentDelete    = "comment.delete"
+	CommentRollback  = "comment.rollback"
+	AttachmentDelete = "attachment.delete"
+)
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func snapshot(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Record appends an entry to the audit log. Pass the transaction of the change
+// itself so that both commit or roll back together. before and after are
+// stored as JSON snapshots of the target; either may be nil.
+func Record(tx sqlx.Execer, r *http.Request, action, targetType string, targetID interface{}, before, after interface{}) error {
+	actorID, _ := r.Context().Value("user_id").(int64)
+
+	beforeJSON, err := snapshot(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := snapshot(after)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO audit_log (actor_id, actor_username, action, target_type, target_id, before, after, ip, created_at)
+		 VALUES ($1, (SELECT username FROM users WHERE id = $1), $2, $3, $4, $5, $6, $7, $8)`,
+		actorID, action, targetType, fmt.Sprint(targetID), beforeJSON, afterJSON, remoteIP(r), time.Now(),
+	)
+	return err
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Personal access tokens are long-lived credentials for bots and scripts.
+// The prefix lets AuthMiddleware tell them apart from JWTs without parsing.
+const accessTokenPrefix = "fpat_"
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// scopeRank orders scopes so that a broader scope implies the narrower ones.
+var scopeRank = map[string]int{
+	ScopeRead:  1,
+	ScopeWrite: 2,
+	ScopeAdmin: 3,
+}
+
+var ErrInvalidAccessToken = errors.New("invalid or expired access token")
+
+type PersonalAccessToken struct {
+	UserID int64
+	Role   string
+	Scopes []string
+}
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, accessTokenPrefix)
+}
+
+func ValidScope(scope string) bool {
+	_, ok := scopeRank[scope]
+	return ok
+}
+
+// ScopesAllow reports whether any of scopes grants required.
+func ScopesAllow(scopes []string, required string) bool {
+	for _, scope := range scopes {
+		if scopeRank[scope] >= scopeRank[required] {
+			return true
+		}
+	}
+	return false
+}
+
+// GeneratePersonalAccessToken returns the plaintext token, which is shown to
+// the user once, and the hash that goes into the database.
+func GeneratePersonalAccessToken() (token, hash string, err error) {
+	random, err := generateToken()
+	if err != nil {
+		return "", "", err
+	}
+	token = accessTokenPrefix + random
+	return token, hashToken(token), nil
+}
+
+// LookupPersonalAccessToken resolves a token to its owner and records its use.
+// The role is read from users so demoting an account also limits its tokens.
+func LookupPersonalAccessToken(db sqlx.Queryer, token string) (*PersonalAccessToken, error) {
+	var pat PersonalAccessToken
+	now := time.Now()
+	err := db.QueryRowx(
+		`UPDATE personal_access_tokens t SET last_used_at = $1
+		 FROM users u
+		 WHERE t.token_hash = $2 AND t.revoked_at IS NULL AND t.expires_at > $1 AND u.id = t.user_id
+		 RETURNING t.user_id, u.role, t.scopes`,
+		now, hashToken(token),
+	).Scan(&pat.UserID, &pat.Role, pq.Array(&pat.Scopes))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAccessToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pat, nil
+}
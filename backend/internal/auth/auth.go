@@ -3,11 +3,16 @@ package auth
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
 	"forum/config"
+	"forum/internal/mail"
+	"forum/internal/oidc"
+	"forum/internal/ratelimit"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/jmoiron/sqlx"
@@ -15,27 +20,47 @@ import (
 )
 
 type AuthService struct {
-	db  *sqlx.DB
-	cfg *config.Config
+	db     *sqlx.DB
+	cfg    *config.Config
+	mailer mail.Mailer
+
+	// Failed logins are counted per account and per client address.
+	accountLimiter ratelimit.Limiter
+	ipLimiter      ratelimit.Limiter
+	// Throttle emails sent on request per recipient and client address.
+	mailLimiter   ratelimit.Limiter
+	mailIPLimiter ratelimit.Limiter
+
+	// oidc is nil when single sign-on is not configured.
+	oidc *oidc.Provider
 }
 
-func NewAuthService(db *sqlx.DB) *AuthService {
+func NewAuthService(db *sqlx.DB, mailer mail.Mailer, accountLimiter, ipLimiter, mailLimiter, mailIPLimiter ratelimit.Limiter) *AuthService {
+	cfg := config.LoadConfig()
 	return &AuthService{
-		db:  db,
-		cfg: config.LoadConfig(),
+		db:             db,
+		cfg:            cfg,
+		mailer:         mailer,
+		accountLimiter: accountLimiter,
+		ipLimiter:      ipLimiter,
+		mailLimiter:    mailLimiter,
+		mailIPLimiter:  mailIPLimiter,
+		oidc:           newOIDCProvider(cfg),
 	}
 }
 
+const minPasswordLength = 6
+
 type Claims struct {
-	UserID int64  `json:"user_id"`
-	Role   string `json:"role"`
+	UserID    int64  `json:"user_id"`
+	Role      string `json:"role"`
+	SessionID int64  `json:"sid"`
+	MFA       bool   `json:"mfa,omitempty"`
+	// Scopes is only set for personal access tokens.
+	Scopes []string `json:"-"`
 	jwt.StandardClaims
 }
 
-const (
-	TokenExp = 24 * time.Hour
-)
-
 func (s *AuthService) Register(w http.ResponseWriter, r *http.Request) {
 	var user struct {
 		Username string `json:"username"`
@@ -48,7 +73,14 @@ func (s *AuthService) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(user.Password) < 6 {
+	email, err := mail.ParseAddress(strings.TrimSpace(user.Email))
+	if err != nil {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	user.Email = email
+
+	if len(user.Password) < minPasswordLength {
 		http.Error(w, "Password must be at least 6 characters long", http.StatusBadRequest)
 		return
 	}
@@ -73,6 +105,11 @@ func (s *AuthService) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The account already exists at this point; a failed email can be resent later.
+	if err := s.sendVerificationEmail(int64(id), user.Email); err != nil {
+		log.Printf("Failed to create verification token: %v", err)
+	}
+
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -87,47 +124,61 @@ func (s *AuthService) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.checkLoginAllowed(w, r, credentials.Email) {
+		return
+	}
+
 	var user struct {
-		ID       int    `db:"id"`
-		Password string `db:"password"`
-		Role     string `db:"role"`
+		ID          int    `db:"id"`
+		Password    string `db:"password"`
+		Role        string `db:"role"`
+		TOTPEnabled bool   `db:"totp_enabled"`
 	}
 
-	err := s.db.QueryRowx("SELECT id, password, role FROM users WHERE email = $1", credentials.Email).StructScan(&user)
+	err := s.db.QueryRowx(
+		"SELECT id, password, role, totp_enabled_at IS NOT NULL AS totp_enabled FROM users WHERE email = $1",
+		credentials.Email,
+	).StructScan(&user)
 	if err != nil {
+		s.recordLoginFailure(r, credentials.Email)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentials.Password))
 	if err != nil {
+		s.recordLoginFailure(r, credentials.Email)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	claims := Claims{
-		UserID: int64(user.ID),
-		Role:   user.Role,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(TokenExp).Unix(),
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(s.cfg.JWTSecret))
-	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+	if !s.checkNotBanned(w, int64(user.ID)) {
 		return
 	}
 
-	response := struct {
-		Token string `json:"token"`
-	}{
-		Token: tokenString,
+	if user.TOTPEnabled {
+		challengeToken, err := s.signChallengeToken(int64(user.ID))
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		response := struct {
+			TwoFactorRequired bool   `json:"two_factor_required"`
+			ChallengeToken    string `json:"challenge_token"`
+		}{
+			TwoFactorRequired: true,
+			ChallengeToken:    challengeToken,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	// With 2FA on, the counter is only cleared after the second step.
+	s.recordLoginSuccess(credentials.Email)
+	s.startSession(w, r, int64(user.ID), user.Role, false)
 }
 
 func (s *AuthService) ChangePassword(w http.ResponseWriter, r *http.Request) {
@@ -167,6 +218,12 @@ func (s *AuthService) ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sessionID, _ := r.Context().Value("session_id").(int64)
+	if err := RevokeUserSessions(s.db, userID, sessionID); err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -180,16 +237,24 @@ func hashPassword(password string) (string, error) {
 	return string(bytes), err
 }
 
+// ValidateToken checks an access token: signature against the key ring,
+// issuer, expiry, and that its session has not been revoked. Challenge tokens
+// from the first 2FA step are rejected.
 func ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+	if err := parseToken(tokenString, claims); err != nil {
+		return nil, err
+	}
+	if claims.Audience != "" || claims.SessionID == 0 {
+		return nil, errors.New("not an access token")
+	}
+
+	active, err := IsSessionActive(keyRing.db, claims.SessionID)
 	if err != nil {
 		return nil, err
 	}
-	if !token.Valid {
-		return nil, errors.New("invalid token")
+	if !active {
+		return nil, fmt.Errorf("session %d is not active", claims.SessionID)
 	}
 	return claims, nil
 }
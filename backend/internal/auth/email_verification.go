@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"forum/internal/mail"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sendVerificationEmail replaces any pending verification token of the user
+// with a new one and mails the confirmation link.
+func (s *AuthService) sendVerificationEmail(userID int64, email string) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = s.db.Exec("UPDATE email_verifications SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL", now, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO email_verifications (user_id, token_hash, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+		userID, hashToken(token), now, now.Add(s.cfg.EmailVerificationTTL),
+	)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", s.cfg.AppBaseURL, url.QueryEscape(token))
+	msg := mail.Message{
+		To:      email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf(
+			"Welcome to the forum!\n\n"+
+				"Open the link below to confirm your email address:\n%s\n\n"+
+				"The link expires in %s.\n",
+			link, s.cfg.EmailVerificationTTL,
+		),
+	}
+
+	go func() {
+		if err := s.mailer.Send(msg); err != nil {
+			log.Printf("Failed to send verification email: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// ResendVerification mails a fresh confirmation link to the current user. It
+// shares the throttle of ForgotPassword.
+func (s *AuthService) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int64)
+
+	var user struct {
+		Email    string `db:"email"`
+		Verified bool   `db:"verified"`
+	}
+	err := s.db.QueryRowx(
+		"SELECT email, email_verified_at IS NOT NULL AS verified FROM users WHERE id = $1", userID,
+	).StructScan(&user)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if user.Verified {
+		http.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+
+	if !s.checkMailAllowed(w, r, user.Email) {
+		return
+	}
+
+	if err := s.sendVerificationEmail(userID, user.Email); err != nil {
+		log.Printf("Failed to create verification token: %v", err)
+		http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmail confirms the address using a token from the verification email.
+func (s *AuthService) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var userID int64
+	err = tx.QueryRowx(
+		`UPDATE email_verifications SET used_at = $1
+		 WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+		 RETURNING user_id`,
+		now, hashToken(data.Token),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE users SET email_verified_at = $1 WHERE id = $2 AND email_verified_at IS NULL", now, userID)
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func IsEmailVerified(db sqlx.Queryer, userID int64) (bool, error) {
+	var verified bool
+	err := db.QueryRowx("SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&verified)
+	return verified, err
+}
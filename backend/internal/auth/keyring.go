@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"forum/config"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// keyCheckInterval is how often every instance reloads the ring from the
+	// database and rotates the signing key if it is due.
+	keyCheckInterval = time.Minute
+	// jwksMaxAge is how long verifiers may cache the JWKS. A new key is
+	// published this long before it starts signing.
+	jwksMaxAge = 5 * time.Minute
+)
+
+type signingKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.Signer
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+func (k *signingKey) publicKey() crypto.PublicKey {
+	return k.PrivateKey.Public()
+}
+
+// KeyRing holds the JWT signing keys. The newest key signs new tokens; older
+// keys stay in the ring, and in the JWKS, until every token they signed has
+// expired. Keys live in the jwt_keys table so all instances share them.
+type KeyRing struct {
+	db  *sqlx.DB
+	cfg *config.Config
+
+	mu   sync.RWMutex
+	keys []*signingKey // newest first
+}
+
+var keyRing *KeyRing
+
+// InitKeyRing loads the signing keys and creates the first one if needed.
+// It must be called before any token is issued or validated.
+func InitKeyRing(db *sqlx.DB) error {
+	ring := &KeyRing{db: db, cfg: config.LoadConfig()}
+	if err := ring.reload(); err != nil {
+		return err
+	}
+	if err := ring.rotateIfDue(); err != nil {
+		return err
+	}
+	keyRing = ring
+	return nil
+}
+
+// RunKeyRotation periodically picks up keys created by other instances and
+// rotates the signing key when it is older than config.JWTKeyRotation.
+func RunKeyRotation(stop <-chan struct{}) {
+	ticker := time.NewTicker(keyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := keyRing.reload(); err != nil {
+				log.Printf("Failed to reload signing keys: %v", err)
+				continue
+			}
+			if err := keyRing.rotateIfDue(); err != nil {
+				log.Printf("Failed to rotate signing key: %v", err)
+			}
+		}
+	}
+}
+
+func (k *KeyRing) reload() error {
+	rows, err := k.db.Query(
+		"SELECT kid, algorithm, private_key, created_at, expires_at FROM jwt_keys WHERE expires_at > $1 ORDER BY created_at DESC",
+		time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("error loading signing keys: %v", err)
+	}
+	defer rows.Close()
+
+	var keys []*signingKey
+	for rows.Next() {
+		var key signingKey
+		var algorithm, privatePEM string
+		if err := rows.Scan(&key.ID, &algorithm, &privatePEM, &key.CreatedAt, &key.ExpiresAt); err != nil {
+			return err
+		}
+
+		key.Method = jwt.GetSigningMethod(algorithm)
+		if key.Method == nil {
+			return fmt.Errorf("signing key %s has unknown algorithm %s", key.ID, algorithm)
+		}
+
+		block, _ := pem.Decode([]byte(privatePEM))
+		if block == nil {
+			return fmt.Errorf("signing key %s is not valid PEM", key.ID)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("error parsing signing key %s: %v", key.ID, err)
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("signing key %s can't sign", key.ID)
+		}
+		key.PrivateKey = signer
+
+		keys = append(keys, &key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *KeyRing) rotateIfDue() error {
+	k.mu.RLock()
+	due := len(k.keys) == 0 ||
+		time.Since(k.keys[0].CreatedAt) >= k.cfg.JWTKeyRotation ||
+		k.keys[0].Method.Alg() != k.cfg.JWTAlgorithm
+	k.mu.RUnlock()
+
+	if !due {
+		return nil
+	}
+	return k.rotate()
+}
+
+// rotate creates a new signing key. Tokens signed by the previous key remain
+// valid because its expires_at covers its signing period plus the longest
+// token lifetime.
+func (k *KeyRing) rotate() error {
+	var method jwt.SigningMethod
+	var signer crypto.Signer
+	var err error
+
+	switch k.cfg.JWTAlgorithm {
+	case "RS256":
+		method = jwt.SigningMethodRS256
+		signer, err = rsa.GenerateKey(rand.Reader, k.cfg.JWTRSAKeyBits)
+	case "EdDSA":
+		method = SigningMethodEdDSA
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %q", k.cfg.JWTAlgorithm)
+	}
+	if err != nil {
+		return fmt.Errorf("error generating signing key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return err
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	kid, err := generateToken()
+	if err != nil {
+		return err
+	}
+	kid = kid[:16]
+
+	now := time.Now()
+	expiresAt := now.Add(k.cfg.JWTKeyRotation + jwksMaxAge + k.cfg.AccessTokenTTL + keyCheckInterval)
+
+	_, err = k.db.Exec(
+		"INSERT INTO jwt_keys (kid, algorithm, private_key, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		kid, method.Alg(), string(privatePEM), now, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("error saving signing key: %v", err)
+	}
+
+	log.Printf("Rotated JWT signing key, new kid %s (%s)", kid, method.Alg())
+	return k.reload()
+}
+
+func (k *KeyRing) find(kid string) *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// current returns the newest key that has been published for at least
+// jwksMaxAge, falling back to the oldest key right after the first start.
+func (k *KeyRing) current() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if time.Since(key.CreatedAt) >= jwksMaxAge {
+			return key
+		}
+	}
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[len(k.keys)-1]
+}
+
+// signToken signs claims with the current key and sets the kid header.
+func signToken(claims jwt.Claims) (string, error) {
+	key := keyRing.current()
+	if key == nil {
+		return "", errors.New("no signing key available")
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
+// parseToken verifies the signature of tokenString against the ring. The
+// algorithm is taken from the key, never from the token header.
+func parseToken(tokenString string, claims *Claims) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := keyRing.find(kid)
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.publicKey(), nil
+	})
+	if err != nil {
+		return err
+	}
+	if !token.Valid {
+		return errors.New("invalid token")
+	}
+	if !claims.VerifyIssuer(keyRing.cfg.JWTIssuer, true) {
+		return errors.New("unexpected token issuer")
+	}
+	return nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS publishes the public halves of every key that may still have valid
+// tokens, so other services can verify forum tokens on their own.
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	keyRing.mu.RLock()
+	keys := make([]jwk, 0, len(keyRing.keys))
+	for _, key := range keyRing.keys {
+		entry := jwk{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch pub := key.publicKey().(type) {
+		case *rsa.PublicKey:
+			entry.Kty = "RSA"
+			entry.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			entry.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			entry.Kty = "OKP"
+			entry.Crv = "Ed25519"
+			entry.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		keys = append(keys, entry)
+	}
+	keyRing.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	json.NewEncoder(w).Encode(struct {
+		Keys []jwk `json:"keys"`
+	}{keys})
+}
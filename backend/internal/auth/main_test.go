@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"forum/internal/mail"
+	"forum/internal/ratelimit"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// testDB connects to the database in TEST_DATABASE_URL, which must have been
+// initialised from internal/database/init.sql. Tests that need it are
+// skipped otherwise.
+func testDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func testService(db *sqlx.DB, mailer mail.Mailer) *AuthService {
+	limiter := func() ratelimit.Limiter {
+		return ratelimit.NewMemoryLimiter(ratelimit.Policy{Threshold: 100, BaseDelay: time.Second, MaxDelay: time.Second, Window: time.Hour})
+	}
+	return NewAuthService(db, mailer, limiter(), limiter(), limiter(), limiter())
+}
+
+// createTestUser adds a user with the given password and removes it when the
+// test ends.
+func createTestUser(t *testing.T, db *sqlx.DB, password string) (int64, string) {
+	t.Helper()
+	hashed, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("test%d", time.Now().UnixNano())
+	email := name + "@example.com"
+
+	var id int64
+	err = db.QueryRow(
+		"INSERT INTO users (username, email, password, role, created_at, updated_at) VALUES ($1, $2, $3, 'user', $4, $4) RETURNING id",
+		name, email, hashed, time.Now(),
+	).Scan(&id)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM users WHERE id = $1", id) })
+	return id, email
+}
@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"forum/config"
+	"forum/internal/oidc"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+var (
+	errOIDCNoAccount   = errors.New("no forum account is linked to this identity")
+	usernameDisallowed = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+)
+
+// newOIDCProvider returns nil when single sign-on is not configured.
+func newOIDCProvider(cfg *config.Config) *oidc.Provider {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return oidc.NewProvider(
+		cfg.OIDCIssuer,
+		cfg.OIDCClientID,
+		cfg.OIDCClientSecret,
+		cfg.OIDCRedirectURL,
+		cfg.OIDCScopes,
+		cfg.OIDCGroupsClaim,
+	)
+}
+
+// OIDCLogin starts single sign-on: it remembers state, nonce and the PKCE
+// verifier and redirects the browser to the identity provider.
+func (s *AuthService) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	now := time.Now()
+	_, err := s.db.Exec(
+		"INSERT INTO oidc_states (state_hash, nonce, code_verifier, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		hashToken(state), nonce, verifier, now, now.Add(oidcStateTTL),
+	)
+	if err != nil {
+		log.Printf("Failed to store OIDC state: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := s.oidc.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		log.Printf("Failed to build OIDC authorization URL: %v", err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback finishes single sign-on and hands the forum tokens to the
+// frontend in the URL fragment, which never reaches any server log.
+func (s *AuthService) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		s.redirectOIDCResult(w, r, url.Values{"error": {errCode}})
+		return
+	}
+
+	var state struct {
+		Nonce        string `db:"nonce"`
+		CodeVerifier string `db:"code_verifier"`
+	}
+	err := s.db.QueryRowx(
+		"DELETE FROM oidc_states WHERE state_hash = $1 AND expires_at > $2 RETURNING nonce, code_verifier",
+		hashToken(query.Get("state")), time.Now(),
+	).StructScan(&state)
+	if err != nil {
+		s.redirectOIDCResult(w, r, url.Values{"error": {"invalid_state"}})
+		return
+	}
+
+	identity, err := s.oidc.Exchange(query.Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		s.redirectOIDCResult(w, r, url.Values{"error": {"login_failed"}})
+		return
+	}
+
+	userID, role, err := s.resolveOIDCUser(identity)
+	if err == errOIDCNoAccount {
+		s.redirectOIDCResult(w, r, url.Values{"error": {"no_account"}})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to resolve OIDC user %s: %v", identity.Subject, err)
+		s.redirectOIDCResult(w, r, url.Values{"error": {"login_failed"}})
+		return
+	}
+
+	ban, err := ActiveSanction(s.db, userID, SanctionBan)
+	if err != nil {
+		log.Printf("Failed to check bans of user %d: %v", userID, err)
+		s.redirectOIDCResult(w, r, url.Values{"error": {"login_failed"}})
+		return
+	}
+	if ban != nil {
+		s.redirectOIDCResult(w, r, url.Values{"error": {"banned"}, "error_description": {ban.Message()}})
+		return
+	}
+
+	// The IdP does not replace the local second factor: with TOTP on, the
+	// client has to complete the same challenge as after a password login.
+	var totpEnabled bool
+	err = s.db.QueryRowx("SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&totpEnabled)
+	if err != nil {
+		log.Printf("Failed to check 2FA of user %d: %v", userID, err)
+		s.redirectOIDCResult(w, r, url.Values{"error": {"login_failed"}})
+		return
+	}
+	if totpEnabled {
+		challengeToken, err := s.signChallengeToken(userID)
+		if err != nil {
+			log.Printf("Failed to sign challenge token: %v", err)
+			s.redirectOIDCResult(w, r, url.Values{"error": {"login_failed"}})
+			return
+		}
+		s.redirectOIDCResult(w, r, url.Values{
+			"two_factor_required": {"true"},
+			"challenge_token":     {challengeToken},
+		})
+		return
+	}
+
+	tokens, err := s.createSession(r, userID, role, oidcMFA(identity.AMR))
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		s.redirectOIDCResult(w, r, url.Values{"error": {"login_failed"}})
+		return
+	}
+
+	s.redirectOIDCResult(w, r, url.Values{
+		"token":         {tokens.Token},
+		"refresh_token": {tokens.RefreshToken},
+		"expires_in":    {fmt.Sprint(tokens.ExpiresIn)},
+	})
+}
+
+func (s *AuthService) redirectOIDCResult(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, s.cfg.AppBaseURL+"/oidc/callback#"+values.Encode(), http.StatusFound)
+}
+
+// resolveOIDCUser finds the forum account for an IdP identity: an existing
+// link, then an account with the same verified email, then a new account if
+// auto-provisioning is on. The role is synced from the IdP groups.
+func (s *AuthService) resolveOIDCUser(identity *oidc.Identity) (int64, string, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	provider := s.cfg.OIDCProviderName
+	now := time.Now()
+
+	var userID int64
+	err = tx.QueryRowx(
+		"SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2",
+		provider, identity.Subject,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		userID, err = s.linkOIDCUser(tx, identity)
+		if err != nil {
+			return 0, "", err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO user_identities (user_id, provider, subject, created_at) VALUES ($1, $2, $3, $4)",
+			userID, provider, identity.Subject, now,
+		)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	var role string
+	if err := tx.QueryRowx("SELECT role FROM users WHERE id = $1", userID).Scan(&role); err != nil {
+		return 0, "", err
+	}
+
+	if mapped, ok := s.mapOIDCRole(identity.Groups); ok && mapped != role {
+		if _, err := tx.Exec("UPDATE users SET role = $1, updated_at = $2 WHERE id = $3", mapped, now, userID); err != nil {
+			return 0, "", err
+		}
+		if err := RevokeUserSessions(tx, userID, 0); err != nil {
+			return 0, "", err
+		}
+		role = mapped
+	}
+
+	return userID, role, tx.Commit()
+}
+
+func (s *AuthService) linkOIDCUser(tx *sqlx.Tx, identity *oidc.Identity) (int64, error) {
+	now := time.Now()
+
+	// Only a verified email proves the IdP user owns the forum account.
+	if identity.EmailVerified && identity.Email != "" {
+		var account struct {
+			ID       int64 `db:"id"`
+			Verified bool  `db:"verified"`
+		}
+		err := tx.QueryRowx(
+			"SELECT id, email_verified_at IS NOT NULL AS verified FROM users WHERE lower(email) = lower($1) FOR UPDATE",
+			identity.Email,
+		).StructScan(&account)
+		if err == nil {
+			if !account.Verified {
+				// Anyone could have registered the address before its owner.
+				// Whatever they set up must not survive the owner's login.
+				if err := resetCredentials(tx, account.ID, now); err != nil {
+					return 0, err
+				}
+			}
+			return account.ID, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+
+	if !s.cfg.OIDCAutoProvision || identity.Email == "" {
+		return 0, errOIDCNoAccount
+	}
+
+	username, err := uniqueUsername(tx, identity)
+	if err != nil {
+		return 0, err
+	}
+
+	// The account has no usable password until the user sets one via reset.
+	random, err := generateToken()
+	if err != nil {
+		return 0, err
+	}
+	hashedPassword, err := hashPassword(random)
+	if err != nil {
+		return 0, err
+	}
+
+	var verifiedAt *time.Time
+	if identity.EmailVerified {
+		verifiedAt = &now
+	}
+
+	var userID int64
+	err = tx.QueryRowx(
+		`INSERT INTO users (username, email, password, role, email_verified_at, created_at, updated_at)
+		 VALUES ($1, $2, $3, 'user', $4, $5, $5) RETURNING id`,
+		username, identity.Email, hashedPassword, verifiedAt, now,
+	).Scan(&userID)
+	return userID, err
+}
+
+// resetCredentials takes over an account whose email was never verified:
+// it replaces the password with a random one, turns 2FA off and revokes all
+// sessions and personal access tokens, then marks the email verified.
+func resetCredentials(tx *sqlx.Tx, userID int64, now time.Time) error {
+	random, err := generateToken()
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := hashPassword(random)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE users SET password = $1, totp_secret = NULL, totp_enabled_at = NULL, email_verified_at = $2, updated_at = $2
+		 WHERE id = $3`,
+		hashedPassword, now, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"UPDATE personal_access_tokens SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL", now, userID,
+	); err != nil {
+		return err
+	}
+	return RevokeUserSessions(tx, userID, 0)
+}
+
+// uniqueUsername derives a free username from the IdP profile.
+func uniqueUsername(tx *sqlx.Tx, identity *oidc.Identity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+	base = usernameDisallowed.ReplaceAllString(base, "")
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 40 {
+		base = base[:40]
+	}
+
+	candidate := base
+	for i := 2; i < 100; i++ {
+		var exists bool
+		if err := tx.QueryRowx("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", candidate).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", base, i)
+	}
+	return "", errors.New("could not find a free username")
+}
+
+// mapOIDCRole applies config.OIDCRoleMapping ("group=role" entries, first
+// match wins). With a mapping configured the IdP is authoritative, so users in
+// none of the groups become plain users.
+func (s *AuthService) mapOIDCRole(groups []string) (string, bool) {
+	if len(s.cfg.OIDCRoleMapping) == 0 {
+		return "", false
+	}
+
+	member := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		member[g] = true
+	}
+
+	for _, entry := range s.cfg.OIDCRoleMapping {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 && member[strings.TrimSpace(parts[0])] {
+			return strings.TrimSpace(parts[1]), true
+		}
+	}
+	return "user", true
+}
+
+// oidcMFA reports whether the IdP says the login used a second factor (RFC 8176).
+func oidcMFA(amr []string) bool {
+	for _, method := range amr {
+		switch method {
+		case "mfa", "otp", "hwk", "swk", "sms":
+			return true
+		}
+	}
+	return false
+}
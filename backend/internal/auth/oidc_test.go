@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"forum/internal/oidc"
+	"forum/internal/oidc/oidctest"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jmoiron/sqlx"
+)
+
+// oidcLogin signs in through the test IdP and returns the values the
+// callback put in the fragment of its redirect.
+func oidcLogin(t *testing.T, s *AuthService, idp *oidctest.Server) url.Values {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.OIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("OIDCLogin status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	code, state, err := idp.Code(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+
+	callback := "/api/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode()
+	rec = httptest.NewRecorder()
+	s.OIDCCallback(rec, httptest.NewRequest(http.MethodGet, callback, nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("OIDCCallback status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// newOIDCTest sets up a service that signs in through a test IdP, which
+// vouches for the email of a new test user.
+func newOIDCTest(t *testing.T) (*sqlx.DB, *AuthService, *oidctest.Server, int64) {
+	t.Helper()
+	db := testDB(t)
+	if err := InitKeyRing(db); err != nil {
+		t.Fatalf("InitKeyRing: %v", err)
+	}
+
+	idp, err := oidctest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+
+	s := testService(db, nil)
+	s.oidc = oidc.NewProvider(idp.URL, "forum", "", "http://forum.test/api/oidc/callback", []string{"openid", "email"}, "groups")
+
+	userID, email := createTestUser(t, db, "password")
+	idp.Claims = oidctest.Static(jwt.MapClaims{
+		"sub":            fmt.Sprintf("subject-%d", time.Now().UnixNano()),
+		"email":          email,
+		"email_verified": true,
+	})
+	return db, s, idp, userID
+}
+
+func TestOIDCCallback(t *testing.T) {
+	db, s, idp, userID := newOIDCTest(t)
+	if _, err := db.Exec("UPDATE users SET email_verified_at = $1 WHERE id = $2", time.Now(), userID); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("session", func(t *testing.T) {
+		values := oidcLogin(t, s, idp)
+		if values.Get("error") != "" {
+			t.Fatalf("callback error = %q", values.Get("error"))
+		}
+		claims, err := ValidateToken(values.Get("token"))
+		if err != nil {
+			t.Fatalf("ValidateToken: %v", err)
+		}
+		if claims.UserID != userID {
+			t.Errorf("token is for user %d, want %d", claims.UserID, userID)
+		}
+	})
+
+	t.Run("two factor", func(t *testing.T) {
+		if _, err := db.Exec("UPDATE users SET totp_enabled_at = $1 WHERE id = $2", time.Now(), userID); err != nil {
+			t.Fatal(err)
+		}
+
+		values := oidcLogin(t, s, idp)
+		if values.Get("token") != "" || values.Get("refresh_token") != "" {
+			t.Fatal("callback issued a session although 2FA is enabled")
+		}
+		if values.Get("two_factor_required") != "true" {
+			t.Fatalf("two_factor_required = %q", values.Get("two_factor_required"))
+		}
+		challengeUser, err := s.parseChallengeToken(values.Get("challenge_token"))
+		if err != nil {
+			t.Fatalf("parseChallengeToken: %v", err)
+		}
+		if challengeUser != userID {
+			t.Errorf("challenge is for user %d, want %d", challengeUser, userID)
+		}
+	})
+}
+
+func TestOIDCLinkKeepsVerifiedAccount(t *testing.T) {
+	db, s, idp, userID := newOIDCTest(t)
+	if _, err := db.Exec("UPDATE users SET email_verified_at = $1 WHERE id = $2", time.Now(), userID); err != nil {
+		t.Fatal(err)
+	}
+
+	if values := oidcLogin(t, s, idp); values.Get("token") == "" {
+		t.Fatalf("callback error = %q", values.Get("error"))
+	}
+
+	var hashed string
+	if err := db.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&hashed); err != nil {
+		t.Fatal(err)
+	}
+	if !checkPasswordHash("password", hashed) {
+		t.Error("password of a verified account was reset")
+	}
+}
+
+// Someone may have registered the address before its owner signed in
+// through the IdP. Nothing they set up may keep working.
+func TestOIDCLinkResetsUnverifiedAccount(t *testing.T) {
+	db, s, idp, userID := newOIDCTest(t)
+	_, err := db.Exec("UPDATE users SET totp_secret = 'secret', totp_enabled_at = $1 WHERE id = $2", time.Now(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessionID int64
+	err = db.QueryRow(
+		`INSERT INTO sessions (user_id, refresh_token_hash, created_at, last_used_at, expires_at)
+		 VALUES ($1, $2, $3, $3, $4) RETURNING id`,
+		userID, fmt.Sprintf("attacker-%d", time.Now().UnixNano()), time.Now(), time.Now().Add(time.Hour),
+	).Scan(&sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := oidcLogin(t, s, idp)
+	if values.Get("token") == "" {
+		t.Fatalf("callback error = %q, two_factor_required = %q", values.Get("error"), values.Get("two_factor_required"))
+	}
+
+	var account struct {
+		Password    string `db:"password"`
+		Verified    bool   `db:"verified"`
+		TOTPEnabled bool   `db:"totp_enabled"`
+	}
+	err = db.QueryRowx(
+		`SELECT password, email_verified_at IS NOT NULL AS verified, totp_enabled_at IS NOT NULL AS totp_enabled
+		 FROM users WHERE id = $1`, userID,
+	).StructScan(&account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkPasswordHash("password", account.Password) {
+		t.Error("the old password still works")
+	}
+	if account.TOTPEnabled {
+		t.Error("2FA set up before the link is still on")
+	}
+	if !account.Verified {
+		t.Error("email is not marked verified")
+	}
+	if active, err := IsSessionActive(db, sessionID); err != nil || active {
+		t.Errorf("IsSessionActive = %v, %v; want the old session revoked", active, err)
+	}
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"forum/internal/mail"
+)
+
+// ForgotPassword mails a single-use reset link. It answers 202 whether or not
+// the email is registered so the endpoint can't be used to probe accounts.
+func (s *AuthService) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Email == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !s.checkMailAllowed(w, r, data.Email) {
+		return
+	}
+
+	// The lookup and every write happen in the background, so that the
+	// response time doesn't tell known emails from unknown ones.
+	go func() {
+		if err := s.sendPasswordReset(data.Email); err != nil {
+			log.Printf("Failed to send password reset email: %v", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordReset mails a reset link if the email belongs to an account.
+// Earlier links stay valid until they expire or one of them is used, so a
+// flood of requests can't keep the user from resetting.
+func (s *AuthService) sendPasswordReset(email string) error {
+	var userID int64
+	err := s.db.QueryRowx("SELECT id FROM users WHERE email = $1", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = s.db.Exec(
+		"INSERT INTO password_resets (user_id, token_hash, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+		userID, hashToken(token), now, now.Add(s.cfg.PasswordResetTTL),
+	)
+	if err != nil {
+		return fmt.Errorf("error storing password reset token: %v", err)
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", s.cfg.AppBaseURL, url.QueryEscape(token))
+	return s.mailer.Send(mail.Message{
+		To:      email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf(
+			"Someone requested a password reset for your forum account.\n\n"+
+				"Open the link below to choose a new password:\n%s\n\n"+
+				"The link expires in %s. If you did not request this, ignore this email.\n",
+			link, s.cfg.PasswordResetTTL,
+		),
+	})
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword and
+// logs the user out of every session.
+func (s *AuthService) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(data.NewPassword) < minPasswordLength {
+		http.Error(w, "Password must be at least 6 characters long", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := hashPassword(data.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var userID int64
+	err = tx.QueryRowx(
+		`UPDATE password_resets SET used_at = $1
+		 WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+		 RETURNING user_id`,
+		now, hashToken(data.Token),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	// Using one link invalidates the others.
+	_, err = tx.Exec("UPDATE password_resets SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL", now, userID)
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE users SET password = $1, updated_at = $2 WHERE id = $3", hashedPassword, now, userID)
+	if err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := RevokeUserSessions(tx, userID, 0); err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/mail"
+	"forum/internal/ratelimit"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var resetTokenPattern = regexp.MustCompile(`reset-password\?token=(\S+)`)
+
+// waitForMail returns the body of the first message in the outbox.
+func waitForMail(t *testing.T, dir string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+		if len(files) > 0 {
+			data, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no email was sent")
+	return ""
+}
+
+func TestForgotAndResetPassword(t *testing.T) {
+	db := testDB(t)
+	outbox := t.TempDir()
+	s := testService(db, &mail.FileOutbox{Dir: outbox, From: "forum@example.com"})
+	userID, email := createTestUser(t, db, "old-password")
+
+	rec := httptest.NewRecorder()
+	s.ForgotPassword(rec, httptest.NewRequest("POST", "/api/password/forgot", strings.NewReader(`{"email":"`+email+`"}`)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("forgot: status %d", rec.Code)
+	}
+
+	message := waitForMail(t, outbox)
+	if !strings.Contains(message, "To: "+email+"\r\n") {
+		t.Fatalf("message not addressed to %s:\n%s", email, message)
+	}
+	match := resetTokenPattern.FindStringSubmatch(message)
+	if match == nil {
+		t.Fatalf("no reset link in message:\n%s", message)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset := func() int {
+		rec := httptest.NewRecorder()
+		body := `{"token":"` + token + `","newPassword":"new-password"}`
+		s.ResetPassword(rec, httptest.NewRequest("POST", "/api/password/reset", strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := reset(); code != http.StatusOK {
+		t.Fatalf("reset: status %d", code)
+	}
+	if code := reset(); code != http.StatusBadRequest {
+		t.Fatalf("reusing the token: status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	var hashed string
+	if err := db.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&hashed); err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hashed), []byte("new-password")) != nil {
+		t.Fatal("password was not changed")
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	db := testDB(t)
+	outbox := t.TempDir()
+	s := testService(db, &mail.FileOutbox{Dir: outbox, From: "forum@example.com"})
+
+	rec := httptest.NewRecorder()
+	s.ForgotPassword(rec, httptest.NewRequest("POST", "/api/password/forgot", strings.NewReader(`{"email":"nobody@example.com"}`)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if files, _ := filepath.Glob(filepath.Join(outbox, "*.eml")); len(files) != 0 {
+		t.Fatalf("sent %d emails to an unknown address", len(files))
+	}
+}
+
+func TestForgotPasswordThrottle(t *testing.T) {
+	s := testService(nil, &mail.FileOutbox{Dir: t.TempDir()})
+	s.mailLimiter = ratelimit.NewMemoryLimiter(ratelimit.Policy{Threshold: 0, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+	// An earlier request locked the recipient.
+	if _, err := s.mailLimiter.Fail(mailKey("Victim@example.com ")); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ForgotPassword(rec, httptest.NewRequest("POST", "/api/password/forgot", strings.NewReader(`{"email":"victim@example.com"}`)))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After")
+	}
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"net/http"
+
+	"forum/config"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Permissions are granted to roles in the role_permissions table. Code only
+// ever checks permissions; role names are data that admins can define.
+const (
+	PermAdminAccess       = "admin.access"
+	PermUsersManage       = "users.manage"
+	PermRolesManage       = "roles.manage"
+	PermUsersSanction     = "users.sanction"
+	PermAuditRead         = "audit.read"
+	PermCategoriesManage  = "categories.manage"
+	PermTagsManage        = "tags.manage"
+	PermChatManage        = "chat.manage"
+	PermPostsEditAny      = "posts.edit.any"
+	PermPostsDeleteAny    = "posts.delete.any"
+	PermCommentsEditAny   = "comments.edit.any"
+	PermCommentsDeleteAny = "comments.delete.any"
+)
+
+// Permissions lists every known permission with a short description.
+var Permissions = map[string]string{
+	PermAdminAccess:       "Open the admin panel",
+	PermUsersManage:       "View, edit, delete and unlock user accounts",
+	PermRolesManage:       "Define roles and their permissions",
+	PermUsersSanction:     "Ban, suspend and mute users",
+	PermAuditRead:         "View and export the audit log",
+	PermCategoriesManage:  "Create, edit and delete categories and their access rules",
+	PermTagsManage:        "Rename and merge tags",
+	PermChatManage:        "Create, edit and delete chat rooms and invite members to private ones",
+	PermPostsEditAny:      "Edit posts of other users",
+	PermPostsDeleteAny:    "Delete posts of other users",
+	PermCommentsEditAny:   "Edit comments of other users",
+	PermCommentsDeleteAny: "Delete comments of other users",
+}
+
+// AdminRole is the built-in role that always holds every permission.
+const AdminRole = "admin"
+
+func ValidPermission(permission string) bool {
+	_, ok := Permissions[permission]
+	return ok
+}
+
+// HasPermission reports whether role grants permission. It is read from the
+// database on every call, so changes to a role apply immediately.
+func HasPermission(db sqlx.Queryer, role, permission string) (bool, error) {
+	if role == AdminRole {
+		return true, nil
+	}
+
+	var granted bool
+	err := db.QueryRowx(
+		"SELECT EXISTS(SELECT 1 FROM role_permissions WHERE role = $1 AND permission = $2)",
+		role, permission,
+	).Scan(&granted)
+	return granted, err
+}
+
+// CanManageRole reports whether a user with actorRole may give role to
+// someone, take it away, or act on an account that has it: admins may,
+// everyone else only when they hold every permission of role themselves.
+func CanManageRole(db sqlx.Queryer, actorRole, role string) (bool, error) {
+	if actorRole == AdminRole {
+		return true, nil
+	}
+	if role == AdminRole {
+		return false, nil
+	}
+
+	var missing bool
+	err := db.QueryRowx(
+		`SELECT EXISTS(SELECT 1 FROM role_permissions p WHERE p.role = $1
+		   AND NOT EXISTS(SELECT 1 FROM role_permissions a WHERE a.role = $2 AND a.permission = p.permission))`,
+		role, actorRole,
+	).Scan(&missing)
+	return !missing, err
+}
+
+// SecondFactorSatisfied reports whether the request may use any permission
+// when REQUIRE_ADMIN_2FA is on. Sessions need a second factor. Personal
+// access tokens need the admin scope, which is only issued from such a
+// session.
+func SecondFactorSatisfied(r *http.Request) bool {
+	if !config.LoadConfig().RequireAdmin2FA {
+		return true
+	}
+	if scopes, _ := r.Context().Value("scopes").([]string); scopes != nil {
+		return ScopesAllow(scopes, ScopeAdmin)
+	}
+	mfa, _ := r.Context().Value("mfa").(bool)
+	return mfa
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Sanction types from most to least severe. A ban blocks login, a suspension
+// makes the account read-only and a mute only silences it in chat.
+const (
+	SanctionBan        = "ban"
+	SanctionSuspension = "suspension"
+	SanctionMute       = "mute"
+)
+
+func ValidSanctionType(sanctionType string) bool {
+	switch sanctionType {
+	case SanctionBan, SanctionSuspension, SanctionMute:
+		return true
+	}
+	return false
+}
+
+type Sanction struct {
+	ID        int64      `db:"id"`
+	Type      string     `db:"type"`
+	Reason    string     `db:"reason"`
+	ExpiresAt *time.Time `db:"expires_at"`
+}
+
+// Message describes the sanction to the affected user.
+func (s *Sanction) Message() string {
+	verb := map[string]string{
+		SanctionBan:        "banned",
+		SanctionSuspension: "suspended",
+		SanctionMute:       "muted",
+	}[s.Type]
+
+	if s.ExpiresAt == nil {
+		return fmt.Sprintf("Account is permanently %s: %s", verb, s.Reason)
+	}
+	return fmt.Sprintf("Account is %s until %s: %s", verb, s.ExpiresAt.UTC().Format(time.RFC3339), s.Reason)
+}
+
+// ActiveSanction returns the most severe active sanction of the given types,
+// or nil if there is none.
+func ActiveSanction(db sqlx.Queryer, userID int64, types ...string) (*Sanction, error) {
+	var sanction Sanction
+	err := db.QueryRowx(
+		`SELECT id, type, reason, expires_at FROM sanctions
+		 WHERE user_id = $1 AND type = ANY($2) AND revoked_at IS NULL
+		   AND (expires_at IS NULL OR expires_at > $3)
+		 ORDER BY CASE type WHEN 'ban' THEN 0 WHEN 'suspension' THEN 1 ELSE 2 END,
+		          expires_at DESC NULLS FIRST
+		 LIMIT 1`,
+		userID, pq.Array(types), time.Now(),
+	).StructScan(&sanction)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sanction, nil
+}
+
+// checkNotBanned answers with 403 and returns false when the user is banned.
+func (s *AuthService) checkNotBanned(w http.ResponseWriter, userID int64) bool {
+	ban, err := ActiveSanction(s.db, userID, SanctionBan)
+	if err != nil {
+		log.Printf("Failed to check bans of user %d: %v", userID, err)
+		http.Error(w, "Failed to check account status", http.StatusInternalServerError)
+		return false
+	}
+	if ban != nil {
+		http.Error(w, ban.Message(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jmoiron/sqlx"
+)
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// generateToken returns a random URL-safe token.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is what gets stored in the database, so a leaked table does not
+// hand out usable tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *AuthService) signAccessToken(userID int64, role string, sessionID int64, mfa bool) (string, error) {
+	claims := Claims{
+		UserID:    userID,
+		Role:      role,
+		SessionID: sessionID,
+		MFA:       mfa,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    s.cfg.JWTIssuer,
+			ExpiresAt: time.Now().Add(s.cfg.AccessTokenTTL).Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+
+	return signToken(claims)
+}
+
+// startSession creates a sessions row and responds with an access/refresh token
+// pair. mfa records that the login passed a second factor.
+func (s *AuthService) startSession(w http.ResponseWriter, r *http.Request, userID int64, role string, mfa bool) {
+	tokens, err := s.createSession(r, userID, role, mfa)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (s *AuthService) createSession(r *http.Request, userID int64, role string, mfa bool) (*tokenResponse, error) {
+	refreshToken, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var sessionID int64
+	err = s.db.QueryRowx(
+		`INSERT INTO sessions (user_id, refresh_token_hash, user_agent, ip, mfa, created_at, last_used_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $6, $7) RETURNING id`,
+		userID,
+		hashToken(refreshToken),
+		r.UserAgent(),
+		clientIP(r),
+		mfa,
+		now,
+		now.Add(s.cfg.RefreshTokenTTL),
+	).Scan(&sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.newTokenResponse(userID, role, sessionID, mfa, refreshToken)
+}
+
+func (s *AuthService) newTokenResponse(userID int64, role string, sessionID int64, mfa bool, refreshToken string) (*tokenResponse, error) {
+	accessToken, err := s.signAccessToken(userID, role, sessionID, mfa)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(s.cfg.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// RefreshToken exchanges a valid refresh token for a new token pair. The old
+// refresh token stops working; presenting it again is treated as theft and
+// revokes the whole session.
+func (s *AuthService) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	newRefreshToken, err := generateToken()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	oldHash := hashToken(data.RefreshToken)
+
+	var session struct {
+		ID     int64  `db:"id"`
+		UserID int64  `db:"user_id"`
+		Role   string `db:"role"`
+		MFA    bool   `db:"mfa"`
+	}
+	err = s.db.QueryRowx(
+		`UPDATE sessions s
+		 SET refresh_token_hash = $1, previous_token_hash = $2, last_used_at = $3
+		 FROM users u
+		 WHERE s.refresh_token_hash = $2 AND s.revoked_at IS NULL AND s.expires_at > $3 AND u.id = s.user_id
+		 RETURNING s.id, s.user_id, u.role, s.mfa`,
+		hashToken(newRefreshToken),
+		oldHash,
+		now,
+	).StructScan(&session)
+	if err == sql.ErrNoRows {
+		result, err := s.db.Exec(
+			"UPDATE sessions SET revoked_at = $1 WHERE previous_token_hash = $2 AND revoked_at IS NULL",
+			now, oldHash,
+		)
+		if err == nil {
+			if n, _ := result.RowsAffected(); n > 0 {
+				log.Printf("Refresh token reuse detected, session revoked")
+			}
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to rotate refresh token: %v", err)
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := s.newTokenResponse(session.UserID, session.Role, session.ID, session.MFA, newRefreshToken)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Logout revokes the session the current access token belongs to.
+func (s *AuthService) Logout(w http.ResponseWriter, r *http.Request) {
+	sessionID, _ := r.Context().Value("session_id").(int64)
+
+	if err := RevokeSession(s.db, sessionID); err != nil {
+		http.Error(w, "Failed to logout", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// IsSessionActive reports whether the session exists, is not revoked and has not expired.
+func IsSessionActive(db sqlx.Queryer, sessionID int64) (bool, error) {
+	var active bool
+	err := db.QueryRowx(
+		"SELECT EXISTS(SELECT 1 FROM sessions WHERE id = $1 AND revoked_at IS NULL AND expires_at > $2)",
+		sessionID, time.Now(),
+	).Scan(&active)
+	return active, err
+}
+
+func RevokeSession(db sqlx.Execer, sessionID int64) error {
+	_, err := db.Exec(
+		"UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL",
+		time.Now(), sessionID,
+	)
+	return err
+}
+
+// RevokeUserSessions revokes every session of the user except exceptSessionID
+// (pass 0 to revoke all of them).
+func RevokeUserSessions(db sqlx.Execer, userID, exceptSessionID int64) error {
+	_, err := db.Exec(
+		"UPDATE sessions SET revoked_at = $1 WHERE user_id = $2 AND id <> $3 AND revoked_at IS NULL",
+		time.Now(), userID, exceptSessionID,
+	)
+	return err
+}
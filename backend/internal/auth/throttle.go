@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/internal/audit"
+	"forum/internal/ratelimit"
+
+	"github.com/gorilla/mux"
+)
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func writeLockout(w http.ResponseWriter, wait time.Duration, status int, message string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("%s, try again in %d seconds", message, seconds), status)
+}
+
+// checkLoginAllowed answers with 423/429 and returns false when the account or
+// the client address is locked out. Limiter errors are logged and let through
+// so that a database hiccup does not lock everybody out.
+func (s *AuthService) checkLoginAllowed(w http.ResponseWriter, r *http.Request, email string) bool {
+	wait, err := s.ipLimiter.Check(ipKey(clientIP(r)))
+	if err != nil {
+		log.Printf("Failed to check login limiter: %v", err)
+	} else if wait > 0 {
+		writeLockout(w, wait, http.StatusTooManyRequests, "Too many failed login attempts from this address")
+		return false
+	}
+
+	wait, err = s.accountLimiter.Check(accountKey(email))
+	if err != nil {
+		log.Printf("Failed to check login limiter: %v", err)
+	} else if wait > 0 {
+		writeLockout(w, wait, http.StatusLocked, "Account temporarily locked due to too many failed login attempts")
+		return false
+	}
+
+	return true
+}
+
+func (s *AuthService) recordLoginFailure(r *http.Request, email string) {
+	if _, err := s.ipLimiter.Fail(ipKey(clientIP(r))); err != nil {
+		log.Printf("Failed to record login failure: %v", err)
+	}
+
+	wait, err := s.accountLimiter.Fail(accountKey(email))
+	if err != nil {
+		log.Printf("Failed to record login failure: %v", err)
+		return
+	}
+	if wait > 0 {
+		log.Printf("Account %q locked for %s after failed logins from %s", email, wait, clientIP(r))
+	}
+}
+
+// recordLoginSuccess clears the account counter. The address counter is kept
+// so that one valid account can't be used to reset it.
+func (s *AuthService) recordLoginSuccess(email string) {
+	if err := s.accountLimiter.Reset(accountKey(email)); err != nil {
+		log.Printf("Failed to reset login limiter: %v", err)
+	}
+}
+
+func mailKey(email string) string {
+	return "mail:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func mailIPKey(ip string) string {
+	return "mail-ip:" + ip
+}
+
+// checkMailAllowed counts a request to send email to the address and answers
+// with 429 when the address or the client is over its limit. The count
+// doesn't depend on whether the address is registered.
+func (s *AuthService) checkMailAllowed(w http.ResponseWriter, r *http.Request, email string) bool {
+	wait, err := s.mailIPLimiter.Check(mailIPKey(clientIP(r)))
+	if err != nil {
+		log.Printf("Failed to check mail limiter: %v", err)
+	} else if wait > 0 {
+		writeLockout(w, wait, http.StatusTooManyRequests, "Too many emails requested from this address")
+		return false
+	}
+
+	wait, err = s.mailLimiter.Check(mailKey(email))
+	if err != nil {
+		log.Printf("Failed to check mail limiter: %v", err)
+	} else if wait > 0 {
+		writeLockout(w, wait, http.StatusTooManyRequests, "Too many emails requested for this account")
+		return false
+	}
+
+	if _, err := s.mailIPLimiter.Fail(mailIPKey(clientIP(r))); err != nil {
+		log.Printf("Failed to record mail request: %v", err)
+	}
+	if _, err := s.mailLimiter.Fail(mailKey(email)); err != nil {
+		log.Printf("Failed to record mail request: %v", err)
+	}
+	return true
+}
+
+// UnlockUser lifts a login lockout of an account. The actor must be able to
+// manage the account's role.
+func (s *AuthService) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var email, role string
+	if err := tx.QueryRowx("SELECT email, role FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&email, &role); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	actorRole, _ := r.Context().Value("user_role").(string)
+	allowed, err := CanManageRole(tx, actorRole, role)
+	if err != nil {
+		log.Printf("Failed to check role permissions: %v", err)
+		http.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Role "+role+" has permissions you don't have", http.StatusForbidden)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.UserUnlock, "user", userID, nil, nil); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+		http.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+		return
+	}
+
+	// A limiter in the database is reset in the same transaction. One in
+	// memory can't fail, so it is reset once the audit entry is committed.
+	txLimiter, inTx := s.accountLimiter.(ratelimit.TxLimiter)
+	if inTx {
+		if err := txLimiter.ResetTx(tx, accountKey(email)); err != nil {
+			http.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+		return
+	}
+
+	if !inTx {
+		if err := s.accountLimiter.Reset(accountKey(email)); err != nil {
+			http.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
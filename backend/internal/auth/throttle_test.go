@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"forum/internal/audit"
+	"forum/internal/ratelimit"
+
+	"github.com/gorilla/mux"
+)
+
+func TestUnlockUser(t *testing.T) {
+	db := testDB(t)
+	s := testService(db, nil)
+	userID, email := createTestUser(t, db, "password")
+
+	for _, limiter := range []ratelimit.Limiter{
+		ratelimit.NewMemoryLimiter(ratelimit.Policy{Threshold: 0, BaseDelay: time.Minute, MaxDelay: time.Minute, Window: time.Hour}),
+		ratelimit.NewPostgresLimiter(db, ratelimit.Policy{Threshold: 0, BaseDelay: time.Minute, MaxDelay: time.Minute, Window: time.Hour}),
+	} {
+		t.Run(fmt.Sprintf("%T", limiter), func(t *testing.T) {
+			s.accountLimiter = limiter
+			if _, err := limiter.Fail(accountKey(email)); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/admin/users/%d/unlock", userID), nil)
+			r = mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(userID)})
+			ctx := context.WithValue(r.Context(), "user_id", userID)
+			r = r.WithContext(context.WithValue(ctx, "user_role", AdminRole))
+			rec := httptest.NewRecorder()
+			s.UnlockUser(rec, r)
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+			}
+
+			if wait, err := limiter.Check(accountKey(email)); err != nil || wait != 0 {
+				t.Errorf("Check = %v, %v; want the account unlocked", wait, err)
+			}
+
+			var entries int
+			err := db.QueryRow(
+				"SELECT count(*) FROM audit_log WHERE action = $1 AND target_id = $2",
+				audit.UserUnlock, fmt.Sprint(userID),
+			).Scan(&entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entries == 0 {
+				t.Error("unlock was not written to the audit log")
+			}
+		})
+	}
+}
+
+func TestUnlockUserAboveActor(t *testing.T) {
+	db := testDB(t)
+	s := testService(db, nil)
+	userID, _ := createTestUser(t, db, "password")
+	if _, err := db.Exec("UPDATE users SET role = $1 WHERE id = $2", AdminRole, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/admin/users/%d/unlock", userID), nil)
+	r = mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(userID)})
+	r = r.WithContext(context.WithValue(r.Context(), "user_role", "moderator"))
+	rec := httptest.NewRecorder()
+	s.UnlockUser(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,378 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	challengeAudience  = "2fa-challenge"
+	challengeTTL       = 5 * time.Minute
+	recoveryCodesCount = 10
+)
+
+// signChallengeToken issues the short-lived token returned by the password
+// step of a 2FA login. It carries no session, so AuthMiddleware rejects it.
+func (s *AuthService) signChallengeToken(userID int64) (string, error) {
+	claims := Claims{
+		UserID: userID,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    s.cfg.JWTIssuer,
+			Audience:  challengeAudience,
+			ExpiresAt: time.Now().Add(challengeTTL).Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+
+	return signToken(claims)
+}
+
+func (s *AuthService) parseChallengeToken(tokenString string) (int64, error) {
+	claims := &Claims{}
+	if err := parseToken(tokenString, claims); err != nil {
+		return 0, err
+	}
+	if !claims.VerifyAudience(challengeAudience, true) {
+		return 0, errors.New("invalid challenge token")
+	}
+	return claims.UserID, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code. Both are consumed on success.
+func (s *AuthService) verifySecondFactor(userID int64, code string) (bool, error) {
+	var totp struct {
+		Secret   string `db:"totp_secret"`
+		LastStep int64  `db:"totp_last_step"`
+	}
+	err := s.db.QueryRowx(
+		"SELECT totp_secret, totp_last_step FROM users WHERE id = $1 AND totp_enabled_at IS NOT NULL",
+		userID,
+	).StructScan(&totp)
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := validateTOTP(totp.Secret, code, time.Now(), totp.LastStep); ok {
+		// The conditional update makes concurrent use of the same code fail.
+		result, err := s.db.Exec(
+			"UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1",
+			step, userID,
+		)
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		return n == 1, err
+	}
+
+	result, err := s.db.Exec(
+		"UPDATE totp_recovery_codes SET used_at = $1 WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL",
+		time.Now(), userID, hashToken(strings.ToLower(strings.TrimSpace(code))),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// replaceRecoveryCodes invalidates the user's old recovery codes and returns a new set.
+func (s *AuthService) replaceRecoveryCodes(userID int64) ([]string, error) {
+	codes, err := generateRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec(
+			"INSERT INTO totp_recovery_codes (user_id, code_hash, created_at) VALUES ($1, $2, $3)",
+			userID, hashToken(code), time.Now(),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// LoginTwoFactor completes a login started by Login for an account with 2FA.
+func (s *AuthService) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := s.parseChallengeToken(data.ChallengeToken)
+	if err != nil {
+		http.Error(w, "Invalid or expired challenge token", http.StatusUnauthorized)
+		return
+	}
+
+	var user struct {
+		Email string `db:"email"`
+		Role  string `db:"role"`
+	}
+	if err := s.db.QueryRowx("SELECT email, role FROM users WHERE id = $1", userID).StructScan(&user); err != nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.checkLoginAllowed(w, r, user.Email) {
+		return
+	}
+
+	ok, err := s.verifySecondFactor(userID, data.Code)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to verify second factor: %v", err)
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.recordLoginFailure(r, user.Email)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	s.recordLoginSuccess(user.Email)
+	if !s.checkNotBanned(w, userID) {
+		return
+	}
+	s.startSession(w, r, userID, user.Role, true)
+}
+
+// SetupTwoFactor generates a new pending TOTP secret. It only takes effect
+// after ConfirmTwoFactor.
+func (s *AuthService) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int64)
+
+	var user struct {
+		Email   string `db:"email"`
+		Enabled bool   `db:"enabled"`
+	}
+	err := s.db.QueryRowx(
+		"SELECT email, totp_enabled_at IS NOT NULL AS enabled FROM users WHERE id = $1", userID,
+	).StructScan(&user)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if user.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = s.db.Exec("UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2", secret, userID)
+	if err != nil {
+		http.Error(w, "Failed to save secret", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}{
+		Secret:     secret,
+		OTPAuthURI: totpURI(s.cfg.TOTPIssuer, user.Email, secret),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ConfirmTwoFactor enables 2FA once the user proves the authenticator works
+// and returns the one-time recovery codes.
+func (s *AuthService) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int64)
+
+	var data struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var user struct {
+		Secret  sql.NullString `db:"totp_secret"`
+		Enabled bool           `db:"enabled"`
+	}
+	err := s.db.QueryRowx(
+		"SELECT totp_secret, totp_enabled_at IS NOT NULL AS enabled FROM users WHERE id = $1", userID,
+	).StructScan(&user)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if user.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if !user.Secret.Valid {
+		http.Error(w, "Two-factor setup has not been started", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := validateTOTP(user.Secret.String, data.Code, time.Now(), 0)
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE users SET totp_enabled_at = $1, totp_last_step = $2 WHERE id = $3",
+		time.Now(), step, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := s.replaceRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("Failed to generate recovery codes: %v", err)
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes; it needs a valid second factor.
+func (s *AuthService) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int64)
+
+	var data struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := s.verifySecondFactor(userID, data.Code)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := s.replaceRecoveryCodes(userID)
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes})
+}
+
+// DisableTwoFactor turns 2FA off; it needs both the password and a second factor.
+func (s *AuthService) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int64)
+
+	var data struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var hashedPassword string
+	if err := s.db.QueryRowx("SELECT password FROM users WHERE id = $1", userID).Scan(&hashedPassword); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if !checkPasswordHash(data.Password, hashedPassword) {
+		http.Error(w, "Password is incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := s.verifySecondFactor(userID, data.Code)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = $1", userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID); err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Limits bound a connection. A peer that doesn't answer pings within
+// PongWait is considered dead.
+type Limits struct {
+	PingInterval   time.Duration // must be shorter than PongWait
+	PongWait       time.Duration
+	WriteWait      time.Duration // bounds every write, so that a stalled peer can't block its pump
+	MaxMessageSize int64
+}
+
+// Client is one chat connection. Its write pump is the only goroutine that
+// writes to the connection; the handler that created it is the only reader.
+type Client struct {
+	UserID int64
+
+	conn   *websocket.Conn
+	limits Limits
+	send   chan []byte
+	// Set by the hub before it closes send.
+	closeCode   int
+	closeReason string
+}
+
+func NewClient(conn *websocket.Conn, userID int64, limits Limits) *Client {
+	if limits.PingInterval <= 0 || limits.PingInterval >= limits.PongWait {
+		limits.PingInterval = limits.PongWait * 9 / 10
+	}
+
+	conn.SetReadLimit(limits.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(limits.PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(limits.PongWait))
+	})
+
+	return &Client{
+		UserID: userID,
+		conn:   conn,
+		limits: limits,
+		send:   make(chan []byte, sendQueueSize),
+	}
+}
+
+// ReadJSON reads the next message. It fails once the peer stops answering
+// pings or sends a message over the size limit.
+func (c *Client) ReadJSON(v interface{}) error {
+	return c.conn.ReadJSON(v)
+}
+
+// writePump writes queued messages and pings until the hub closes the queue,
+// then sends the close frame and closes the connection.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.limits.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			if !ok {
+				closeMessage := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				c.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(c.limits.WriteWait))
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(c.limits.WriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				// Closing the connection ends the read loop, which unregisters
+				// the client.
+				return
+			}
+
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.limits.WriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
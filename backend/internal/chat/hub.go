@@ -0,0 +1,309 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendQueueSize is how many messages may wait for a client. A client that
+// falls further behind is dropped, so that it can't hold up the others.
+const sendQueueSize = 64
+
+// Hub keeps track of the connected clients and the rooms they joined, and
+// fans messages out to them. Its maps are owned by the goroutine of Run;
+// everything else talks to it through channels. Whether a user may join a
+// room is up to the caller.
+type Hub struct {
+	clients    map[*Client]map[int64]bool // rooms joined by each client
+	rooms      map[int64]map[*Client]bool
+	register   chan *Client
+	unregister chan *Client
+	join       chan subscription
+	leave      chan subscription
+	joined     chan query
+	broadcast  chan roomMessage
+	direct     chan envelope
+	kick       chan kick
+	disconnect chan disconnect
+	done       chan struct{}
+	pumps      sync.WaitGroup
+}
+
+type subscription struct {
+	client *Client
+	room   int64
+}
+
+type query struct {
+	subscription
+	reply chan bool
+}
+
+type roomMessage struct {
+	room int64
+	data []byte
+}
+
+type envelope struct {
+	client *Client
+	data   []byte
+}
+
+type kick struct {
+	room int64
+	keep func(userID int64) bool
+	data []byte
+}
+
+type disconnect struct {
+	userID int64
+	code   int
+	reason string
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		clients:    make(map[*Client]map[int64]bool),
+		rooms:      make(map[int64]map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		join:       make(chan subscription),
+		leave:      make(chan subscription),
+		joined:     make(chan query),
+		broadcast:  make(chan roomMessage),
+		direct:     make(chan envelope),
+		kick:       make(chan kick),
+		disconnect: make(chan disconnect),
+		done:       make(chan struct{}),
+	}
+}
+
+// Run serves the hub until stop is closed, then closes every connection.
+// Wait reports when the close frames have been sent.
+func (h *Hub) Run(stop <-chan struct{}) {
+	defer close(h.done)
+
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = make(map[int64]bool)
+			h.pumps.Add(1)
+			go func() {
+				defer h.pumps.Done()
+				client.writePump()
+			}()
+
+		case client := <-h.unregister:
+			h.remove(client, websocket.CloseNormalClosure, "")
+
+		case s := <-h.join:
+			if rooms, ok := h.clients[s.client]; ok {
+				rooms[s.room] = true
+				if h.rooms[s.room] == nil {
+					h.rooms[s.room] = make(map[*Client]bool)
+				}
+				h.rooms[s.room][s.client] = true
+			}
+
+		case s := <-h.leave:
+			h.unsubscribe(s.client, s.room)
+
+		case q := <-h.joined:
+			q.reply <- h.clients[q.client][q.room]
+
+		case m := <-h.broadcast:
+			for client := range h.rooms[m.room] {
+				h.deliver(client, m.data)
+			}
+
+		case e := <-h.direct:
+			if _, ok := h.clients[e.client]; ok {
+				h.deliver(e.client, e.data)
+			}
+
+		case k := <-h.kick:
+			for client := range h.rooms[k.room] {
+				if k.keep == nil || !k.keep(client.UserID) {
+					h.unsubscribe(client, k.room)
+					h.deliver(client, k.data)
+				}
+			}
+
+		case d := <-h.disconnect:
+			for client := range h.clients {
+				if client.UserID == d.userID {
+					h.remove(client, d.code, d.reason)
+				}
+			}
+
+		case <-stop:
+			for client := range h.clients {
+				h.remove(client, websocket.CloseGoingAway, "Server is shutting down")
+			}
+			return
+		}
+	}
+}
+
+// deliver queues data for a client without waiting. A full queue means the
+// client doesn't keep up.
+func (h *Hub) deliver(client *Client, data []byte) {
+	select {
+	case client.send <- data:
+	default:
+		log.Printf("Chat: dropping slow client of user %d", client.UserID)
+		h.remove(client, websocket.CloseTryAgainLater, "Too slow")
+	}
+}
+
+func (h *Hub) unsubscribe(client *Client, room int64) {
+	delete(h.clients[client], room)
+	delete(h.rooms[room], client)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// remove closes the send queue of a client. Its write pump then sends the
+// close frame and closes the connection.
+func (h *Hub) remove(client *Client, code int, reason string) {
+	rooms, ok := h.clients[client]
+	if !ok {
+		return
+	}
+	for room := range rooms {
+		h.unsubscribe(client, room)
+	}
+	delete(h.clients, client)
+	client.closeCode, client.closeReason = code, reason
+	close(client.send)
+}
+
+// Wait blocks until Run has returned and every write pump has sent its close
+// frame, or until ctx is done.
+func (h *Hub) Wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		<-h.done
+		h.pumps.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Register adds a client and starts its write pump. It reports false when
+// the hub has stopped.
+func (h *Hub) Register(client *Client) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+func (h *Hub) Unregister(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
+}
+
+// Join subscribes a client to the messages of a room.
+func (h *Hub) Join(client *Client, room int64) {
+	select {
+	case h.join <- subscription{client, room}:
+	case <-h.done:
+	}
+}
+
+func (h *Hub) Leave(client *Client, room int64) {
+	select {
+	case h.leave <- subscription{client, room}:
+	case <-h.done:
+	}
+}
+
+// Joined reports whether a client is subscribed to a room. Kick and
+// DisconnectUser unsubscribe clients behind the back of their handler, so
+// this is the only reliable answer.
+func (h *Hub) Joined(client *Client, room int64) bool {
+	q := query{subscription{client, room}, make(chan bool, 1)}
+	select {
+	case h.joined <- q:
+		return <-q.reply
+	case <-h.done:
+		return false
+	}
+}
+
+// Broadcast sends v as JSON to every client in a room.
+func (h *Hub) Broadcast(room int64, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	select {
+	case h.broadcast <- roomMessage{room, data}:
+	case <-h.done:
+	}
+	return nil
+}
+
+// Send sends v as JSON to one client.
+func (h *Hub) Send(client *Client, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	select {
+	case h.direct <- envelope{client, data}:
+	case <-h.done:
+	}
+	return nil
+}
+
+// Kick unsubscribes the clients of the users that keep rejects from a room
+// and sends them v as JSON. A nil keep kicks everyone. keep runs on the
+// goroutine of Run and must not block.
+func (h *Hub) Kick(room int64, keep func(userID int64) bool, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	select {
+	case h.kick <- kick{room, keep, data}:
+	case <-h.done:
+	}
+	return nil
+}
+
+// DisconnectUser closes every connection of a user with a policy violation
+// close frame carrying the reason.
+func (h *Hub) DisconnectUser(userID int64, reason string) {
+	// Control frames are limited to 125 bytes, two of which hold the code.
+	// The cut must not split a character: browsers fail the connection on
+	// a reason that isn't valid UTF-8.
+	if len(reason) > 123 {
+		end := 120
+		for end > 0 && !utf8.RuneStart(reason[end]) {
+			end--
+		}
+		reason = reason[:end] + "..."
+	}
+	select {
+	case h.disconnect <- disconnect{userID, websocket.ClosePolicyViolation, reason}:
+	case <-h.done:
+	}
+}
@@ -0,0 +1,361 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+var testLimits = Limits{
+	PingInterval:   9 * time.Second,
+	PongWait:       10 * time.Second,
+	WriteWait:      5 * time.Second,
+	MaxMessageSize: 1 << 20,
+}
+
+// testHub runs a hub behind a WebSocket server. Every connection to it is
+// registered like the chat handler does, for the user in the query string.
+type testHub struct {
+	*Hub
+	t       *testing.T
+	server  *httptest.Server
+	clients chan *Client
+}
+
+func newTestHub(t *testing.T) *testHub {
+	t.Helper()
+	h := &testHub{Hub: NewHub(), t: t, clients: make(chan *Client, 1)}
+
+	stop := make(chan struct{})
+	go h.Run(stop)
+
+	upgrader := websocket.Upgrader{}
+	h.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.ParseInt(r.URL.Query().Get("user"), 10, 64)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(conn, userID, testLimits)
+		if !h.Register(client) {
+			conn.Close()
+			return
+		}
+		defer h.Unregister(client)
+		h.clients <- client
+
+		for {
+			var v interface{}
+			if err := client.ReadJSON(&v); err != nil {
+				return
+			}
+		}
+	}))
+
+	t.Cleanup(func() {
+		close(stop)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := h.Wait(ctx); err != nil {
+			t.Errorf("Wait: %v", err)
+		}
+		h.server.Close()
+	})
+	return h
+}
+
+// connect opens a connection for userID and returns the hub's client for it
+// and the peer's end.
+func (h *testHub) connect(userID int64) (*Client, *websocket.Conn) {
+	h.t.Helper()
+	url := "ws" + strings.TrimPrefix(h.server.URL, "http") + "/?user=" + strconv.FormatInt(userID, 10)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		h.t.Fatalf("Dial: %v", err)
+	}
+	h.t.Cleanup(func() { conn.Close() })
+
+	select {
+	case client := <-h.clients:
+		return client, conn
+	case <-time.After(5 * time.Second):
+		h.t.Fatal("client was not registered")
+		return nil, nil
+	}
+}
+
+type testMessage struct {
+	Text string `json:"text"`
+}
+
+func receive(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	var m testMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("Unmarshal %q: %v", data, err)
+	}
+	return m.Text
+}
+
+// receiveClose reads until the close frame and returns it.
+func receiveClose(t *testing.T, conn *websocket.Conn) *websocket.CloseError {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			if !ok {
+				t.Fatalf("ReadMessage: %v, want a close frame", err)
+			}
+			return closeErr
+		}
+	}
+}
+
+func TestRegisterAndUnregister(t *testing.T) {
+	h := newTestHub(t)
+	client, conn := h.connect(1)
+
+	h.Send(client, testMessage{"hello"})
+	if got := receive(t, conn); got != "hello" {
+		t.Errorf("received %q, want %q", got, "hello")
+	}
+
+	h.Join(client, 1)
+	if !h.Joined(client, 1) {
+		t.Fatal("client is not in the room it joined")
+	}
+
+	h.Unregister(client)
+	if closeErr := receiveClose(t, conn); closeErr.Code != websocket.CloseNormalClosure {
+		t.Errorf("close code = %d, want %d", closeErr.Code, websocket.CloseNormalClosure)
+	}
+	if h.Joined(client, 1) {
+		t.Error("unregistered client is still in the room")
+	}
+
+	// Messages to a client that is gone are dropped.
+	h.Send(client, testMessage{"late"})
+	h.Broadcast(1, testMessage{"late"})
+	h.Unregister(client)
+}
+
+func TestUnregisterOnDisconnect(t *testing.T) {
+	h := newTestHub(t)
+	client, conn := h.connect(1)
+	h.Join(client, 1)
+
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Joined(client, 1) {
+		if time.Now().After(deadline) {
+			t.Fatal("client was not unregistered after the peer went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	h := newTestHub(t)
+	alice, aliceConn := h.connect(1)
+	bob, bobConn := h.connect(2)
+	carol, carolConn := h.connect(3)
+
+	h.Join(alice, 1)
+	h.Join(bob, 1)
+	h.Join(carol, 2)
+
+	h.Broadcast(1, testMessage{"room 1"})
+	h.Broadcast(2, testMessage{"room 2"})
+
+	if got := receive(t, aliceConn); got != "room 1" {
+		t.Errorf("alice received %q", got)
+	}
+	if got := receive(t, bobConn); got != "room 1" {
+		t.Errorf("bob received %q", got)
+	}
+	if got := receive(t, carolConn); got != "room 2" {
+		t.Errorf("carol received %q, want only the message of her room", got)
+	}
+
+	h.Leave(bob, 1)
+	h.Broadcast(1, testMessage{"after leave"})
+	h.Send(bob, testMessage{"direct"})
+	if got := receive(t, aliceConn); got != "after leave" {
+		t.Errorf("alice received %q", got)
+	}
+	if got := receive(t, bobConn); got != "direct" {
+		t.Errorf("bob received %q after leaving the room", got)
+	}
+}
+
+func TestSlowClientIsDropped(t *testing.T) {
+	h := newTestHub(t)
+	slow, slowConn := h.connect(1)
+	fast, fastConn := h.connect(2)
+	h.Join(slow, 1)
+
+	// The peer of slow doesn't read, so its write pump blocks once the
+	// socket buffers are full and then its queue fills up.
+	payload := testMessage{strings.Repeat("x", 64<<10)}
+	for i := 0; h.Joined(slow, 1); i++ {
+		if i == 10000 {
+			t.Fatal("slow client was not dropped")
+		}
+		h.Broadcast(1, payload)
+	}
+
+	// Other clients are not held up.
+	h.Send(fast, testMessage{"still here"})
+	if got := receive(t, fastConn); got != "still here" {
+		t.Errorf("received %q", got)
+	}
+
+	closeErr := receiveClose(t, slowConn)
+	if closeErr.Code != websocket.CloseTryAgainLater {
+		t.Errorf("close code = %d, want %d", closeErr.Code, websocket.CloseTryAgainLater)
+	}
+}
+
+func TestKick(t *testing.T) {
+	h := newTestHub(t)
+	member, memberConn := h.connect(1)
+	other, otherConn := h.connect(2)
+	h.Join(member, 1)
+	h.Join(other, 1)
+	h.Join(other, 2)
+
+	h.Kick(1, func(userID int64) bool { return userID == 1 }, testMessage{"kicked"})
+	if got := receive(t, otherConn); got != "kicked" {
+		t.Errorf("kicked client received %q", got)
+	}
+	if h.Joined(other, 1) {
+		t.Error("kicked client is still in the room")
+	}
+	if !h.Joined(other, 2) {
+		t.Error("kicked client left its other rooms")
+	}
+	if !h.Joined(member, 1) {
+		t.Error("kept client was kicked")
+	}
+
+	h.Broadcast(1, testMessage{"members only"})
+	h.Send(other, testMessage{"direct"})
+	if got := receive(t, memberConn); got != "members only" {
+		t.Errorf("kept client received %q", got)
+	}
+	if got := receive(t, otherConn); got != "direct" {
+		t.Errorf("kicked client received %q", got)
+	}
+
+	// A nil keep kicks everyone.
+	h.Kick(1, nil, testMessage{"room deleted"})
+	if got := receive(t, memberConn); got != "room deleted" {
+		t.Errorf("received %q", got)
+	}
+	if h.Joined(member, 1) {
+		t.Error("client is still in the room")
+	}
+}
+
+func TestDisconnectUser(t *testing.T) {
+	h := newTestHub(t)
+	_, firstConn := h.connect(1)
+	_, secondConn := h.connect(1)
+	other, otherConn := h.connect(2)
+
+	reason := strings.Repeat("banned ", 30)
+	h.DisconnectUser(1, reason)
+
+	for _, conn := range []*websocket.Conn{firstConn, secondConn} {
+		closeErr := receiveClose(t, conn)
+		if closeErr.Code != websocket.ClosePolicyViolation {
+			t.Errorf("close code = %d, want %d", closeErr.Code, websocket.ClosePolicyViolation)
+		}
+		if !strings.HasPrefix(closeErr.Text, "banned") || len(closeErr.Text) > 123 {
+			t.Errorf("close reason = %q", closeErr.Text)
+		}
+	}
+
+	h.Send(other, testMessage{"still here"})
+	if got := receive(t, otherConn); got != "still here" {
+		t.Errorf("other user received %q", got)
+	}
+}
+
+func TestDisconnectUserNonASCIIReason(t *testing.T) {
+	h := newTestHub(t)
+	_, conn := h.connect(1)
+
+	// Two bytes per letter; byte 120 falls in the middle of one.
+	reason := strings.Repeat("бан ", 40)
+	h.DisconnectUser(1, reason)
+
+	closeErr := receiveClose(t, conn)
+	if closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("close code = %d, want %d", closeErr.Code, websocket.ClosePolicyViolation)
+	}
+	if !utf8.ValidString(closeErr.Text) || len(closeErr.Text) > 123 {
+		t.Errorf("close reason = %q", closeErr.Text)
+	}
+	if !strings.HasPrefix(reason, strings.TrimSuffix(closeErr.Text, "...")) {
+		t.Errorf("close reason %q is not a prefix of the reason", closeErr.Text)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h := NewHub()
+	stop := make(chan struct{})
+	go h.Run(stop)
+
+	registered := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(conn, 1, testLimits)
+		if h.Register(client) {
+			defer h.Unregister(client)
+			close(registered)
+			var v interface{}
+			for client.ReadJSON(&v) == nil {
+			}
+		}
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	<-registered
+
+	close(stop)
+	if closeErr := receiveClose(t, conn); closeErr.Code != websocket.CloseGoingAway {
+		t.Errorf("close code = %d, want %d", closeErr.Code, websocket.CloseGoingAway)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Wait(ctx); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if h.Register(NewClient(conn, 1, testLimits)) {
+		t.Error("Register succeeded after the hub stopped")
+	}
+}
@@ -1,36 +1,42 @@
 package database
 
 import (
-	"forum-go-vue/internal/models"
+	"forum/internal/models"
 )
 
-func SaveMessage(message models.ChatMessage) error {
-	query := `INSERT INTO chat_messages (content, user_id, reply_to_id, created_at)
-			  VALUES ($1, $2, $3, $4) RETURNING id`
-	return DB.QueryRow(query, message.Content, message.UserID, message.ReplyToID, message.CreatedAt).Scan(&message.ID)
+// SaveMessage stores a message and sets its ID.
+func SaveMessage(message *models.ChatMessage) error {
+	query := `INSERT INTO chat_messages (room_id, content, user_id, reply_to_id, created_at)
+			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	return DB.QueryRow(query, message.RoomID, message.Content, message.UserID, message.ReplyToID, message.CreatedAt).Scan(&message.ID)
 }
 
-func GetLastMessages(limit int) ([]models.ChatMessage, error) {
-	query := `SELECT id, content, user_id, reply_to_id, created_at
+// GetLastMessages returns the last messages of a room in chronological order.
+func GetLastMessages(roomID int64, limit int) ([]models.ChatMessage, error) {
+	query := `SELECT id, room_id, content, user_id, reply_to_id, created_at
 			  FROM chat_messages
-			  ORDER BY created_at DESC
-			  LIMIT $1`
+			  WHERE room_id = $1
+			  ORDER BY created_at DESC, id DESC
+			  LIMIT $2`
 
-	rows, err := DB.Query(query, limit)
+	rows, err := DB.Query(query, roomID, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []models.ChatMessage
+	messages := []models.ChatMessage{}
 	for rows.Next() {
 		var msg models.ChatMessage
-		err := rows.Scan(&msg.ID, &msg.Content, &msg.UserID, &msg.ReplyToID, &msg.CreatedAt)
+		err := rows.Scan(&msg.ID, &msg.RoomID, &msg.Content, &msg.UserID, &msg.ReplyToID, &msg.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
 		messages = append(messages, msg)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
 	// Reverse the slice to get messages in chronological order
 	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
@@ -42,10 +48,10 @@ func GetLastMessages(limit int) ([]models.ChatMessage, error) {
 
 func GetMessageByID(id int) (models.ChatMessage, error) {
 	var msg models.ChatMessage
-	query := `SELECT id, content, user_id, reply_to_id, created_at
+	query := `SELECT id, room_id, content, user_id, reply_to_id, created_at
 			  FROM chat_messages
 			  WHERE id = $1`
-	err := DB.QueryRow(query, id).Scan(&msg.ID, &msg.Content, &msg.UserID, &msg.ReplyToID, &msg.CreatedAt)
+	err := DB.QueryRow(query, id).Scan(&msg.ID, &msg.RoomID, &msg.Content, &msg.UserID, &msg.ReplyToID, &msg.CreatedAt)
 	return msg, err
 }
 
@@ -55,3 +61,46 @@ func GetUsernameByID(id int) (string, error) {
 	err := DB.QueryRow(query, id).Scan(&username)
 	return username, err
 }
+
+func GetChatRoomBySlug(slug string) (models.ChatRoom, error) {
+	var room models.ChatRoom
+	query := `SELECT id, slug, name, description, private, created_at
+			  FROM chat_rooms
+			  WHERE slug = $1`
+	err := DB.QueryRow(query, slug).Scan(&room.ID, &room.Slug, &room.Name, &room.Description, &room.Private, &room.CreatedAt)
+	return room, err
+}
+
+// GetChatRooms lists the public rooms and the private rooms the user is a
+// member of, or every room when all is set.
+func GetChatRooms(userID int64, all bool) ([]models.ChatRoom, error) {
+	query := `SELECT id, slug, name, description, private, created_at
+			  FROM chat_rooms r
+			  WHERE NOT r.private OR $2
+			     OR EXISTS(SELECT 1 FROM chat_room_members m WHERE m.room_id = r.id AND m.user_id = $1)
+			  ORDER BY name, id`
+
+	rows, err := DB.Query(query, userID, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []models.ChatRoom{}
+	for rows.Next() {
+		var room models.ChatRoom
+		err := rows.Scan(&room.ID, &room.Slug, &room.Name, &room.Description, &room.Private, &room.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func IsChatRoomMember(roomID, userID int64) (bool, error) {
+	var member bool
+	query := `SELECT EXISTS(SELECT 1 FROM chat_room_members WHERE room_id = $1 AND user_id = $2)`
+	err := DB.QueryRow(query, roomID, userID).Scan(&member)
+	return member, err
+}
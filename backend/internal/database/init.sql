@@ -2,23 +2,97 @@ CREATE DATABASE forum;
 
 \c forum;
 
+CREATE TABLE roles (
+    name VARCHAR(20) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    builtin BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The admin role is granted every permission in code and needs no rows here.
+CREATE TABLE role_permissions (
+    role VARCHAR(20) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    permission VARCHAR(50) NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO roles (name, description, builtin) VALUES
+    ('admin', 'Full access', TRUE),
+    ('moderator', 'Edits and deletes content of other users', TRUE),
+    ('user', 'Regular member', TRUE);
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('moderator', 'admin.access'),
+    ('moderator', 'users.sanction'),
+    ('moderator', 'posts.edit.any'),
+    ('moderator', 'posts.delete.any'),
+    ('moderator', 'comments.edit.any'),
+    ('moderator', 'comments.delete.any'),
+    ('moderator', 'tags.manage');
+
 CREATE TABLE users (
     id SERIAL PRIMARY KEY,
     username VARCHAR(50) NOT NULL UNIQUE,
     email VARCHAR(100) NOT NULL UNIQUE,
     password VARCHAR(100) NOT NULL,
-    role VARCHAR(20) NOT NULL DEFAULT 'user',
+    role VARCHAR(20) NOT NULL DEFAULT 'user' REFERENCES roles(name),
+    email_verified_at TIMESTAMP,
+    totp_secret VARCHAR(64),
+    totp_enabled_at TIMESTAMP,
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL
 );
 
+-- Empty role lists allow everyone: guests may read, any member may post and
+-- comment. The admin role is never restricted. Reading is inherited, so the
+-- children of a staff-only category are staff-only too.
+CREATE TABLE categories (
+    id SERIAL PRIMARY KEY,
+    parent_id INTEGER REFERENCES categories(id),
+    slug VARCHAR(50) NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    position INTEGER NOT NULL DEFAULT 0,
+    read_roles VARCHAR(20)[] NOT NULL DEFAULT '{}',
+    post_roles VARCHAR(20)[] NOT NULL DEFAULT '{}',
+    comment_roles VARCHAR(20)[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO categories (slug, name, description) VALUES
+    ('general', 'General', 'Everything else');
+
 CREATE TABLE posts (
     id SERIAL PRIMARY KEY,
     title VARCHAR(200) NOT NULL,
     content TEXT NOT NULL,
     author_id INTEGER NOT NULL REFERENCES users(id),
+    category_id INTEGER NOT NULL REFERENCES categories(id),
     created_at TIMESTAMP NOT NULL,
-    updated_at TIMESTAMP NOT NULL
+    updated_at TIMESTAMP NOT NULL,
+    -- Vote and reaction totals, kept by triggers on post_votes and post_reactions.
+    score INTEGER NOT NULL DEFAULT 0,
+    upvotes INTEGER NOT NULL DEFAULT 0,
+    downvotes INTEGER NOT NULL DEFAULT 0,
+    reaction_counts JSONB NOT NULL DEFAULT '{}',
+    -- The language is rewritten at startup when SEARCH_LANGUAGE differs.
+    search_vector tsvector GENERATED ALWAYS AS (
+        setweight(to_tsvector('russian', title), 'A') || setweight(to_tsvector('russian', content), 'B')
+    ) STORED
+);
+
+-- Tag names are stored lowercased; see normalizeTag.
+CREATE TABLE tags (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(30) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE post_tags (
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    PRIMARY KEY (post_id, tag_id)
 );
 
 CREATE TABLE comments (
@@ -26,21 +100,401 @@ CREATE TABLE comments (
     content TEXT NOT NULL,
     post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
     author_id INTEGER NOT NULL REFERENCES users(id),
+    -- Replies form a tree. path lists the IDs from the top-level comment down
+    -- to this one, so its length is the depth plus one.
+    parent_id INTEGER REFERENCES comments(id) ON DELETE CASCADE,
+    path INTEGER[] NOT NULL DEFAULT '{}',
+    -- A deleted comment that still has replies stays as a placeholder with
+    -- its content removed.
+    deleted_at TIMESTAMP,
     created_at TIMESTAMP NOT NULL,
-    updated_at TIMESTAMP NOT NULL
+    updated_at TIMESTAMP NOT NULL,
+    score INTEGER NOT NULL DEFAULT 0,
+    upvotes INTEGER NOT NULL DEFAULT 0,
+    downvotes INTEGER NOT NULL DEFAULT 0,
+    reaction_counts JSONB NOT NULL DEFAULT '{}',
+    search_vector tsvector GENERATED ALWAYS AS (to_tsvector('russian', content)) STORED
+);
+
+-- One vote and one reaction per user and post or comment.
+CREATE TABLE post_votes (
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    value SMALLINT NOT NULL CHECK (value IN (-1, 1)),
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (post_id, user_id)
+);
+
+CREATE TABLE comment_votes (
+    comment_id INTEGER NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    value SMALLINT NOT NULL CHECK (value IN (-1, 1)),
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (comment_id, user_id)
+);
+
+CREATE TABLE post_reactions (
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    emoji VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (post_id, user_id)
+);
+
+CREATE TABLE comment_reactions (
+    comment_id INTEGER NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    emoji VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (comment_id, user_id)
+);
+
+-- The totals are kept by triggers rather than by the handlers, so that they
+-- stay right when votes go with a deleted user. TG_ARGV[0] is the table that
+-- holds the totals and TG_ARGV[1] the column of the vote that refers to it.
+CREATE FUNCTION count_vote() RETURNS trigger AS $$
+DECLARE
+    query TEXT := format(
+        'UPDATE %I SET score = score + $2, upvotes = upvotes + $3, downvotes = downvotes + $4 WHERE id = $1',
+        TG_ARGV[0]
+    );
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        EXECUTE query USING (to_jsonb(OLD) ->> TG_ARGV[1])::int,
+            -OLD.value, -(OLD.value = 1)::int, -(OLD.value = -1)::int;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        EXECUTE query USING (to_jsonb(NEW) ->> TG_ARGV[1])::int,
+            NEW.value, (NEW.value = 1)::int, (NEW.value = -1)::int;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- reaction_counts maps an emoji to its count; emojis nobody uses are removed.
+CREATE FUNCTION count_reaction() RETURNS trigger AS $$
+DECLARE
+    query TEXT := format(
+        'UPDATE %I SET reaction_counts = CASE
+            WHEN COALESCE((reaction_counts ->> $2)::int, 0) + $3 > 0
+            THEN jsonb_set(reaction_counts, ARRAY[$2], to_jsonb(COALESCE((reaction_counts ->> $2)::int, 0) + $3))
+            ELSE reaction_counts - $2
+         END
+         WHERE id = $1',
+        TG_ARGV[0]
+    );
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        EXECUTE query USING (to_jsonb(OLD) ->> TG_ARGV[1])::int, OLD.emoji::text, -1;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        EXECUTE query USING (to_jsonb(NEW) ->> TG_ARGV[1])::int, NEW.emoji::text, 1;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER post_votes_count AFTER INSERT OR UPDATE OR DELETE ON post_votes
+    FOR EACH ROW EXECUTE FUNCTION count_vote('posts', 'post_id');
+CREATE TRIGGER comment_votes_count AFTER INSERT OR UPDATE OR DELETE ON comment_votes
+    FOR EACH ROW EXECUTE FUNCTION count_vote('comments', 'comment_id');
+CREATE TRIGGER post_reactions_count AFTER INSERT OR UPDATE OR DELETE ON post_reactions
+    FOR EACH ROW EXECUTE FUNCTION count_reaction('posts', 'post_id');
+CREATE TRIGGER comment_reactions_count AFTER INSERT OR UPDATE OR DELETE ON comment_reactions
+    FOR EACH ROW EXECUTE FUNCTION count_reaction('comments', 'comment_id');
+
+-- Every saved version of a post or comment. Revision 1 is the original text
+-- and each edit or rollback adds the next one.
+CREATE TABLE post_revisions (
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    title VARCHAR(200) NOT NULL,
+    content TEXT NOT NULL,
+    editor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (post_id, revision)
+);
+
+CREATE TABLE comment_revisions (
+    comment_id INTEGER NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    editor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (comment_id, revision)
+);
+
+-- Uploaded files. An attachment belongs to either a post or a comment; the
+-- file itself lives in the blob store under storage_key.
+CREATE TABLE attachments (
+    id SERIAL PRIMARY KEY,
+    post_id INTEGER REFERENCES posts(id) ON DELETE CASCADE,
+    comment_id INTEGER REFERENCES comments(id) ON DELETE CASCADE,
+    uploader_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    storage_key VARCHAR(255) NOT NULL UNIQUE,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    -- Images stay 'processing' until their metadata is stripped.
+    status VARCHAR(20) NOT NULL DEFAULT 'ready',
+    width INTEGER,
+    height INTEGER,
+    created_at TIMESTAMP NOT NULL,
+    CHECK ((post_id IS NULL) <> (comment_id IS NULL))
+);
+
+CREATE TABLE attachment_thumbnails (
+    attachment_id INTEGER NOT NULL REFERENCES attachments(id) ON DELETE CASCADE,
+    name VARCHAR(20) NOT NULL,
+    storage_key VARCHAR(255) NOT NULL UNIQUE,
+    content_type VARCHAR(100) NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    PRIMARY KEY (attachment_id, name)
+);
+
+-- Queue of the image pipeline. Workers claim a job by setting locked_until
+-- and retry failures later by moving run_at.
+CREATE TABLE image_jobs (
+    attachment_id INTEGER PRIMARY KEY REFERENCES attachments(id) ON DELETE CASCADE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    run_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP,
+    last_error TEXT NOT NULL DEFAULT ''
+);
+
+-- Keys of blobs whose attachments or thumbnails are gone. A background job
+-- deletes the files and then the rows.
+CREATE TABLE blob_deletions (
+    storage_key VARCHAR(255) PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE FUNCTION queue_blob_deletion() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO blob_deletions (storage_key) VALUES (OLD.storage_key) ON CONFLICT DO NOTHING;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER attachments_blob_deletion AFTER DELETE ON attachments
+    FOR EACH ROW EXECUTE FUNCTION queue_blob_deletion();
+CREATE TRIGGER attachment_thumbnails_blob_deletion AFTER DELETE ON attachment_thumbnails
+    FOR EACH ROW EXECUTE FUNCTION queue_blob_deletion();
+
+-- Anyone may join a public room; private rooms are open to their members,
+-- who are invited by an admin. The admin role is never restricted.
+CREATE TABLE chat_rooms (
+    id SERIAL PRIMARY KEY,
+    slug VARCHAR(50) NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    private BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO chat_rooms (slug, name, description) VALUES
+    ('general', 'General', 'Everything else'),
+    ('ops', 'Ops', 'Incidents, deploys and infrastructure'),
+    ('releases', 'Releases', 'Release planning and announcements');
+
+CREATE TABLE chat_room_members (
+    room_id INTEGER NOT NULL REFERENCES chat_rooms(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (room_id, user_id)
 );
 
 CREATE TABLE IF NOT EXISTS chat_messages (
     id SERIAL PRIMARY KEY,
+    room_id INTEGER NOT NULL REFERENCES chat_rooms(id) ON DELETE CASCADE,
     content TEXT NOT NULL,
     user_id INTEGER NOT NULL REFERENCES users(id),
     reply_to_id INTEGER REFERENCES chat_messages(id),
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    refresh_token_hash VARCHAR(64) NOT NULL UNIQUE,
+    previous_token_hash VARCHAR(64),
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    mfa BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+
+-- Private keys are stored as PKCS#8 PEM; restrict access to this table.
+CREATE TABLE jwt_keys (
+    kid VARCHAR(32) PRIMARY KEY,
+    algorithm VARCHAR(10) NOT NULL,
+    private_key TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE password_resets (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE TABLE email_verifications (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE TABLE totp_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE TABLE personal_access_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE TABLE login_attempts (
+    key VARCHAR(255) PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
+
+CREATE TABLE user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE (provider, subject)
+);
+
+CREATE TABLE oidc_states (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- expires_at is NULL for permanent bans.
+CREATE TABLE sanctions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(20) NOT NULL CHECK (type IN ('ban', 'suspension', 'mute')),
+    reason TEXT NOT NULL,
+    issued_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    revoked_by INTEGER REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Append-only: actor_id has no foreign key and the username is copied so that
+-- entries survive the deletion of the actor, and a trigger rejects changes.
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id INTEGER,
+    actor_username VARCHAR(50),
+    action VARCHAR(50) NOT NULL,
+    target_type VARCHAR(30) NOT NULL,
+    target_id VARCHAR(50) NOT NULL,
+    before JSONB,
+    after JSONB,
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE mail_outbox (
+    id SERIAL PRIMARY KEY,
+    recipient VARCHAR(100) NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
 CREATE INDEX idx_posts_author_id ON posts(author_id);
+CREATE INDEX idx_posts_category_id ON posts(category_id, created_at, id);
+CREATE INDEX idx_categories_parent_id ON categories(parent_id);
+CREATE INDEX idx_post_tags_tag_id ON post_tags(tag_id);
+-- Serves the prefix search of tag autocomplete.
+CREATE INDEX idx_tags_name_prefix ON tags(name varchar_pattern_ops);
 CREATE INDEX idx_comments_post_id ON comments(post_id);
+CREATE INDEX idx_comments_parent_id ON comments(parent_id);
+-- Threads are loaded by their top-level comment, the first ID of the path.
+CREATE INDEX idx_comments_thread ON comments(post_id, (path[1]));
+CREATE INDEX idx_comments_roots ON comments(post_id, created_at, id) WHERE parent_id IS NULL;
 CREATE INDEX idx_comments_author_id ON comments(author_id);
+CREATE INDEX idx_posts_score ON posts(score, created_at, id);
+CREATE INDEX idx_post_votes_user_id ON post_votes(user_id);
+CREATE INDEX idx_comment_votes_user_id ON comment_votes(user_id);
+CREATE INDEX idx_post_reactions_user_id ON post_reactions(user_id);
+CREATE INDEX idx_comment_reactions_user_id ON comment_reactions(user_id);
+CREATE INDEX idx_attachments_post_id ON attachments(post_id);
+CREATE INDEX idx_attachments_comment_id ON attachments(comment_id);
+CREATE INDEX idx_attachments_uploader_id ON attachments(uploader_id);
+CREATE INDEX idx_image_jobs_run_at ON image_jobs(run_at);
 CREATE INDEX IF NOT EXISTS idx_chat_messages_user_id ON chat_messages(user_id);
-CREATE INDEX IF NOT EXISTS idx_chat_messages_created_at ON chat_messages(created_at);
-CREATE INDEX IF NOT EXISTS idx_chat_messages_reply_to_id ON chat_messages(reply_to_id); 
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_chat_messages_room_created_at ON chat_messages(room_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_chat_messages_reply_to_id ON chat_messages(reply_to_id); 
+CREATE INDEX idx_chat_room_members_user_id ON chat_room_members(user_id);
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX idx_sessions_previous_token_hash ON sessions(previous_token_hash);
+CREATE INDEX idx_password_resets_user_id ON password_resets(user_id);
+CREATE INDEX idx_email_verifications_user_id ON email_verifications(user_id);
+CREATE INDEX idx_totp_recovery_codes_user_id ON totp_recovery_codes(user_id);
+CREATE INDEX idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
+CREATE INDEX idx_sanctions_user_id ON sanctions(user_id);
+CREATE INDEX idx_sanctions_created_at ON sanctions(created_at, id);
+CREATE INDEX idx_audit_log_actor_id ON audit_log(actor_id);
+CREATE INDEX idx_audit_log_target ON audit_log(target_type, target_id);
+CREATE INDEX idx_audit_log_created_at ON audit_log(created_at, id);
+
+-- Keyset pagination walks these (created_at, id) indexes backwards.
+CREATE INDEX idx_users_created_at ON users(created_at, id);
+CREATE INDEX idx_posts_created_at ON posts(created_at, id);
+CREATE INDEX idx_comments_created_at ON comments(created_at, id);
+
+-- Full-text search
+CREATE INDEX idx_posts_search_vector ON posts USING GIN (search_vector);
+CREATE INDEX idx_comments_search_vector ON comments USING GIN (search_vector);
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// searchColumns are the generated tsvector columns from init.sql. A generated
+// column needs a constant text search configuration, so %s is the language.
+var searchColumns = []struct {
+	table      string
+	expression string
+}{
+	{"posts", "setweight(to_tsvector('%[1]s', title), 'A') || setweight(to_tsvector('%[1]s', content), 'B')"},
+	{"comments", "to_tsvector('%[1]s', content)"},
+}
+
+// EnsureSearchLanguage rebuilds the search_vector columns and their GIN
+// indexes when they were generated with another language. The rebuild
+// rewrites the tables, so it only happens once after SEARCH_LANGUAGE changes.
+func EnsureSearchLanguage(language string) error {
+	var known bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_ts_config WHERE cfgname = $1)", language).Scan(&known)
+	if err != nil {
+		return fmt.Errorf("error checking search language: %v", err)
+	}
+	if !known {
+		return fmt.Errorf("unknown text search configuration %q", language)
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, column := range searchColumns {
+		var expression string
+		err := tx.QueryRow(
+			`SELECT generation_expression FROM information_schema.columns
+			 WHERE table_name = $1 AND column_name = 'search_vector'`, column.table,
+		).Scan(&expression)
+		if err != nil {
+			return fmt.Errorf("error reading %s.search_vector: %v", column.table, err)
+		}
+		if strings.Contains(expression, "'"+language+"'::regconfig") {
+			continue
+		}
+
+		log.Printf("Rebuilding %s.search_vector for language %q", column.table, language)
+		// language is a known configuration name, so it is safe to inline.
+		statements := []string{
+			fmt.Sprintf("ALTER TABLE %s DROP COLUMN search_vector", column.table),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (%s) STORED",
+				column.table, fmt.Sprintf(column.expression, language)),
+			fmt.Sprintf("CREATE INDEX idx_%[1]s_search_vector ON %[1]s USING GIN (search_vector)", column.table),
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return fmt.Errorf("error rebuilding %s.search_vector: %v", column.table, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
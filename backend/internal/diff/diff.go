@@ -0,0 +1,301 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type Op int
+
+const (
+	Equal Op = iota
+	Insert
+	Delete
+)
+
+func (op Op) String() string {
+	switch op {
+	case Insert:
+		return "insert"
+	case Delete:
+		return "delete"
+	default:
+		return "equal"
+	}
+}
+
+func (op Op) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+// Edit is one token of an edit script.
+type Edit struct {
+	Op   Op
+	Text string
+}
+
+// maxEdits bounds the work of the Myers algorithm, which is quadratic in the
+// number of edits. Beyond it the differing middle is replaced as a whole.
+const maxEdits = 2000
+
+// Diff returns the shortest edit script turning a into b.
+func Diff(a, b []string) []Edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []Edit
+	for _, token := range a[:prefix] {
+		edits = append(edits, Edit{Equal, token})
+	}
+	edits = append(edits, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, token := range a[len(a)-suffix:] {
+		edits = append(edits, Edit{Equal, token})
+	}
+	return edits
+}
+
+func myers(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+
+	// v[offset+k] is the furthest x reached on diagonal k. trace[d] keeps
+	// diagonals -d..d as they were before step d, for the backtrack.
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	for d := 0; d <= max; d++ {
+		if d > maxEdits {
+			return replace(a, b)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+	return replace(a, b)
+}
+
+func backtrack(trace [][]int, a, b []string) []Edit {
+	var reversed []Edit
+	x, y := len(a), len(b)
+
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[k-1+d] < v[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+d]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, Edit{Equal, a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			reversed = append(reversed, Edit{Insert, b[y-1]})
+			y--
+		} else {
+			reversed = append(reversed, Edit{Delete, a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, Edit{Equal, a[x-1]})
+		x--
+		y--
+	}
+
+	edits := make([]Edit, len(reversed))
+	for i, edit := range reversed {
+		edits[len(reversed)-1-i] = edit
+	}
+	return edits
+}
+
+func replace(a, b []string) []Edit {
+	edits := make([]Edit, 0, len(a)+len(b))
+	for _, token := range a {
+		edits = append(edits, Edit{Delete, token})
+	}
+	for _, token := range b {
+		edits = append(edits, Edit{Insert, token})
+	}
+	return edits
+}
+
+// Segment is a run of text with the same operation in a word-level diff.
+type Segment struct {
+	Op   Op     `json:"op"`
+	Text string `json:"text"`
+}
+
+// Words compares a and b word by word. Whitespace and punctuation are tokens
+// of their own, so joining the segments gives back the texts.
+func Words(a, b string) []Segment {
+	var segments []Segment
+	for _, edit := range Diff(splitWords(a), splitWords(b)) {
+		if n := len(segments); n > 0 && segments[n-1].Op == edit.Op {
+			segments[n-1].Text += edit.Text
+			continue
+		}
+		segments = append(segments, Segment{edit.Op, edit.Text})
+	}
+	if segments == nil {
+		segments = []Segment{}
+	}
+	return segments
+}
+
+// splitWords cuts s into runs of letters and digits, runs of whitespace and
+// single other characters.
+func splitWords(s string) []string {
+	class := func(r rune) int {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			return 1
+		case unicode.IsSpace(r):
+			return 2
+		default:
+			return 0
+		}
+	}
+
+	var tokens []string
+	start, prev := 0, -1
+	for i, r := range s {
+		c := class(r)
+		if i > start && (c != prev || c == 0) {
+			tokens = append(tokens, s[start:i])
+			start = i
+		}
+		prev = c
+	}
+	if start < len(s) {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+// Unified formats a line diff of a and b like diff -u with three lines of
+// context. It returns "" when the texts are equal.
+func Unified(a, b, fromLabel, toLabel string) string {
+	const context = 3
+
+	edits := Diff(strings.Split(a, "\n"), strings.Split(b, "\n"))
+
+	// Line numbers in a and b before each edit.
+	aLine := make([]int, len(edits)+1)
+	bLine := make([]int, len(edits)+1)
+	for i, edit := range edits {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if edit.Op != Insert {
+			aLine[i+1]++
+		}
+		if edit.Op != Delete {
+			bLine[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	prevStop := 0
+	for i := 0; i < len(edits); {
+		if edits[i].Op == Equal {
+			i++
+			continue
+		}
+
+		// Changes closer than twice the context share a hunk.
+		end := i
+		for j := i; j < len(edits); {
+			if edits[j].Op != Equal {
+				j++
+				end = j
+				continue
+			}
+			run := j
+			for run < len(edits) && edits[run].Op == Equal {
+				run++
+			}
+			if run == len(edits) || run-j > 2*context {
+				break
+			}
+			j = run
+		}
+
+		start := i - context
+		if start < prevStop {
+			start = prevStop
+		}
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromLabel, toLabel)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(aLine[start], aLine[stop]-aLine[start]), hunkRange(bLine[start], bLine[stop]-bLine[start]))
+		for _, edit := range edits[start:stop] {
+			switch edit.Op {
+			case Equal:
+				out.WriteString(" ")
+			case Insert:
+				out.WriteString("+")
+			case Delete:
+				out.WriteString("-")
+			}
+			out.WriteString(edit.Text)
+			out.WriteString("\n")
+		}
+
+		prevStop = stop
+		i = stop
+	}
+	return out.String()
+}
+
+// hunkRange formats the start,count pair of a hunk header; an empty range
+// points at the line before it, as in diff -u.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,124 @@
+package diff
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// apply rebuilds both sides from an edit script.
+func apply(edits []Edit) (a, b []string) {
+	for _, edit := range edits {
+		if edit.Op != Insert {
+			a = append(a, edit.Text)
+		}
+		if edit.Op != Delete {
+			b = append(b, edit.Text)
+		}
+	}
+	return a, b
+}
+
+func countOps(edits []Edit) map[Op]int {
+	counts := make(map[Op]int)
+	for _, edit := range edits {
+		counts[edit.Op]++
+	}
+	return counts
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Edit
+	}{
+		{"identical", "a b c", "a b c", []Edit{{Equal, "a"}, {Equal, "b"}, {Equal, "c"}}},
+		{"both empty", "", "", nil},
+		{"insert into empty", "", "a b", []Edit{{Insert, "a"}, {Insert, "b"}}},
+		{"delete everything", "a b", "", []Edit{{Delete, "a"}, {Delete, "b"}}},
+		{"insert in the middle", "a c", "a b c", []Edit{{Equal, "a"}, {Insert, "b"}, {Equal, "c"}}},
+		{"delete in the middle", "a b c", "a c", []Edit{{Equal, "a"}, {Delete, "b"}, {Equal, "c"}}},
+		{"replace", "a b c", "a x c", []Edit{{Equal, "a"}, {Delete, "b"}, {Insert, "x"}, {Equal, "c"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := strings.Fields(tt.a), strings.Fields(tt.b)
+			got := Diff(a, b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffIsShortest(t *testing.T) {
+	a := strings.Fields("the quick brown fox jumps over the lazy dog")
+	b := strings.Fields("a quick red fox jumped over the dog today")
+
+	edits := Diff(a, b)
+	gotA, gotB := apply(edits)
+	if !reflect.DeepEqual(gotA, a) || !reflect.DeepEqual(gotB, b) {
+		t.Fatalf("edit script rebuilds %v and %v", gotA, gotB)
+	}
+	// the→a, brown→red, jumps→jumped, -lazy, +today.
+	if counts := countOps(edits); counts[Delete]+counts[Insert] != 8 {
+		t.Errorf("edit script has %d deletions and %d insertions, want 8 edits", counts[Delete], counts[Insert])
+	}
+}
+
+func TestDiffFallsBackBeyondMaxEdits(t *testing.T) {
+	// "shared" moves from the end of the middle to its start. The shortest
+	// script keeps it, which takes 2n edits.
+	texts := func(n int) (a, b []string) {
+		a, b = []string{"start"}, []string{"start", "shared"}
+		for i := 0; i < n; i++ {
+			a = append(a, fmt.Sprintf("a%d", i))
+			b = append(b, fmt.Sprintf("b%d", i))
+		}
+		return append(a, "shared", "end"), append(b, "end")
+	}
+
+	a, b := texts(10)
+	if counts := countOps(Diff(a, b)); counts[Equal] != 3 {
+		t.Fatalf("below maxEdits, Diff kept %d tokens, want 3", counts[Equal])
+	}
+
+	a, b = texts(maxEdits)
+	edits := Diff(a, b)
+	gotA, gotB := apply(edits)
+	if !reflect.DeepEqual(gotA, a) || !reflect.DeepEqual(gotB, b) {
+		t.Fatal("fallback edit script doesn't rebuild the inputs")
+	}
+
+	// Beyond it, the middle is replaced as a whole.
+	want := append([]Edit{{Equal, "start"}}, replace(a[1:len(a)-1], b[1:len(b)-1])...)
+	want = append(want, Edit{Equal, "end"})
+	if !reflect.DeepEqual(edits, want) {
+		t.Errorf("Diff didn't replace the middle as a whole: %v", countOps(edits))
+	}
+}
+
+func TestWordsRebuildsTexts(t *testing.T) {
+	a := "Hello, world! How are you?"
+	b := "Hello, brave new world! How are you doing?"
+
+	var gotA, gotB strings.Builder
+	for _, segment := range Words(a, b) {
+		if segment.Op != Insert {
+			gotA.WriteString(segment.Text)
+		}
+		if segment.Op != Delete {
+			gotB.WriteString(segment.Text)
+		}
+	}
+	if gotA.String() != a || gotB.String() != b {
+		t.Errorf("segments rebuild %q and %q", gotA.String(), gotB.String())
+	}
+
+	if segments := Words(a, a); len(segments) != 1 || segments[0] != (Segment{Equal, a}) {
+		t.Errorf("Words of identical texts = %v, want one equal segment", segments)
+	}
+}
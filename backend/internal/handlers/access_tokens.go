@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"encoding/json"
+	"forum/internal/auth"
+	"forum/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultAccessTokenDays = 30
+	maxAccessTokenDays     = 365
+)
+
+// requireSession rejects requests authenticated with a personal access token,
+// so a leaked token can't be used to mint new ones.
+func requireSession(w http.ResponseWriter, r *http.Request) bool {
+	if sessionID, _ := r.Context().Value("session_id").(int64); sessionID == 0 {
+		http.Error(w, "Access tokens can only be managed from a login session", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h *ProfileHandler) GetAccessTokens(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+	userID := r.Context().Value("user_id").(int64)
+
+	query := `SELECT id, name, scopes, created_at, expires_at, last_used_at
+			  FROM personal_access_tokens
+			  WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+			  ORDER BY created_at DESC`
+
+	rows, err := h.db.Query(query, userID, time.Now())
+	if err != nil {
+		http.Error(w, "Failed to fetch access tokens", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []models.AccessToken{}
+	for rows.Next() {
+		var token models.AccessToken
+		err := rows.Scan(&token.ID, &token.Name, pq.Array(&token.Scopes), &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt)
+		if err != nil {
+			http.Error(w, "Failed to scan access token", http.StatusInternalServerError)
+			return
+		}
+		tokens = append(tokens, token)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (h *ProfileHandler) CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+	userID := r.Context().Value("user_id").(int64)
+
+	var req models.AccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Token name must be between 1 and 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if auth.ScopesAllow(req.Scopes, auth.ScopeAdmin) {
+		granted, err := hasPermission(r, auth.PermAdminAccess)
+		if err != nil {
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return
+		}
+		if !granted {
+			http.Error(w, "Admin access required for admin tokens", http.StatusForbidden)
+			return
+		}
+		if mfa, _ := r.Context().Value("mfa").(bool); h.cfg.RequireAdmin2FA && !mfa {
+			http.Error(w, "Two-factor authentication required for admin tokens", http.StatusForbidden)
+			return
+		}
+	}
+
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultAccessTokenDays
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAccessTokenDays {
+		http.Error(w, "expires_in_days must be between 1 and 365", http.StatusBadRequest)
+		return
+	}
+
+	plaintext, hash, err := auth.GeneratePersonalAccessToken()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	created := models.CreatedAccessToken{
+		AccessToken: models.AccessToken{
+			Name:      req.Name,
+			Scopes:    req.Scopes,
+			CreatedAt: time.Now(),
+		},
+		Token: plaintext,
+	}
+	created.ExpiresAt = created.CreatedAt.AddDate(0, 0, req.ExpiresInDays)
+
+	query := `INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+			  VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+	err = h.db.QueryRow(query, userID, created.Name, hash, pq.Array(created.Scopes), created.CreatedAt, created.ExpiresAt).Scan(&created.ID)
+	if err != nil {
+		http.Error(w, "Failed to create access token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (h *ProfileHandler) RevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+	userID := r.Context().Value("user_id").(int64)
+
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(
+		"UPDATE personal_access_tokens SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL",
+		time.Now(), tokenID, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to revoke access token", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Access token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,9 +1,15 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"forum/internal/audit"
+	"forum/internal/auth"
 	"forum/internal/database"
+	"forum/internal/markdown"
 	"forum/internal/models"
+	"forum/internal/pagination"
+	"log"
 	"net/http"
 	"strconv"
 
@@ -11,9 +17,20 @@ import (
 )
 
 func GetAllUsers(w http.ResponseWriter, r *http.Request) {
-	query := `SELECT id, username, email, role, created_at FROM users ORDER BY created_at DESC`
+	params, err := pagination.FromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	rows, err := database.DB.Query(query)
+	var args []interface{}
+	query := `SELECT id, username, email, role, created_at FROM users`
+	if condition := params.Where("created_at", "id", &args); condition != "" {
+		query += " WHERE " + condition
+	}
+	query += params.OrderBy("created_at", "id")
+
+	rows, err := database.DB.Query(query, args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 		return
@@ -31,7 +48,9 @@ func GetAllUsers(w http.ResponseWriter, r *http.Request) {
 		users = append(users, user)
 	}
 
-	json.NewEncoder(w).Encode(users)
+	json.NewEncoder(w).Encode(pagination.NewPage(users, params, func(user models.UserResponse) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: user.CreatedAt, ID: user.ID}
+	}))
 }
 
 func GetUser(w http.ResponseWriter, r *http.Request) {
@@ -68,11 +87,55 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `UPDATE users SET username = $1, email = $2, role = $3
+	exists, err := roleExists(database.DB, user.Role)
+	if err != nil {
+		http.Error(w, "Failed to check role", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Unknown role: "+user.Role, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.UserResponse
+	err = tx.QueryRow(`SELECT id, username, email, role, created_at FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(
+		&before.ID, &before.Username, &before.Email, &before.Role, &before.CreatedAt,
+	)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Without this, users.manage would be enough to make oneself or anyone
+	// else admin, or to take over an admin account through its email.
+	actorRole, _ := r.Context().Value("user_role").(string)
+	for _, role := range []string{before.Role, user.Role} {
+		allowed, err := auth.CanManageRole(tx, actorRole, role)
+		if err != nil {
+			log.Printf("Error checking role permissions: %v", err)
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Role "+role+" has permissions you don't have", http.StatusForbidden)
+			return
+		}
+	}
+
+	// A changed email has to be confirmed again.
+	query := `UPDATE users SET username = $1, email = $2, role = $3,
+			  email_verified_at = CASE WHEN email = $2 THEN email_verified_at END
 			  WHERE id = $4
 			  RETURNING id, username, email, role, created_at`
 
-	err = database.DB.QueryRow(query, user.Username, user.Email, user.Role, userID).Scan(
+	err = tx.QueryRow(query, user.Username, user.Email, user.Role, userID).Scan(
 		&user.ID, &user.Username, &user.Email, &user.Role, &user.CreatedAt,
 	)
 	if err != nil {
@@ -80,6 +143,26 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Tokens carry the role, so a role change must log the user out everywhere.
+	if user.Role != before.Role {
+		if err := auth.RevokeUserSessions(tx, userID, 0); err != nil {
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	after := models.UserResponse{ID: user.ID, Username: user.Username, Email: user.Email, Role: user.Role, CreatedAt: user.CreatedAt}
+	if err := audit.Record(tx, r, audit.UserUpdate, "user", userID, before, after); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
 	json.NewEncoder(w).Encode(user)
 }
 
@@ -91,9 +174,56 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `DELETE FROM users WHERE id = $1`
-	err = database.DB.QueryRow(query, userID).Scan()
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var role string
+	err = tx.QueryRow(`SELECT role FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting user: %v", err)
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	allowed, err := auth.CanManageRole(tx, requestRole(r), role)
+	if err != nil {
+		log.Printf("Error checking role permissions: %v", err)
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Role "+role+" has permissions you don't have", http.StatusForbidden)
+		return
+	}
+
+	var before models.UserResponse
+	err = tx.QueryRow(`DELETE FROM users WHERE id = $1 RETURNING id, username, email, role, created_at`, userID).Scan(
+		&before.ID, &before.Username, &before.Email, &before.Role, &before.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
+		log.Printf("Error deleting user: %v", err)
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.UserDelete, "user", userID, before, nil); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
 		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
 		return
 	}
@@ -102,13 +232,24 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetAllPosts(w http.ResponseWriter, r *http.Request) {
-	query := `SELECT p.id, p.title, p.content, p.author_id, p.created_at, p.updated_at,
-			  u.id, u.username, u.email, u.role, u.created_at
+	params, err := pagination.FromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args []interface{}
+	query := `SELECT p.id, p.title, p.content, p.author_id, p.category_id, p.created_at, p.updated_at,
+			  u.id, u.username, u.email, u.role, u.created_at,
+			  p.score, p.upvotes, p.downvotes, p.reaction_counts
 			  FROM posts p
-			  JOIN users u ON p.author_id = u.id
-			  ORDER BY p.created_at DESC`
+			  JOIN users u ON p.author_id = u.id`
+	if condition := params.Where("p.created_at", "p.id", &args); condition != "" {
+		query += " WHERE " + condition
+	}
+	query += params.OrderBy("p.created_at", "p.id")
 
-	rows, err := database.DB.Query(query)
+	rows, err := database.DB.Query(query, args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
 		return
@@ -120,28 +261,49 @@ func GetAllPosts(w http.ResponseWriter, r *http.Request) {
 		var post models.PostResponse
 		var author models.UserResponse
 		err := rows.Scan(
-			&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.CreatedAt, &post.UpdatedAt,
+			&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.CategoryID, &post.CreatedAt, &post.UpdatedAt,
 			&author.ID, &author.Username, &author.Email, &author.Role, &author.CreatedAt,
+			&post.Score, &post.Upvotes, &post.Downvotes, (*reactionCounts)(&post.Reactions),
 		)
 		if err != nil {
 			http.Error(w, "Failed to scan post", http.StatusInternalServerError)
 			return
 		}
 		post.Author = author
+		post.ContentHTML = markdown.Render(post.Content)
 		posts = append(posts, post)
 	}
+	if err := withPostAttachments(posts); err != nil {
+		log.Printf("Error fetching attachments: %v", err)
+		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+		return
+	}
+	if err := withPostVotes(r, posts); err != nil {
+		log.Printf("Error fetching votes: %v", err)
+		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+		return
+	}
 
-	json.NewEncoder(w).Encode(posts)
+	json.NewEncoder(w).Encode(pagination.NewPage(posts, params, postCursor))
 }
 
 func GetAllComments(w http.ResponseWriter, r *http.Request) {
-	query := `SELECT c.id, c.content, c.post_id, c.author_id, c.created_at, c.updated_at,
-			  u.id, u.username, u.email, u.role, u.created_at
+	params, err := pagination.FromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args []interface{}
+	query := `SELECT ` + commentColumns + `
 			  FROM comments c
-			  JOIN users u ON c.author_id = u.id
-			  ORDER BY c.created_at DESC`
+			  JOIN users u ON c.author_id = u.id`
+	if condition := params.Where("c.created_at", "c.id", &args); condition != "" {
+		query += " WHERE " + condition
+	}
+	query += params.OrderBy("c.created_at", "c.id")
 
-	rows, err := database.DB.Query(query)
+	rows, err := database.DB.Query(query, args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
 		return
@@ -150,22 +312,27 @@ func GetAllComments(w http.ResponseWriter, r *http.Request) {
 
 	var comments []models.CommentResponse
 	for rows.Next() {
-		var comment models.CommentResponse
-		var author models.UserResponse
-		var authorID int64
-		err := rows.Scan(
-			&comment.ID, &comment.Content, &comment.PostID, &authorID, &comment.CreatedAt, &comment.UpdatedAt,
-			&author.ID, &author.Username, &author.Email, &author.Role, &author.CreatedAt,
-		)
+		comment, err := scanComment(rows)
 		if err != nil {
 			http.Error(w, "Failed to scan comment", http.StatusInternalServerError)
 			return
 		}
-		comment.Author = author
 		comments = append(comments, comment)
 	}
+	if err := withCommentAttachments(comments); err != nil {
+		log.Printf("Error fetching attachments: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return
+	}
+	if err := withCommentVotes(r, comments); err != nil {
+		log.Printf("Error fetching votes: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return
+	}
 
-	json.NewEncoder(w).Encode(comments)
+	json.NewEncoder(w).Encode(pagination.NewPage(comments, params, func(comment models.CommentResponse) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: comment.CreatedAt, ID: comment.ID}
+	}))
 }
 
 func GetComment(w http.ResponseWriter, r *http.Request) {
@@ -176,23 +343,29 @@ func GetComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `SELECT c.id, c.content, c.post_id, c.author_id, c.created_at, c.updated_at,
-			  u.id, u.username, u.email, u.role, u.created_at
+	query := `SELECT ` + commentColumns + `
 			  FROM comments c
 			  JOIN users u ON c.author_id = u.id
 			  WHERE c.id = $1`
 
-	var comment models.CommentResponse
-	var author models.UserResponse
-	var authorID int64
-	err = database.DB.QueryRow(query, commentID).Scan(
-		&comment.ID, &comment.Content, &comment.PostID, &authorID, &comment.CreatedAt, &comment.UpdatedAt,
-		&author.ID, &author.Username, &author.Email, &author.Role, &author.CreatedAt,
-	)
+	comment, err := scanComment(database.DB.QueryRow(query, commentID))
 	if err != nil {
 		http.Error(w, "Comment not found", http.StatusNotFound)
 		return
 	}
-	comment.Author = author
+	attachments, err := commentAttachments.attachmentsOf(database.DB, []int64{comment.ID})
+	if err != nil {
+		log.Printf("Error fetching attachments: %v", err)
+		http.Error(w, "Failed to fetch comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := commentVotes.fill(r, []int64{comment.ID}, func(int) *models.Votes { return &comment.Votes }); err != nil {
+		log.Printf("Error fetching votes: %v", err)
+		http.Error(w, "Failed to fetch comment", http.StatusInternalServerError)
+		return
+	}
+
+	comment.Attachments = attachments[comment.ID]
 	json.NewEncoder(w).Encode(comment)
 }
@@ -0,0 +1,638 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"forum/config"
+	"forum/internal/audit"
+	"forum/internal/auth"
+	"forum/internal/database"
+	"forum/internal/imaging"
+	"forum/internal/models"
+	"forum/internal/storage"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const maxAttachments = 10
+
+// attachmentParent describes what attachments can belong to.
+type attachmentParent struct {
+	name   string // for error messages
+	table  string
+	column string
+	// ownerQuery returns the author and the category of the parent.
+	ownerQuery string
+	editAny    string
+}
+
+var (
+	postAttachments = attachmentParent{
+		name: "Post", table: "posts", column: "post_id",
+		ownerQuery: "SELECT author_id, category_id FROM posts WHERE id = $1",
+		editAny:    auth.PermPostsEditAny,
+	}
+	commentAttachments = attachmentParent{
+		name: "Comment", table: "comments", column: "comment_id",
+		ownerQuery: "SELECT c.author_id, p.category_id FROM comments c JOIN posts p ON p.id = c.post_id WHERE c.id = $1 AND c.deleted_at IS NULL",
+		editAny:    auth.PermCommentsEditAny,
+	}
+)
+
+const attachmentColumns = `a.id, a.post_id, a.comment_id, a.uploader_id, a.filename, a.content_type, a.size,
+	a.status, a.width, a.height, a.created_at,
+	ARRAY(SELECT t.name FROM attachment_thumbnails t WHERE t.attachment_id = a.id)`
+
+func scanAttachment(row interface{ Scan(...interface{}) error }, extra ...interface{}) (models.Attachment, error) {
+	var attachment models.Attachment
+	var thumbnails []string
+	err := row.Scan(append([]interface{}{
+		&attachment.ID, &attachment.PostID, &attachment.CommentID, &attachment.UploaderID,
+		&attachment.Filename, &attachment.ContentType, &attachment.Size,
+		&attachment.Status, &attachment.Width, &attachment.Height, &attachment.CreatedAt,
+		pq.Array(&thumbnails),
+	}, extra...)...)
+	attachment.URL = fmt.Sprintf("/api/attachments/%d", attachment.ID)
+	attachment.Thumbnails = make(map[string]string, len(thumbnails))
+	for _, name := range thumbnails {
+		attachment.Thumbnails[name] = fmt.Sprintf("/api/attachments/%d/thumbnails/%s", attachment.ID, name)
+	}
+	return attachment, err
+}
+
+// attachmentsOf loads the attachments of posts or comments keyed by their ID.
+// Every ID gets a list, empty if there is nothing attached.
+func (p attachmentParent) attachmentsOf(db sqlx.Queryer, ids []int64) (map[int64][]models.Attachment, error) {
+	attachments := make(map[int64][]models.Attachment, len(ids))
+	for _, id := range ids {
+		attachments[id] = []models.Attachment{}
+	}
+	if len(ids) == 0 {
+		return attachments, nil
+	}
+
+	rows, err := db.Query(fmt.Sprintf(
+		`SELECT %s FROM attachments a WHERE a.%s = ANY($1) ORDER BY a.id`, attachmentColumns, p.column,
+	), pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		parentID := attachment.PostID
+		if parentID == nil {
+			parentID = attachment.CommentID
+		}
+		attachments[*parentID] = append(attachments[*parentID], attachment)
+	}
+	return attachments, rows.Err()
+}
+
+func withPostAttachments(posts []models.PostResponse) error {
+	ids := make([]int64, len(posts))
+	for i, post := range posts {
+		ids[i] = post.ID
+	}
+	attachments, err := postAttachments.attachmentsOf(database.DB, ids)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Attachments = attachments[posts[i].ID]
+	}
+	return nil
+}
+
+func withCommentAttachments(comments []models.CommentResponse) error {
+	ids := make([]int64, len(comments))
+	for i, comment := range comments {
+		ids[i] = comment.ID
+	}
+	attachments, err := commentAttachments.attachmentsOf(database.DB, ids)
+	if err != nil {
+		return err
+	}
+	for i := range comments {
+		comments[i].Attachments = attachments[comments[i].ID]
+	}
+	return nil
+}
+
+type AttachmentHandler struct {
+	db    *sqlx.DB
+	store storage.BlobStore
+	cfg   *config.Config
+}
+
+func NewAttachmentHandler(db *sqlx.DB, store storage.BlobStore) *AttachmentHandler {
+	return &AttachmentHandler{
+		db:    db,
+		store: store,
+		cfg:   config.LoadConfig(),
+	}
+}
+
+// UploadPostAttachment takes a multipart/form-data request with the file in
+// the "file" field.
+func (h *AttachmentHandler) UploadPostAttachment(w http.ResponseWriter, r *http.Request) {
+	h.upload(w, r, postAttachments)
+}
+
+func (h *AttachmentHandler) UploadCommentAttachment(w http.ResponseWriter, r *http.Request) {
+	h.upload(w, r, commentAttachments)
+}
+
+func (h *AttachmentHandler) upload(w http.ResponseWriter, r *http.Request, parent attachmentParent) {
+	parentID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid "+strings.ToLower(parent.name)+" ID", http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value("user_id").(int64)
+
+	// Check access before reading the body, so that refused uploads are cheap.
+	var authorID, categoryID int64
+	err = h.db.QueryRow(parent.ownerQuery, parentID).Scan(&authorID, &categoryID)
+	if err == sql.ErrNoRows {
+		http.Error(w, parent.name+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+		return
+	}
+	tree, err := loadCategories(h.db)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+		return
+	}
+	if !tree.canRead(categoryID, requestRole(r)) {
+		http.Error(w, parent.name+" not found", http.StatusNotFound)
+		return
+	}
+	if authorID != userID {
+		editAny, err := hasPermission(r, parent.editAny)
+		if err != nil {
+			log.Printf("Error checking permission: %v", err)
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return
+		}
+		if !editAny {
+			http.Error(w, "You can only attach files to your own "+strings.ToLower(parent.name)+"s", http.StatusForbidden)
+			return
+		}
+	}
+
+	file, err := h.receiveFile(w, r)
+	if err != nil {
+		return
+	}
+	defer os.Remove(file.tmp.Name())
+	defer file.tmp.Close()
+
+	key, err := newStorageKey()
+	if err != nil {
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+		return
+	}
+	if err := h.store.Put(r.Context(), key, file.tmp, file.size, file.contentType); err != nil {
+		log.Printf("Error storing attachment: %v", err)
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+		return
+	}
+
+	attachment, status, err := h.insertAttachment(parent, parentID, userID, key, file)
+	if attachment != nil && attachment.Status == imaging.StatusProcessing {
+		imaging.Wake()
+	}
+	if err != nil {
+		// The row was never written, so nothing queues the blob for deletion.
+		if err := h.store.Delete(context.Background(), key); err != nil {
+			log.Printf("Error deleting unused blob %s: %v", key, err)
+		}
+		if status == http.StatusInternalServerError {
+			log.Printf("Error saving attachment: %v", err)
+			http.Error(w, "Failed to upload file", status)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+func (h *AttachmentHandler) insertAttachment(parent attachmentParent, parentID, userID int64, key string, file *receivedFile) (*models.Attachment, int, error) {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	// Lock the parent so that parallel uploads can't exceed the limit, and
+	// make sure it wasn't deleted in the meantime.
+	var locked int64
+	err = tx.QueryRow(fmt.Sprintf("SELECT id FROM %s WHERE id = $1 FOR UPDATE", parent.table), parentID).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return nil, http.StatusNotFound, fmt.Errorf("%s not found", parent.name)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var count int
+	err = tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM attachments WHERE %s = $1", parent.column), parentID).Scan(&count)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if count >= maxAttachments {
+		return nil, http.StatusBadRequest, fmt.Errorf("At most %d files can be attached", maxAttachments)
+	}
+
+	// Images are only served once the pipeline has stripped their metadata.
+	status := imaging.StatusReady
+	if imaging.Types[file.contentType] {
+		status = imaging.StatusProcessing
+	}
+
+	row := tx.QueryRow(fmt.Sprintf(
+		`INSERT INTO attachments AS a (%s, uploader_id, storage_key, filename, content_type, size, sha256, status, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		 RETURNING %s`, parent.column, attachmentColumns,
+	), parentID, userID, key, file.filename, file.contentType, file.size, file.sha256, status, time.Now())
+	attachment, err := scanAttachment(row)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if status == imaging.StatusProcessing {
+		if err := imaging.Enqueue(tx, attachment.ID); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return &attachment, http.StatusCreated, nil
+}
+
+// receivedFile is an uploaded file spooled to a temporary file.
+type receivedFile struct {
+	tmp         *os.File
+	filename    string
+	contentType string
+	size        int64
+	sha256      string
+}
+
+// receiveFile streams the "file" part of the request to a temporary file and
+// checks its size and type. The type is sniffed from the content; what the
+// client declares is ignored. Errors are answered before returning.
+func (h *AttachmentHandler) receiveFile(w http.ResponseWriter, r *http.Request) (*receivedFile, error) {
+	// Leave room for the multipart headers around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, h.cfg.MaxUploadSize+64<<10)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data request", http.StatusBadRequest)
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "The file field is missing", http.StatusBadRequest)
+			return nil, err
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return nil, err
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		defer part.Close()
+
+		tmp, err := os.CreateTemp("", "forum-upload-*")
+		if err != nil {
+			log.Printf("Error creating temporary file: %v", err)
+			http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+			return nil, err
+		}
+		file := &receivedFile{tmp: tmp, filename: sanitizeFilename(part.FileName())}
+		fail := func(message string, status int, err error) (*receivedFile, error) {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			http.Error(w, message, status)
+			return nil, err
+		}
+
+		hash := sha256.New()
+		file.size, err = io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(part, h.cfg.MaxUploadSize+1))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || file.size > h.cfg.MaxUploadSize {
+			return fail(fmt.Sprintf("The file is larger than %d bytes", h.cfg.MaxUploadSize), http.StatusRequestEntityTooLarge, errors.New("file too large"))
+		}
+		if err != nil {
+			return fail("Failed to read the file", http.StatusBadRequest, err)
+		}
+		if file.size == 0 {
+			return fail("The file is empty", http.StatusBadRequest, errors.New("empty file"))
+		}
+		file.sha256 = hex.EncodeToString(hash.Sum(nil))
+
+		head := make([]byte, 512)
+		n, err := tmp.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			return fail("Failed to upload file", http.StatusInternalServerError, err)
+		}
+		file.contentType = http.DetectContentType(head[:n])
+		if !h.allowedType(file.contentType) {
+			return fail("Files of type "+file.contentType+" are not allowed", http.StatusUnsupportedMediaType, errors.New("type not allowed"))
+		}
+
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return fail("Failed to upload file", http.StatusInternalServerError, err)
+		}
+		return file, nil
+	}
+}
+
+func (h *AttachmentHandler) allowedType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range h.cfg.AllowedUploadTypes {
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeFilename keeps the base name of what the client sent, without
+// control characters and within the column size.
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+func newStorageKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	return "attachments/" + id[:2] + "/" + id, nil
+}
+
+// storedAttachment is an attachment with the location and hash of its blob.
+type storedAttachment struct {
+	models.Attachment
+	key  string
+	hash string
+}
+
+// loadAttachment returns the attachment of the request, or answers 404 when
+// the current user can't read it.
+func (h *AttachmentHandler) loadAttachment(w http.ResponseWriter, r *http.Request) (*storedAttachment, bool) {
+	attachmentID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var stored storedAttachment
+	var categoryID int64
+	row := h.db.QueryRow(`SELECT `+attachmentColumns+`, a.storage_key, a.sha256, p.category_id
+		FROM attachments a
+		LEFT JOIN comments c ON c.id = a.comment_id
+		JOIN posts p ON p.id = COALESCE(a.post_id, c.post_id)
+		WHERE a.id = $1`, attachmentID)
+	stored.Attachment, err = scanAttachment(row, &stored.key, &stored.hash, &categoryID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error fetching attachment: %v", err)
+		http.Error(w, "Failed to fetch attachment", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	tree, err := loadCategories(h.db)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to fetch attachment", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !tree.canRead(categoryID, requestRole(r)) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return nil, false
+	}
+	return &stored, true
+}
+
+// DownloadAttachment serves the file. Images are shown inline, anything else
+// is offered as a download; neither may be sniffed or run as a page.
+func (h *AttachmentHandler) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := h.loadAttachment(w, r)
+	if !ok || !checkServable(w, attachment) {
+		return
+	}
+	h.serveBlob(w, r, blobInfo{
+		key: attachment.key, hash: attachment.hash, contentType: attachment.ContentType,
+		size: attachment.Size, filename: attachment.Filename,
+	})
+}
+
+// DownloadThumbnail serves a thumbnail of an image by size name.
+func (h *AttachmentHandler) DownloadThumbnail(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := h.loadAttachment(w, r)
+	if !ok || !checkServable(w, attachment) {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	blob := blobInfo{filename: attachment.Filename}
+	err := h.db.QueryRow(
+		"SELECT storage_key, sha256, content_type, size FROM attachment_thumbnails WHERE attachment_id = $1 AND name = $2",
+		attachment.ID, name,
+	).Scan(&blob.key, &blob.hash, &blob.contentType, &blob.size)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching thumbnail: %v", err)
+		http.Error(w, "Failed to fetch attachment", http.StatusInternalServerError)
+		return
+	}
+	blob.filename = strings.TrimSuffix(blob.filename, path.Ext(blob.filename)) + "-" + name + path.Ext(blob.filename)
+	h.serveBlob(w, r, blob)
+}
+
+// checkServable refuses images the pipeline hasn't cleaned up.
+func checkServable(w http.ResponseWriter, attachment *storedAttachment) bool {
+	switch attachment.Status {
+	case imaging.StatusProcessing:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "The image is still being processed", http.StatusConflict)
+		return false
+	case imaging.StatusFailed:
+		http.Error(w, "The image could not be processed", http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+type blobInfo struct {
+	key         string
+	hash        string
+	contentType string
+	size        int64
+	filename    string
+}
+
+func (h *AttachmentHandler) serveBlob(w http.ResponseWriter, r *http.Request, blob blobInfo) {
+	etag := `"` + blob.hash + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, err := h.store.Get(r.Context(), blob.key)
+	if err == storage.ErrNotFound {
+		log.Printf("Blob %s is missing", blob.key)
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading attachment: %v", err)
+		http.Error(w, "Failed to fetch attachment", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(blob.contentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", blob.contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(blob.size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": blob.filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("Error sending blob %s: %v", blob.key, err)
+	}
+}
+
+// DeleteAttachment removes an attachment. The uploader and moderators who may
+// edit the post or comment can do it; the file is deleted in the background.
+func (h *AttachmentHandler) DeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := h.loadAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int64)
+	if attachment.UploaderID == nil || *attachment.UploaderID != userID {
+		parent := postAttachments
+		if attachment.CommentID != nil {
+			parent = commentAttachments
+		}
+		editAny, err := hasPermission(r, parent.editAny)
+		if err != nil {
+			log.Printf("Error checking permission: %v", err)
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return
+		}
+		if !editAny {
+			http.Error(w, "Attachment not found or unauthorized", http.StatusNotFound)
+			return
+		}
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM attachments WHERE id = $1", attachment.ID)
+	if err != nil {
+		log.Printf("Error deleting attachment: %v", err)
+		http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	var uploaderID int64
+	if attachment.UploaderID != nil {
+		uploaderID = *attachment.UploaderID
+	}
+	if err := auditModeration(tx, r, uploaderID, audit.AttachmentDelete, "attachment", attachment.ID, attachment.Attachment, nil); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
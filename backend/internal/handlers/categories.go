@@ -0,0 +1,477 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"forum/internal/audit"
+	"forum/internal/auth"
+	"forum/internal/database"
+	"forum/internal/models"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var categorySlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,49}$`)
+
+const selectCategory = `SELECT id, parent_id, slug, name, description, position,
+			  read_roles, post_roles, comment_roles, created_at
+			  FROM categories`
+
+func scanCategory(row interface{ Scan(...interface{}) error }, category *models.Category) error {
+	err := row.Scan(
+		&category.ID, &category.ParentID, &category.Slug, &category.Name, &category.Description, &category.Position,
+		pq.Array(&category.ReadRoles), pq.Array(&category.PostRoles), pq.Array(&category.CommentRoles),
+		&category.CreatedAt,
+	)
+	for _, roles := range []*[]string{&category.ReadRoles, &category.PostRoles, &category.CommentRoles} {
+		if *roles == nil {
+			*roles = []string{}
+		}
+	}
+	return err
+}
+
+// requestRole is the role of the current user, or "" for guests.
+func requestRole(r *http.Request) string {
+	role, _ := r.Context().Value("user_role").(string)
+	return role
+}
+
+func roleAllowed(roles []string, role string) bool {
+	if role == auth.AdminRole || len(roles) == 0 {
+		return true
+	}
+	for _, allowed := range roles {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+// categoryTree holds every category by ID. A forum has few categories, so
+// access checks load them all rather than walking parents in SQL.
+type categoryTree map[int64]*models.Category
+
+func loadCategories(db sqlx.Queryer) (categoryTree, error) {
+	rows, err := db.Query(selectCategory)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tree := categoryTree{}
+	for rows.Next() {
+		var category models.Category
+		if err := scanCategory(rows, &category); err != nil {
+			return nil, err
+		}
+		tree[category.ID] = &category
+	}
+	return tree, rows.Err()
+}
+
+// canRead checks the read roles of the category and all of its parents.
+func (t categoryTree) canRead(id int64, role string) bool {
+	for depth := 0; depth <= len(t); depth++ {
+		category, ok := t[id]
+		if !ok || !roleAllowed(category.ReadRoles, role) {
+			return false
+		}
+		if category.ParentID == nil {
+			return true
+		}
+		id = *category.ParentID
+	}
+	return false
+}
+
+func (t categoryTree) canPost(id int64, role string) bool {
+	return role != "" && t.canRead(id, role) && roleAllowed(t[id].PostRoles, role)
+}
+
+func (t categoryTree) canComment(id int64, role string) bool {
+	return role != "" && t.canRead(id, role) && roleAllowed(t[id].CommentRoles, role)
+}
+
+// readable lists the IDs of the categories the role may read.
+func (t categoryTree) readable(role string) []int64 {
+	ids := []int64{}
+	for id := range t {
+		if t.canRead(id, role) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (t categoryTree) bySlug(slug string) *models.Category {
+	for _, category := range t {
+		if category.Slug == slug {
+			return category
+		}
+	}
+	return nil
+}
+
+// isAncestor reports whether ancestor is id itself or one of its parents.
+func (t categoryTree) isAncestor(ancestor, id int64) bool {
+	for depth := 0; depth <= len(t); depth++ {
+		if id == ancestor {
+			return true
+		}
+		category, ok := t[id]
+		if !ok || category.ParentID == nil {
+			return false
+		}
+		id = *category.ParentID
+	}
+	return false
+}
+
+// sorted returns the categories in display order with the permission flags
+// of role filled in.
+func (t categoryTree) sorted(role string) []models.Category {
+	categories := make([]models.Category, 0, len(t))
+	for _, category := range t {
+		category.CanPost = t.canPost(category.ID, role)
+		category.CanComment = t.canComment(category.ID, role)
+		categories = append(categories, *category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Position != categories[j].Position {
+			return categories[i].Position < categories[j].Position
+		}
+		return categories[i].Name < categories[j].Name
+	})
+	return categories
+}
+
+// postCategory returns the category of a post, or sql.ErrNoRows.
+func postCategory(db sqlx.Queryer, postID int64) (int64, error) {
+	var categoryID int64
+	err := db.QueryRowx("SELECT category_id FROM posts WHERE id = $1", postID).Scan(&categoryID)
+	return categoryID, err
+}
+
+// GetCategories lists the categories the current user may read. The client
+// builds the tree from parent_id.
+func GetCategories(w http.ResponseWriter, r *http.Request) {
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+		return
+	}
+
+	role := requestRole(r)
+	categories := []models.Category{}
+	for _, category := range tree.sorted(role) {
+		if tree.canRead(category.ID, role) {
+			categories = append(categories, category)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(categories)
+}
+
+// GetAllCategories lists every category for the admin panel.
+func GetAllCategories(w http.ResponseWriter, r *http.Request) {
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tree.sorted(requestRole(r)))
+}
+
+// validateCategory normalizes the request and checks the fields that don't
+// depend on other categories.
+func validateCategory(w http.ResponseWriter, tx *sqlx.Tx, req *models.CategoryRequest) bool {
+	req.Slug = strings.TrimSpace(req.Slug)
+	req.Name = strings.TrimSpace(req.Name)
+
+	if !categorySlugPattern.MatchString(req.Slug) {
+		http.Error(w, "Slug must be up to 50 lowercase letters, digits or '-'", http.StatusBadRequest)
+		return false
+	}
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Name must be 1-100 characters", http.StatusBadRequest)
+		return false
+	}
+
+	for _, roles := range []*[]string{&req.ReadRoles, &req.PostRoles, &req.CommentRoles} {
+		if *roles == nil {
+			*roles = []string{}
+		}
+		for _, role := range *roles {
+			exists, err := roleExists(tx, role)
+			if err != nil {
+				http.Error(w, "Failed to check roles", http.StatusInternalServerError)
+				return false
+			}
+			if !exists {
+				http.Error(w, "Unknown role: "+role, http.StatusBadRequest)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func slugTaken(tx *sqlx.Tx, slug string, exceptID int64) (bool, error) {
+	var taken bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE slug = $1 AND id <> $2)", slug, exceptID).Scan(&taken)
+	return taken, err
+}
+
+func CreateCategory(w http.ResponseWriter, r *http.Request) {
+	var req models.CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to create category", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if !validateCategory(w, tx, &req) {
+		return
+	}
+
+	// Locking the table keeps concurrent changes from building a cycle.
+	if _, err := tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		http.Error(w, "Failed to create category", http.StatusInternalServerError)
+		return
+	}
+
+	tree, err := loadCategories(tx)
+	if err != nil {
+		http.Error(w, "Failed to create category", http.StatusInternalServerError)
+		return
+	}
+	if req.ParentID != nil && tree[*req.ParentID] == nil {
+		http.Error(w, "Parent category not found", http.StatusBadRequest)
+		return
+	}
+	taken, err := slugTaken(tx, req.Slug, 0)
+	if err != nil {
+		http.Error(w, "Failed to create category", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Slug is already taken", http.StatusConflict)
+		return
+	}
+
+	var categoryID int64
+	err = tx.QueryRow(
+		`INSERT INTO categories (parent_id, slug, name, description, position, read_roles, post_roles, comment_roles)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		req.ParentID, req.Slug, req.Name, req.Description, req.Position,
+		pq.Array(req.ReadRoles), pq.Array(req.PostRoles), pq.Array(req.CommentRoles),
+	).Scan(&categoryID)
+	if err != nil {
+		log.Printf("Error creating category: %v", err)
+		http.Error(w, "Failed to create category", http.StatusInternalServerError)
+		return
+	}
+
+	var category models.Category
+	if err := scanCategory(tx.QueryRow(selectCategory+" WHERE id = $1", categoryID), &category); err != nil {
+		http.Error(w, "Failed to fetch category", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.CategoryCreate, "category", categoryID, nil, category); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to create category", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create category", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+func UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	var req models.CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to update category", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if !validateCategory(w, tx, &req) {
+		return
+	}
+
+	if _, err := tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		http.Error(w, "Failed to update category", http.StatusInternalServerError)
+		return
+	}
+
+	tree, err := loadCategories(tx)
+	if err != nil {
+		http.Error(w, "Failed to update category", http.StatusInternalServerError)
+		return
+	}
+	before, ok := tree[categoryID]
+	if !ok {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if req.ParentID != nil {
+		if tree[*req.ParentID] == nil {
+			http.Error(w, "Parent category not found", http.StatusBadRequest)
+			return
+		}
+		if tree.isAncestor(categoryID, *req.ParentID) {
+			http.Error(w, "A category can't be moved into itself or its subcategories", http.StatusBadRequest)
+			return
+		}
+	}
+	taken, err := slugTaken(tx, req.Slug, categoryID)
+	if err != nil {
+		http.Error(w, "Failed to update category", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Slug is already taken", http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec(
+		`UPDATE categories SET parent_id = $1, slug = $2, name = $3, description = $4, position = $5,
+		 read_roles = $6, post_roles = $7, comment_roles = $8
+		 WHERE id = $9`,
+		req.ParentID, req.Slug, req.Name, req.Description, req.Position,
+		pq.Array(req.ReadRoles), pq.Array(req.PostRoles), pq.Array(req.CommentRoles), categoryID,
+	)
+	if err != nil {
+		log.Printf("Error updating category: %v", err)
+		http.Error(w, "Failed to update category", http.StatusInternalServerError)
+		return
+	}
+
+	var category models.Category
+	if err := scanCategory(tx.QueryRow(selectCategory+" WHERE id = $1", categoryID), &category); err != nil {
+		http.Error(w, "Failed to fetch category", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.CategoryUpdate, "category", categoryID, before, category); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to update category", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update category", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(category)
+}
+
+// DeleteCategory removes an empty category. Posts and subcategories have to
+// be moved or deleted first.
+func DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.Category
+	err = scanCategory(tx.QueryRow(selectCategory+" WHERE id = $1 FOR UPDATE", categoryID), &before)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+		return
+	}
+
+	var hasChildren, hasPosts bool
+	err = tx.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM categories WHERE parent_id = $1),
+		 EXISTS(SELECT 1 FROM posts WHERE category_id = $1)`, categoryID,
+	).Scan(&hasChildren, &hasPosts)
+	if err != nil {
+		http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+		return
+	}
+	if hasChildren {
+		http.Error(w, "Category still has subcategories", http.StatusConflict)
+		return
+	}
+	if hasPosts {
+		http.Error(w, "Category still has posts", http.StatusConflict)
+		return
+	}
+
+	// Both tables reference categories, so a concurrent insert makes this
+	// fail instead of leaving orphans.
+	if _, err := tx.Exec("DELETE FROM categories WHERE id = $1", categoryID); err != nil {
+		log.Printf("Error deleting category: %v", err)
+		http.Error(w, "Failed to delete category", http.StatusConflict)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.CategoryDelete, "category", categoryID, before, nil); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error deleting category: %v", err)
+		http.Error(w, "Failed to delete category", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
+	"forum/config"
+	"forum/internal/auth"
+	"forum/internal/chat"
 	"forum/internal/database"
 	"forum/internal/models"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,163 +27,275 @@ var upgrader = websocket.Upgrader{
 	HandshakeTimeout: 10 * time.Second,
 }
 
-var clients = make(map[*websocket.Conn]int)
-var broadcast = make(chan models.ChatMessageResponse)
+// chatHistorySize is how many messages a client gets when joining a room.
+const chatHistorySize = 50
+
+// chatHub serves every chat connection of this instance.
+var chatHub = chat.NewHub()
+
+// RunChat serves the chat hub until stop is closed.
+func RunChat(stop <-chan struct{}) {
+	chatHub.Run(stop)
+}
+
+// WaitChat blocks until the chat hub has stopped and sent close frames to
+// every client.
+func WaitChat(ctx context.Context) error {
+	return chatHub.Wait(ctx)
+}
+
+func chatLimits() chat.Limits {
+	cfg := config.LoadConfig()
+	return chat.Limits{
+		PingInterval:   cfg.ChatPingInterval,
+		PongWait:       cfg.ChatPongWait,
+		WriteWait:      cfg.ChatWriteWait,
+		MaxMessageSize: cfg.ChatMaxMessageSize,
+	}
+}
 
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user_id").(int)
+	userID := r.Context().Value("user_id").(int64)
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Error upgrading to WebSocket: %v", err)
 		return
 	}
-	defer conn.Close()
-
-	clients[conn] = userID
 
-	// Send last 50 messages
-	messages, err := database.GetLastMessages(50)
-	if err != nil {
-		log.Printf("Error getting messages: %v", err)
+	client := chat.NewClient(conn, userID, chatLimits())
+	if !chatHub.Register(client) {
+		conn.Close()
 		return
 	}
+	// The write pump closes the connection once the client is unregistered.
+	defer chatHub.Unregister(client)
 
-	// Get usernames for messages
-	for i := range messages {
-		username, err := database.GetUsernameByID(messages[i].UserID)
+	session := &chatSession{
+		client: client,
+		userID: userID,
+		role:   requestRole(r),
+	}
+
+	for {
+		var cmd models.ChatCommand
+		err := client.ReadJSON(&cmd)
 		if err != nil {
-			log.Printf("Error getting username: %v", err)
-			continue
-		}
-		messages[i].Username = username
-
-		// If message is a reply, get reply information
-		if messages[i].ReplyToID != nil {
-			replyMsg, err := database.GetMessageByID(*messages[i].ReplyToID)
-			if err != nil {
-				log.Printf("Error getting reply message: %v", err)
-				continue
-			}
-			replyUsername, err := database.GetUsernameByID(replyMsg.UserID)
-			if err != nil {
-				log.Printf("Error getting reply username: %v", err)
-				continue
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Error reading message: %v", err)
 			}
-			messages[i].ReplyTo = &models.ReplyTo{
-				ID:       replyMsg.ID,
-				Content:  replyMsg.Content,
-				Username: replyUsername,
+			return
+		}
+
+		switch cmd.Type {
+		case models.ChatJoin:
+			session.join(cmd.Room)
+		case models.ChatLeave:
+			session.leave(cmd.Room)
+		case models.ChatSend:
+			if !session.send(cmd) {
+				return
 			}
+		default:
+			session.fail(cmd.Room, "Unknown command")
 		}
 	}
+}
+
+// chatSession is the state of one chat connection. Only the read loop of
+// its handler uses it. The rooms it joined are kept by the hub, which may
+// kick it out of one at any time.
+type chatSession struct {
+	client *chat.Client
+	userID int64
+	role   string
+}
 
-	if err := conn.WriteJSON(messages); err != nil {
-		log.Printf("Error sending messages: %v", err)
+func (s *chatSession) fail(room, message string) {
+	chatHub.Send(s.client, models.ChatEvent{Type: models.ChatError, Room: room, Error: message})
+}
+
+// room looks up a room the user may access, or reports to the client why it
+// can't.
+func (s *chatSession) room(slug string) (models.ChatRoom, bool) {
+	room, err := database.GetChatRoomBySlug(slug)
+	if err == sql.ErrNoRows {
+		s.fail(slug, "Room not found")
+		return room, false
+	}
+	if err != nil {
+		log.Printf("Error fetching chat room: %v", err)
+		s.fail(slug, "Failed to fetch room")
+		return room, false
+	}
+
+	allowed, err := canAccessChatRoom(room, s.userID, s.role)
+	if err != nil {
+		log.Printf("Error checking chat room membership: %v", err)
+		s.fail(slug, "Failed to fetch room")
+		return room, false
+	}
+	if !allowed {
+		s.fail(slug, "Room not found")
+		return room, false
+	}
+	return room, true
+}
+
+// join subscribes the connection to a room and sends its history. Joining
+// before loading the history may deliver a new message twice, but never
+// loses one; clients drop duplicates by ID.
+func (s *chatSession) join(slug string) {
+	room, ok := s.room(slug)
+	if !ok {
 		return
 	}
+	chatHub.Join(s.client, room.ID)
 
-	for {
-		var msg models.ChatMessageRequest
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("Error reading message: %v", err)
-			delete(clients, conn)
-			break
-		}
+	// A kick between the check above and the join would have missed this
+	// connection, so the room is looked up once more now that it is in it.
+	if _, ok := s.room(slug); !ok {
+		chatHub.Leave(s.client, room.ID)
+		return
+	}
 
-		message := models.ChatMessage{
-			Content:   msg.Content,
-			UserID:    userID,
-			ReplyToID: msg.ReplyToID,
-			CreatedAt: time.Now(),
-		}
+	messages, err := chatHistory(room.ID, chatHistorySize)
+	if err != nil {
+		log.Printf("Error getting messages: %v", err)
+		s.fail(room.Slug, "Failed to fetch messages")
+		return
+	}
+	chatHub.Send(s.client, models.ChatEvent{Type: models.ChatHistory, Room: room.Slug, Messages: messages})
+}
 
-		// Save message to database
-		if err := database.SaveMessage(message); err != nil {
-			log.Printf("Error saving message: %v", err)
-			continue
+func (s *chatSession) leave(slug string) {
+	room, err := database.GetChatRoomBySlug(slug)
+	if err == sql.ErrNoRows {
+		s.fail(slug, "Room not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching chat room: %v", err)
+		s.fail(slug, "Failed to fetch room")
+		return
+	}
+	chatHub.Leave(s.client, room.ID)
+	chatHub.Send(s.client, models.ChatEvent{Type: models.ChatLeft, Room: room.Slug})
+}
+
+// send saves a message and broadcasts it to the room. It reports false when
+// the connection has to be closed.
+func (s *chatSession) send(cmd models.ChatCommand) bool {
+	// Sanctions are checked per message so they also hit open connections.
+	sanction, err := auth.ActiveSanction(database.DB, s.userID, auth.SanctionBan, auth.SanctionSuspension, auth.SanctionMute)
+	if err != nil {
+		log.Printf("Error checking sanctions: %v", err)
+		return true
+	}
+	if sanction != nil {
+		if sanction.Type == auth.SanctionBan {
+			chatHub.DisconnectUser(s.userID, sanction.Message())
+			return false
 		}
+		s.fail(cmd.Room, sanction.Message())
+		return true
+	}
 
-		// Get username for the message
-		username, err := database.GetUsernameByID(userID)
-		if err != nil {
-			log.Printf("Error getting username: %v", err)
-			continue
+	room, ok := s.room(cmd.Room)
+	if !ok {
+		return true
+	}
+	if !chatHub.Joined(s.client, room.ID) {
+		s.fail(room.Slug, "Join the room first")
+		return true
+	}
+	content := strings.TrimSpace(cmd.Content)
+	if content == "" {
+		s.fail(room.Slug, "Message can't be empty")
+		return true
+	}
+	if cmd.ReplyToID != nil {
+		replyMsg, err := database.GetMessageByID(*cmd.ReplyToID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error getting message: %v", err)
+			s.fail(room.Slug, "Failed to send message")
+			return true
 		}
-		message.Username = username
-
-		// If message is a reply, get reply information
-		if message.ReplyToID != nil {
-			replyMsg, err := database.GetMessageByID(*message.ReplyToID)
-			if err != nil {
-				log.Printf("Error getting reply message: %v", err)
-				continue
-			}
-			replyUsername, err := database.GetUsernameByID(replyMsg.UserID)
-			if err != nil {
-				log.Printf("Error getting reply username: %v", err)
-				continue
-			}
-			message.ReplyTo = &models.ReplyTo{
-				ID:       replyMsg.ID,
-				Content:  replyMsg.Content,
-				Username: replyUsername,
-			}
+		if err == sql.ErrNoRows || replyMsg.RoomID != room.ID {
+			s.fail(room.Slug, "Message to reply to not found")
+			return true
 		}
+	}
 
-		// Broadcast message to all clients
-		for client := range clients {
-			if err := client.WriteJSON(message); err != nil {
-				log.Printf("Error broadcasting message: %v", err)
-				client.Close()
-				delete(clients, client)
-			}
-		}
+	message := models.ChatMessage{
+		RoomID:    room.ID,
+		Content:   content,
+		UserID:    int(s.userID),
+		ReplyToID: cmd.ReplyToID,
+		CreatedAt: time.Now(),
 	}
+
+	// Save message to database
+	if err := database.SaveMessage(&message); err != nil {
+		log.Printf("Error saving message: %v", err)
+		s.fail(room.Slug, "Failed to send message")
+		return true
+	}
+
+	if err := withChatDetails(&message); err != nil {
+		log.Printf("Error getting message details: %v", err)
+		return true
+	}
+
+	event := models.ChatEvent{Type: models.ChatSend, Room: room.Slug, Message: &message}
+	if err := chatHub.Broadcast(room.ID, event); err != nil {
+		log.Printf("Error broadcasting message: %v", err)
+	}
+	return true
 }
 
-func getLastMessages(limit int) ([]models.ChatMessageResponse, error) {
-	query := `SELECT m.id, m.content, m.created_at,
-			  u.id, u.username, u.email, u.role, u.created_at
-			  FROM chat_messages m
-			  JOIN users u ON m.user_id = u.id
-			  ORDER BY m.created_at DESC
-			  LIMIT $1`
+// DisconnectUser closes every chat connection of the user, e.g. after a ban.
+func DisconnectUser(userID int64, reason string) {
+	chatHub.DisconnectUser(userID, reason)
+}
 
-	rows, err := database.DB.Query(query, limit)
+// chatHistory returns the last messages of a room in chronological order.
+func chatHistory(roomID int64, limit int) ([]models.ChatMessage, error) {
+	messages, err := database.GetLastMessages(roomID, limit)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var messages []models.ChatMessageResponse
-	for rows.Next() {
-		var msg models.ChatMessageResponse
-		var user models.UserResponse
-		err := rows.Scan(
-			&msg.ID, &msg.Content, &msg.CreatedAt,
-			&user.ID, &user.Username, &user.Email, &user.Role, &user.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
+	for i := range messages {
+		if err := withChatDetails(&messages[i]); err != nil {
+			log.Printf("Error getting message details: %v", err)
 		}
-		msg.User = user
-		messages = append(messages, msg)
 	}
-
 	return messages, nil
 }
 
-func BroadcastMessages() {
-	for {
-		msg := <-broadcast
-		for client := range clients {
-			err := client.WriteJSON(msg)
-			if err != nil {
-				log.Printf("Error broadcasting message: %v", err)
-				client.Close()
-				delete(clients, client)
-			}
-		}
+// withChatDetails adds the username of the author and, for replies, the
+// message replied to.
+func withChatDetails(message *models.ChatMessage) error {
+	username, err := database.GetUsernameByID(message.UserID)
+	if err != nil {
+		return err
+	}
+	message.Username = username
+
+	if message.ReplyToID == nil {
+		return nil
+	}
+	replyMsg, err := database.GetMessageByID(*message.ReplyToID)
+	if err != nil {
+		return err
+	}
+	replyUsername, err := database.GetUsernameByID(replyMsg.UserID)
+	if err != nil {
+		return err
+	}
+	message.ReplyTo = &models.ReplyTo{
+		ID:       replyMsg.ID,
+		Content:  replyMsg.Content,
+		Username: replyUsername,
 	}
+	return nil
 }
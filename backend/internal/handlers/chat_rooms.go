@@ -0,0 +1,451 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"forum/internal/audit"
+	"forum/internal/auth"
+	"forum/internal/database"
+	"forum/internal/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const selectChatRoom = `SELECT id, slug, name, description, private, created_at FROM chat_rooms`
+
+func scanChatRoom(row interface{ Scan(...interface{}) error }, room *models.ChatRoom) error {
+	return row.Scan(&room.ID, &room.Slug, &room.Name, &room.Description, &room.Private, &room.CreatedAt)
+}
+
+// canAccessChatRoom reports whether a user may join a room. Like categories,
+// the admin role is never restricted.
+func canAccessChatRoom(room models.ChatRoom, userID int64, role string) (bool, error) {
+	if !room.Private || role == auth.AdminRole {
+		return true, nil
+	}
+	return database.IsChatRoomMember(room.ID, userID)
+}
+
+// GetChatRooms lists the rooms the current user may join.
+func GetChatRooms(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int64)
+	rooms, err := database.GetChatRooms(userID, requestRole(r) == auth.AdminRole)
+	if err != nil {
+		log.Printf("Error fetching chat rooms: %v", err)
+		http.Error(w, "Failed to fetch rooms", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// GetAllChatRooms lists every room for the admin panel.
+func GetAllChatRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := database.GetChatRooms(0, true)
+	if err != nil {
+		log.Printf("Error fetching chat rooms: %v", err)
+		http.Error(w, "Failed to fetch rooms", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
+
+func validateChatRoom(w http.ResponseWriter, tx *sqlx.Tx, req *models.ChatRoomRequest, exceptID int64) bool {
+	req.Slug = strings.TrimSpace(req.Slug)
+	req.Name = strings.TrimSpace(req.Name)
+
+	if !categorySlugPattern.MatchString(req.Slug) {
+		http.Error(w, "Slug must be up to 50 lowercase letters, digits or '-'", http.StatusBadRequest)
+		return false
+	}
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Name must be 1-100 characters", http.StatusBadRequest)
+		return false
+	}
+
+	var taken bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM chat_rooms WHERE slug = $1 AND id <> $2)", req.Slug, exceptID).Scan(&taken)
+	if err != nil {
+		http.Error(w, "Failed to check slug", http.StatusInternalServerError)
+		return false
+	}
+	if taken {
+		http.Error(w, "Slug is already taken", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// chatRoomID reads the room ID from the URL.
+func chatRoomID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	roomID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return roomID, true
+}
+
+func CreateChatRoom(w http.ResponseWriter, r *http.Request) {
+	var req models.ChatRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if !validateChatRoom(w, tx, &req, 0) {
+		return
+	}
+
+	var room models.ChatRoom
+	err = scanChatRoom(tx.QueryRow(
+		`INSERT INTO chat_rooms (slug, name, description, private) VALUES ($1, $2, $3, $4)
+		 RETURNING id, slug, name, description, private, created_at`,
+		req.Slug, req.Name, req.Description, req.Private,
+	), &room)
+	if err != nil {
+		log.Printf("Error creating chat room: %v", err)
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.ChatRoomCreate, "chat_room", room.ID, nil, room); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(room)
+}
+
+// UpdateChatRoom changes a room. Making it private removes everyone but its
+// members from it; admins can join again.
+func UpdateChatRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := chatRoomID(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.ChatRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to update room", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.ChatRoom
+	err = scanChatRoom(tx.QueryRow(selectChatRoom+" WHERE id = $1 FOR UPDATE", roomID), &before)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update room", http.StatusInternalServerError)
+		return
+	}
+
+	if !validateChatRoom(w, tx, &req, roomID) {
+		return
+	}
+
+	var room models.ChatRoom
+	err = scanChatRoom(tx.QueryRow(
+		`UPDATE chat_rooms SET slug = $1, name = $2, description = $3, private = $4 WHERE id = $5
+		 RETURNING id, slug, name, description, private, created_at`,
+		req.Slug, req.Name, req.Description, req.Private, roomID,
+	), &room)
+	if err != nil {
+		log.Printf("Error updating chat room: %v", err)
+		http.Error(w, "Failed to update room", http.StatusInternalServerError)
+		return
+	}
+
+	var members []int64
+	if room.Private && !before.Private {
+		err := tx.QueryRow(
+			"SELECT COALESCE(array_agg(user_id), '{}') FROM chat_room_members WHERE room_id = $1", roomID,
+		).Scan(pq.Array(&members))
+		if err != nil {
+			http.Error(w, "Failed to update room", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := audit.Record(tx, r, audit.ChatRoomUpdate, "chat_room", roomID, before, room); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to update room", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update room", http.StatusInternalServerError)
+		return
+	}
+
+	if room.Private && !before.Private {
+		isMember := make(map[int64]bool, len(members))
+		for _, userID := range members {
+			isMember[userID] = true
+		}
+		chatHub.Kick(roomID, func(userID int64) bool { return isMember[userID] }, models.ChatEvent{Type: models.ChatLeft, Room: room.Slug})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+// DeleteChatRoom removes a room together with its history.
+func DeleteChatRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := chatRoomID(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.ChatRoom
+	err = scanChatRoom(tx.QueryRow(selectChatRoom+" WHERE id = $1 FOR UPDATE", roomID), &before)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM chat_rooms WHERE id = $1", roomID); err != nil {
+		log.Printf("Error deleting chat room: %v", err)
+		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.ChatRoomDelete, "chat_room", roomID, before, nil); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+		return
+	}
+
+	chatHub.Kick(roomID, nil, models.ChatEvent{Type: models.ChatLeft, Room: before.Slug})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetChatRoomMembers lists the users invited to a room.
+func GetChatRoomMembers(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := chatRoomID(w, r)
+	if !ok {
+		return
+	}
+
+	var exists bool
+	if err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM chat_rooms WHERE id = $1)", roomID).Scan(&exists); err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT m.user_id, u.username, m.created_at
+		 FROM chat_room_members m JOIN users u ON u.id = m.user_id
+		 WHERE m.room_id = $1
+		 ORDER BY u.username`, roomID)
+	if err != nil {
+		log.Printf("Error fetching chat room members: %v", err)
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := []models.ChatRoomMember{}
+	for rows.Next() {
+		var member models.ChatRoomMember
+		if err := rows.Scan(&member.UserID, &member.Username, &member.CreatedAt); err != nil {
+			log.Printf("Error scanning chat room member: %v", err)
+			http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+			return
+		}
+		members = append(members, member)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// AddChatRoomMember invites a user to a room. Membership matters for private
+// rooms only, but can be set up before a room is made private.
+func AddChatRoomMember(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := chatRoomID(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.ChatRoomMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to add member", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM chat_rooms WHERE id = $1)", roomID).Scan(&exists); err != nil {
+		http.Error(w, "Failed to add member", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	var member models.ChatRoomMember
+	err = tx.QueryRow("SELECT id, username FROM users WHERE id = $1", req.UserID).Scan(&member.UserID, &member.Username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to add member", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.QueryRow(
+		`INSERT INTO chat_room_members (room_id, user_id) VALUES ($1, $2)
+		 ON CONFLICT (room_id, user_id) DO NOTHING
+		 RETURNING created_at`, roomID, req.UserID,
+	).Scan(&member.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User is already a member", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding chat room member: %v", err)
+		http.Error(w, "Failed to add member", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.ChatMemberAdd, "chat_room", roomID, nil, member); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to add member", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to add member", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(member)
+}
+
+// RemoveChatRoomMember revokes an invitation. If the room is private, the
+// user's open connections leave it.
+func RemoveChatRoomMember(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := chatRoomID(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var room models.ChatRoom
+	err = scanChatRoom(tx.QueryRow(selectChatRoom+" WHERE id = $1 FOR SHARE", roomID), &room)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	var member models.ChatRoomMember
+	err = tx.QueryRow(
+		`DELETE FROM chat_room_members m USING users u
+		 WHERE m.room_id = $1 AND m.user_id = $2 AND u.id = m.user_id
+		 RETURNING m.user_id, u.username, m.created_at`, roomID, userID,
+	).Scan(&member.UserID, &member.Username, &member.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error removing chat room member: %v", err)
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.ChatMemberRemove, "chat_room", roomID, member, nil); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	if room.Private {
+		chatHub.Kick(roomID, func(id int64) bool { return id != userID }, models.ChatEvent{Type: models.ChatLeft, Room: room.Slug})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,7 +1,11 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"forum/config"
+	"forum/internal/audit"
+	"forum/internal/auth"
 	"forum/internal/database"
 	"forum/internal/models"
 	"log"
@@ -10,6 +14,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 func CreateComment(w http.ResponseWriter, r *http.Request) {
@@ -21,20 +26,34 @@ func CreateComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Проверяем существование поста
-	var postExists bool
-	err = database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = $1)", postID).Scan(&postExists)
+	// Проверяем существование поста и права на комментирование в его разделе
+	categoryID, err := postCategory(database.DB, postID)
+	if err == sql.ErrNoRows {
+		log.Printf("Post with ID %d does not exist", postID)
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to check post existence: %v", err)
 		http.Error(w, "Failed to check post existence", http.StatusInternalServerError)
 		return
 	}
 
-	if !postExists {
-		log.Printf("Post with ID %d does not exist", postID)
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Failed to fetch categories: %v", err)
+		http.Error(w, "Failed to check category", http.StatusInternalServerError)
+		return
+	}
+	role := requestRole(r)
+	if !tree.canRead(categoryID, role) {
 		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
+	if !tree.canComment(categoryID, role) {
+		http.Error(w, "You can't comment in this category", http.StatusForbidden)
+		return
+	}
 
 	var comment models.Comment
 	if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
@@ -57,21 +76,56 @@ func CreateComment(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Creating comment: PostID=%d, AuthorID=%d, Content=%s", comment.PostID, comment.AuthorID, comment.Content)
 
-	query := `INSERT INTO comments (content, post_id, author_id, created_at, updated_at)
-			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var path []int64
+	if comment.ParentID != nil {
+		if path, ok = replyParent(w, tx, postID, *comment.ParentID, config.LoadConfig().MaxCommentDepth); !ok {
+			return
+		}
+	}
+
+	query := `INSERT INTO comments (content, post_id, parent_id, author_id, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
 
-	err = database.DB.QueryRow(query, comment.Content, comment.PostID, comment.AuthorID, comment.CreatedAt, comment.UpdatedAt).Scan(&comment.ID)
+	err = tx.QueryRow(query, comment.Content, comment.PostID, comment.ParentID, comment.AuthorID, comment.CreatedAt, comment.UpdatedAt).Scan(&comment.ID)
 	if err != nil {
 		log.Printf("Failed to create comment: %v", err)
 		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
 		return
 	}
 
+	path = append(path, comment.ID)
+	if _, err := tx.Exec("UPDATE comments SET path = $1 WHERE id = $2", pq.Array(path), comment.ID); err != nil {
+		log.Printf("Failed to save comment path: %v", err)
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := commentRevisions.save(tx, comment.ID, "", comment.Content, userID, ""); err != nil {
+		log.Printf("Failed to save comment revision: %v", err)
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+
 	log.Printf("Successfully created comment with ID: %d", comment.ID)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(comment)
 }
 
+// GetComments returns a page of the threads of a post: top-level comments
+// with all of their replies, each followed by its replies in a flat list or
+// nested when ?view=tree. See threadQueryFromRequest for the parameters.
 func GetComments(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	postID, err := strconv.ParseInt(vars["post_id"], 10, 64)
@@ -80,38 +134,37 @@ func GetComments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `SELECT c.id, c.content, c.post_id, c.author_id, c.created_at, c.updated_at,
-			  u.id, u.username, u.email, u.role, u.created_at
-			  FROM comments c
-			  JOIN users u ON c.author_id = u.id
-			  WHERE c.post_id = $1
-			  ORDER BY c.created_at DESC`
+	q, ok := threadQueryFromRequest(w, r)
+	if !ok {
+		return
+	}
 
-	rows, err := database.DB.Query(query, postID)
+	categoryID, err := postCategory(database.DB, postID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var comments []models.CommentResponse
-	for rows.Next() {
-		var comment models.CommentResponse
-		var author models.UserResponse
-		var authorID int64
-		err := rows.Scan(
-			&comment.ID, &comment.Content, &comment.PostID, &authorID, &comment.CreatedAt, &comment.UpdatedAt,
-			&author.ID, &author.Username, &author.Email, &author.Role, &author.CreatedAt,
-		)
-		if err != nil {
-			http.Error(w, "Failed to scan comment", http.StatusInternalServerError)
-			return
-		}
-		comment.Author = author
-		comments = append(comments, comment)
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return
+	}
+	if !tree.canRead(categoryID, requestRole(r)) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
 	}
 
-	json.NewEncoder(w).Encode(comments)
+	page, ok := loadThreads(w, r, postID, q)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(page)
 }
 
 func UpdateComment(w http.ResponseWriter, r *http.Request) {
@@ -122,27 +175,78 @@ func UpdateComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var comment models.Comment
-	if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
+	var req struct {
+		models.Comment
+		EditReason string `json:"edit_reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	comment := req.Comment
 
 	userID := r.Context().Value("user_id").(int64)
 	comment.UpdatedAt = time.Now()
 
+	editAny, err := hasPermission(r, auth.PermCommentsEditAny)
+	if err != nil {
+		log.Printf("Error checking permission: %v", err)
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.Comment
+	err = tx.QueryRow(
+		`SELECT id, content, post_id, parent_id, author_id, created_at, updated_at FROM comments
+		 WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, commentID,
+	).Scan(&before.ID, &before.Content, &before.PostID, &before.ParentID, &before.AuthorID, &before.CreatedAt, &before.UpdatedAt)
+	if err == sql.ErrNoRows || (err == nil && before.AuthorID != userID && !editAny) {
+		http.Error(w, "Comment not found or unauthorized", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+		return
+	}
+
 	query := `UPDATE comments SET content = $1, updated_at = $2
-			  WHERE id = $3 AND author_id = $4
-			  RETURNING id, content, post_id, author_id, created_at, updated_at`
+			  WHERE id = $3
+			  RETURNING id, content, post_id, parent_id, author_id, created_at, updated_at`
 
-	err = database.DB.QueryRow(query, comment.Content, comment.UpdatedAt, commentID, userID).Scan(
-		&comment.ID, &comment.Content, &comment.PostID, &comment.AuthorID, &comment.CreatedAt, &comment.UpdatedAt,
+	err = tx.QueryRow(query, comment.Content, comment.UpdatedAt, commentID).Scan(
+		&comment.ID, &comment.Content, &comment.PostID, &comment.ParentID, &comment.AuthorID, &comment.CreatedAt, &comment.UpdatedAt,
 	)
 	if err != nil {
 		http.Error(w, "Failed to update comment", http.StatusInternalServerError)
 		return
 	}
 
+	if comment.Content != before.Content {
+		if err := commentRevisions.save(tx, commentID, "", comment.Content, userID, req.EditReason); err != nil {
+			log.Printf("Error saving comment revision: %v", err)
+			http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := auditModeration(tx, r, before.AuthorID, audit.CommentUpdate, "comment", commentID, before, comment); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+		return
+	}
+
 	json.NewEncoder(w).Encode(comment)
 }
 
@@ -155,18 +259,51 @@ func DeleteComment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID := r.Context().Value("user_id").(int64)
-	userRole := r.Context().Value("role").(string)
 
-	var query string
-	if userRole == "admin" {
-		query = `DELETE FROM comments WHERE id = $1`
-		err = database.DB.QueryRow(query, commentID).Scan()
-	} else {
-		query = `DELETE FROM comments WHERE id = $1 AND author_id = $2`
-		err = database.DB.QueryRow(query, commentID, userID).Scan()
+	deleteAny, err := hasPermission(r, auth.PermCommentsDeleteAny)
+	if err != nil {
+		log.Printf("Error checking permission: %v", err)
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
 	}
 
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.Comment
+	query := `SELECT id, content, post_id, parent_id, author_id, created_at, updated_at FROM comments
+			  WHERE id = $1 AND deleted_at IS NULL AND ($2 OR author_id = $3)
+			  FOR UPDATE`
+	err = tx.QueryRow(query, commentID, deleteAny, userID).Scan(
+		&before.ID, &before.Content, &before.PostID, &before.ParentID, &before.AuthorID, &before.CreatedAt, &before.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Comment not found or unauthorized", http.StatusNotFound)
+		return
+	}
 	if err != nil {
+		log.Printf("Error deleting comment: %v", err)
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := removeComment(tx, commentID, before.ParentID); err != nil {
+		log.Printf("Error deleting comment: %v", err)
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := auditModeration(tx, r, before.AuthorID, audit.CommentDelete, "comment", commentID, before, nil); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
 		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
 		return
 	}
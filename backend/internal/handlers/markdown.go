@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"bytes"
+	"forum/internal/markdown"
+	"log"
+	"net/http"
+)
+
+// HighlightCSS serves the stylesheet for code blocks in content_html.
+func HighlightCSS(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := markdown.WriteCSS(&buf); err != nil {
+		log.Printf("Error writing highlight CSS: %v", err)
+		http.Error(w, "Failed to write stylesheet", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(buf.Bytes())
+}
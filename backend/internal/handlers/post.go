@@ -3,14 +3,21 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"forum/internal/audit"
+	"forum/internal/auth"
 	"forum/internal/database"
+	"forum/internal/markdown"
 	"forum/internal/models"
+	"forum/internal/pagination"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 func CreatePost(w http.ResponseWriter, r *http.Request) {
@@ -20,33 +27,153 @@ func CreatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkCanPost(w, r, post.CategoryID) {
+		return
+	}
+	tags, ok := normalizeTags(w, post.Tags)
+	if !ok {
+		return
+	}
+
 	userID := r.Context().Value("user_id").(int64)
 	post.AuthorID = userID
+	post.Tags = tags
 	post.CreatedAt = time.Now()
 	post.UpdatedAt = time.Now()
 
-	query := `INSERT INTO posts (title, content, author_id, created_at, updated_at)
-			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to create post", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO posts (title, content, author_id, category_id, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
 
-	err := database.DB.QueryRow(query, post.Title, post.Content, post.AuthorID, post.CreatedAt, post.UpdatedAt).Scan(&post.ID)
+	err = tx.QueryRow(query, post.Title, post.Content, post.AuthorID, post.CategoryID, post.CreatedAt, post.UpdatedAt).Scan(&post.ID)
 	if err != nil {
 		http.Error(w, "Failed to create post", http.StatusInternalServerError)
 		return
 	}
 
+	if err := setPostTags(tx, post.ID, post.Tags); err != nil {
+		log.Printf("Error saving post tags: %v", err)
+		http.Error(w, "Failed to create post", http.StatusInternalServerError)
+		return
+	}
+
+	if err := postRevisions.save(tx, post.ID, post.Title, post.Content, userID, ""); err != nil {
+		log.Printf("Error saving post revision: %v", err)
+		http.Error(w, "Failed to create post", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create post", http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(post)
 }
 
+// checkCanPost makes sure the current user may post in the category.
+func checkCanPost(w http.ResponseWriter, r *http.Request, categoryID int64) bool {
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to check category", http.StatusInternalServerError)
+		return false
+	}
+
+	role := requestRole(r)
+	if !tree.canRead(categoryID, role) {
+		http.Error(w, "Category not found", http.StatusBadRequest)
+		return false
+	}
+	if !tree.canPost(categoryID, role) {
+		http.Error(w, "You can't post in this category", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// GetPosts lists the posts of the categories the current user may read.
+// ?category= takes a category slug, ?tags=a,b keeps posts with all of the
+// tags, or with any of them when ?match=any. ?sort=top orders by score
+// instead of newest first.
 func GetPosts(w http.ResponseWriter, r *http.Request) {
-	query := `SELECT p.id, p.title, p.content, p.author_id, p.created_at, p.updated_at,
+	sort := r.URL.Query().Get("sort")
+	if sort != "" && sort != "new" && sort != "top" {
+		http.Error(w, "Sort must be new or top", http.StatusBadRequest)
+		return
+	}
+
+	// Scores change all the time, so the top list is paginated by offset
+	// like search results.
+	var params pagination.Params
+	var offset pagination.Offset
+	var err error
+	if sort == "top" {
+		offset, err = pagination.OffsetFromRequest(r)
+	} else {
+		params, err = pagination.FromRequest(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+		return
+	}
+	role := requestRole(r)
+
+	args := []interface{}{pq.Array(tree.readable(role))}
+	conditions := []string{"p.category_id = ANY($1)"}
+
+	if slug := r.URL.Query().Get("category"); slug != "" {
+		category := tree.bySlug(slug)
+		if category == nil || !tree.canRead(category.ID, role) {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+		args = append(args, category.ID)
+		conditions = append(conditions, fmt.Sprintf("p.category_id = $%d", len(args)))
+	}
+
+	condition, err := tagFilter(r, &args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if condition != "" {
+		conditions = append(conditions, condition)
+	}
+
+	if condition := params.Where("p.created_at", "p.id", &args); condition != "" {
+		conditions = append(conditions, condition)
+	}
+
+	query := `SELECT p.id, p.title, p.content, p.author_id, p.category_id, p.created_at, p.updated_at,
 			  u.id, u.username, u.email, u.role, u.created_at,
-			  (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) as comments_count
+			  (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id AND c.deleted_at IS NULL) as comments_count,
+			  p.score, p.upvotes, p.downvotes, p.reaction_counts,
+			  ` + tagsColumn + `
 			  FROM posts p
 			  JOIN users u ON p.author_id = u.id
-			  ORDER BY p.created_at DESC`
+			  WHERE ` + strings.Join(conditions, " AND ")
+	if sort == "top" {
+		query += " ORDER BY p.score DESC, p.created_at DESC, p.id DESC" + offset.Clause()
+	} else {
+		query += params.OrderBy("p.created_at", "p.id")
+	}
 
-	rows, err := database.DB.Query(query)
+	rows, err := database.DB.Query(query, args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
 		return
@@ -59,9 +186,10 @@ func GetPosts(w http.ResponseWriter, r *http.Request) {
 		var author models.UserResponse
 		var commentsCount int
 		err := rows.Scan(
-			&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.CreatedAt, &post.UpdatedAt,
+			&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.CategoryID, &post.CreatedAt, &post.UpdatedAt,
 			&author.ID, &author.Username, &author.Email, &author.Role, &author.CreatedAt,
-			&commentsCount,
+			&commentsCount, &post.Score, &post.Upvotes, &post.Downvotes, (*reactionCounts)(&post.Reactions),
+			pq.Array(&post.Tags),
 		)
 		if err != nil {
 			http.Error(w, "Failed to scan post", http.StatusInternalServerError)
@@ -69,12 +197,34 @@ func GetPosts(w http.ResponseWriter, r *http.Request) {
 		}
 		post.Author = author
 		post.CommentsCount = commentsCount
+		post.ContentHTML = markdown.Render(post.Content)
 		posts = append(posts, post)
 	}
+	if err := withPostAttachments(posts); err != nil {
+		log.Printf("Error fetching attachments: %v", err)
+		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+		return
+	}
+	if err := withPostVotes(r, posts); err != nil {
+		log.Printf("Error fetching votes: %v", err)
+		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+		return
+	}
 
-	json.NewEncoder(w).Encode(posts)
+	if sort == "top" {
+		json.NewEncoder(w).Encode(pagination.NewOffsetPage(posts, offset))
+		return
+	}
+	json.NewEncoder(w).Encode(pagination.NewPage(posts, params, postCursor))
 }
 
+func postCursor(post models.PostResponse) pagination.Cursor {
+	return pagination.Cursor{CreatedAt: post.CreatedAt, ID: post.ID}
+}
+
+// GetPost returns a post. With ?include=comments the first page of its
+// comments comes along, read with the parameters of GetComments, so that
+// ?around= can open a post at a linked comment.
 func GetPost(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	postID, err := strconv.ParseInt(vars["id"], 10, 64)
@@ -83,8 +233,23 @@ func GetPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `SELECT p.id, p.title, p.content, p.author_id, p.created_at, p.updated_at,
-			  u.id, u.username, u.email, u.role, u.created_at
+	include := r.URL.Query().Get("include")
+	if include != "" && include != "comments" {
+		http.Error(w, "Include must be comments", http.StatusBadRequest)
+		return
+	}
+	var threads threadQuery
+	if include == "comments" {
+		var ok bool
+		if threads, ok = threadQueryFromRequest(w, r); !ok {
+			return
+		}
+	}
+
+	query := `SELECT p.id, p.title, p.content, p.author_id, p.category_id, p.created_at, p.updated_at,
+			  u.id, u.username, u.email, u.role, u.created_at,
+			  p.score, p.upvotes, p.downvotes, p.reaction_counts,
+			  ` + tagsColumn + `
 			  FROM posts p
 			  JOIN users u ON p.author_id = u.id
 			  WHERE p.id = $1`
@@ -92,16 +257,56 @@ func GetPost(w http.ResponseWriter, r *http.Request) {
 	var post models.PostResponse
 	var author models.UserResponse
 	err = database.DB.QueryRow(query, postID).Scan(
-		&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.CreatedAt, &post.UpdatedAt,
+		&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.CategoryID, &post.CreatedAt, &post.UpdatedAt,
 		&author.ID, &author.Username, &author.Email, &author.Role, &author.CreatedAt,
+		&post.Score, &post.Upvotes, &post.Downvotes, (*reactionCounts)(&post.Reactions),
+		pq.Array(&post.Tags),
 	)
 	if err != nil {
 		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
 
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to fetch post", http.StatusInternalServerError)
+		return
+	}
+	if !tree.canRead(post.CategoryID, requestRole(r)) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	attachments, err := postAttachments.attachmentsOf(database.DB, []int64{post.ID})
+	if err != nil {
+		log.Printf("Error fetching attachments: %v", err)
+		http.Error(w, "Failed to fetch post", http.StatusInternalServerError)
+		return
+	}
+
+	if err := postVotes.fill(r, []int64{post.ID}, func(int) *models.Votes { return &post.Votes }); err != nil {
+		log.Printf("Error fetching votes: %v", err)
+		http.Error(w, "Failed to fetch post", http.StatusInternalServerError)
+		return
+	}
+
 	post.Author = author
-	json.NewEncoder(w).Encode(post)
+	post.ContentHTML = markdown.Render(post.Content)
+	post.Attachments = attachments[post.ID]
+
+	if include != "comments" {
+		json.NewEncoder(w).Encode(post)
+		return
+	}
+	comments, ok := loadThreads(w, r, post.ID, threads)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		models.PostResponse
+		Comments pagination.Page[models.CommentResponse] `json:"comments"`
+	}{post, comments})
 }
 
 func UpdatePost(w http.ResponseWriter, r *http.Request) {
@@ -112,27 +317,109 @@ func UpdatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var post models.Post
-	if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+	var req struct {
+		models.Post
+		EditReason string `json:"edit_reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	post := req.Post
+
+	// Without tags the current ones are kept.
+	var tags []string
+	if post.Tags != nil {
+		var ok bool
+		if tags, ok = normalizeTags(w, post.Tags); !ok {
+			return
+		}
+	}
 
 	userID := r.Context().Value("user_id").(int64)
 	post.UpdatedAt = time.Now()
 
-	query := `UPDATE posts SET title = $1, content = $2, updated_at = $3
-			  WHERE id = $4 AND author_id = $5
-			  RETURNING id, title, content, author_id, created_at, updated_at`
+	editAny, err := hasPermission(r, auth.PermPostsEditAny)
+	if err != nil {
+		log.Printf("Error checking permission: %v", err)
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
-	err = database.DB.QueryRow(query, post.Title, post.Content, post.UpdatedAt, postID, userID).Scan(
-		&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.CreatedAt, &post.UpdatedAt,
+	var before models.Post
+	err = tx.QueryRow(
+		`SELECT id, title, content, author_id, category_id, created_at, updated_at FROM posts WHERE id = $1 FOR UPDATE`, postID,
+	).Scan(&before.ID, &before.Title, &before.Content, &before.AuthorID, &before.CategoryID, &before.CreatedAt, &before.UpdatedAt)
+	if err == sql.ErrNoRows || (err == nil && before.AuthorID != userID && !editAny) {
+		http.Error(w, "Post not found or unauthorized", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+		return
+	}
+	if before.Tags, err = postTags(tx, postID); err != nil {
+		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+		return
+	}
+
+	// Without category_id the post stays where it is; moving it needs the
+	// right to post in the new category.
+	if post.CategoryID == 0 {
+		post.CategoryID = before.CategoryID
+	}
+	if post.CategoryID != before.CategoryID && !checkCanPost(w, r, post.CategoryID) {
+		return
+	}
+
+	query := `UPDATE posts SET title = $1, content = $2, category_id = $3, updated_at = $4
+			  WHERE id = $5
+			  RETURNING id, title, content, author_id, category_id, created_at, updated_at`
+
+	err = tx.QueryRow(query, post.Title, post.Content, post.CategoryID, post.UpdatedAt, postID).Scan(
+		&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.CategoryID, &post.CreatedAt, &post.UpdatedAt,
 	)
 	if err != nil {
 		http.Error(w, "Failed to update post", http.StatusInternalServerError)
 		return
 	}
 
+	if post.Title != before.Title || post.Content != before.Content {
+		if err := postRevisions.save(tx, postID, post.Title, post.Content, userID, req.EditReason); err != nil {
+			log.Printf("Error saving post revision: %v", err)
+			http.Error(w, "Failed to update post", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	post.Tags = before.Tags
+	if tags != nil {
+		if err := setPostTags(tx, postID, tags); err != nil {
+			log.Printf("Error saving post tags: %v", err)
+			http.Error(w, "Failed to update post", http.StatusInternalServerError)
+			return
+		}
+		post.Tags = tags
+	}
+
+	if err := auditModeration(tx, r, before.AuthorID, audit.PostUpdate, "post", postID, before, post); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+		return
+	}
+
 	json.NewEncoder(w).Encode(post)
 }
 
@@ -145,33 +432,45 @@ func DeletePost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID := r.Context().Value("user_id").(int64)
-	userRole := r.Context().Value("role").(string)
 
-	var query string
-	var result sql.Result
-	if userRole == "admin" {
-		query = `DELETE FROM posts WHERE id = $1`
-		result, err = database.DB.Exec(query, postID)
-	} else {
-		query = `DELETE FROM posts WHERE id = $1 AND author_id = $2`
-		result, err = database.DB.Exec(query, postID, userID)
+	deleteAny, err := hasPermission(r, auth.PermPostsDeleteAny)
+	if err != nil {
+		log.Printf("Error checking permission: %v", err)
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
 	}
 
+	tx, err := database.DB.Beginx()
 	if err != nil {
-		log.Printf("Error deleting post: %v", err)
 		http.Error(w, "Failed to delete post", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	var before models.Post
+	query := `DELETE FROM posts WHERE id = $1 AND ($2 OR author_id = $3)
+			  RETURNING id, title, content, author_id, category_id, created_at, updated_at`
+	err = tx.QueryRow(query, postID, deleteAny, userID).Scan(
+		&before.ID, &before.Title, &before.Content, &before.AuthorID, &before.CategoryID, &before.CreatedAt, &before.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found or unauthorized", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
-		http.Error(w, "Failed to check deletion result", http.StatusInternalServerError)
+		log.Printf("Error deleting post: %v", err)
+		http.Error(w, "Failed to delete post", http.StatusInternalServerError)
 		return
 	}
 
-	if rowsAffected == 0 {
-		http.Error(w, "Post not found or unauthorized", http.StatusNotFound)
+	if err := auditModeration(tx, r, before.AuthorID, audit.PostDelete, "post", postID, before, nil); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to delete post", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete post", http.StatusInternalServerError)
 		return
 	}
 
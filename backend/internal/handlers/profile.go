@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"encoding/json"
+	"forum/config"
+	"forum/internal/auth"
 	"net/http"
 
 	"github.com/jmoiron/sqlx"
@@ -19,23 +21,34 @@ func hashPassword(password string) (string, error) {
 }
 
 type ProfileHandler struct {
-	db *sqlx.DB
+	db  *sqlx.DB
+	cfg *config.Config
 }
 
 func NewProfileHandler(db *sqlx.DB) *ProfileHandler {
-	return &ProfileHandler{db: db}
+	return &ProfileHandler{
+		db:  db,
+		cfg: config.LoadConfig(),
+	}
 }
 
 func (h *ProfileHandler) GetUserProfile(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(int64)
 
 	var user struct {
-		ID       int64  `json:"id"`
-		Username string `json:"username"`
-		Email    string `json:"email"`
+		ID            int64  `json:"id"`
+		Username      string `json:"username"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified" db:"email_verified"`
+		TwoFactor     bool   `json:"two_factor_enabled" db:"two_factor_enabled"`
 	}
 
-	err := h.db.QueryRowx("SELECT id, username, email FROM users WHERE id = $1", userID).StructScan(&user)
+	err := h.db.QueryRowx(
+		`SELECT id, username, email, email_verified_at IS NOT NULL AS email_verified,
+		 totp_enabled_at IS NOT NULL AS two_factor_enabled
+		 FROM users WHERE id = $1`,
+		userID,
+	).StructScan(&user)
 	if err != nil {
 		http.Error(w, "Failed to get user profile", http.StatusInternalServerError)
 		return
@@ -59,7 +72,7 @@ func (h *ProfileHandler) GetUserStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.db.QueryRowx("SELECT COUNT(*) FROM comments WHERE author_id = $1", userID).Scan(&stats.Comments)
+	err = h.db.QueryRowx("SELECT COUNT(*) FROM comments WHERE author_id = $1 AND deleted_at IS NULL", userID).Scan(&stats.Comments)
 	if err != nil {
 		http.Error(w, "Failed to get comments count", http.StatusInternalServerError)
 		return
@@ -106,5 +119,11 @@ func (h *ProfileHandler) ChangePassword(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	sessionID, _ := r.Context().Value("session_id").(int64)
+	if err := auth.RevokeUserSessions(h.db, userID, sessionID); err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
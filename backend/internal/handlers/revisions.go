@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"forum/internal/audit"
+	"forum/internal/database"
+	"forum/internal/diff"
+	"forum/internal/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// revisionTarget describes the revision table of posts or comments.
+type revisionTarget struct {
+	name     string // for error messages
+	table    string
+	column   string
+	hasTitle bool
+	// categoryQuery returns the category that decides who may read the target.
+	categoryQuery string
+}
+
+var (
+	postRevisions = revisionTarget{
+		name: "Post", table: "post_revisions", column: "post_id", hasTitle: true,
+		categoryQuery: "SELECT category_id FROM posts WHERE id = $1",
+	}
+	commentRevisions = revisionTarget{
+		name: "Comment", table: "comment_revisions", column: "comment_id",
+		categoryQuery: "SELECT p.category_id FROM comments c JOIN posts p ON p.id = c.post_id WHERE c.id = $1",
+	}
+)
+
+// save stores the next revision. The caller holds a lock on the post or
+// comment, so revision numbers can't collide.
+func (t revisionTarget) save(tx *sqlx.Tx, id int64, title, content string, editorID int64, reason string) error {
+	columns, values := "content", "$2"
+	args := []interface{}{id, content, editorID, reason, time.Now()}
+	if t.hasTitle {
+		columns, values = "title, content", "$6, $2"
+		args = append(args, title)
+	}
+
+	_, err := tx.Exec(fmt.Sprintf(
+		`INSERT INTO %[1]s (%[2]s, revision, %[3]s, editor_id, reason, created_at)
+		 SELECT $1, COALESCE(MAX(revision), 0) + 1, %[4]s, $3, $4, $5 FROM %[1]s WHERE %[2]s = $1`,
+		t.table, t.column, columns, values,
+	), args...)
+	return err
+}
+
+func (t revisionTarget) list(db sqlx.Queryer, id int64) ([]models.Revision, error) {
+	title := "NULL"
+	if t.hasTitle {
+		title = "r.title"
+	}
+
+	rows, err := db.Query(fmt.Sprintf(
+		`SELECT r.revision, %s, r.content, r.editor_id, u.username, r.reason, r.created_at
+		 FROM %s r
+		 LEFT JOIN users u ON u.id = r.editor_id
+		 WHERE r.%s = $1
+		 ORDER BY r.revision`,
+		title, t.table, t.column,
+	), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []models.Revision{}
+	for rows.Next() {
+		var revision models.Revision
+		err := rows.Scan(
+			&revision.Revision, &revision.Title, &revision.Content, &revision.EditorID, &revision.EditorUsername,
+			&revision.Reason, &revision.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+// checkReadable answers 404 unless the current user may read the target.
+func (t revisionTarget) checkReadable(w http.ResponseWriter, r *http.Request, id int64) bool {
+	var categoryID int64
+	err := database.DB.QueryRow(t.categoryQuery, id).Scan(&categoryID)
+	if err == sql.ErrNoRows {
+		http.Error(w, t.name+" not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return false
+	}
+
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return false
+	}
+	if !tree.canRead(categoryID, requestRole(r)) {
+		http.Error(w, t.name+" not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (t revisionTarget) getRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid "+strings.ToLower(t.name)+" ID", http.StatusBadRequest)
+		return
+	}
+	if !t.checkReadable(w, r, id) {
+		return
+	}
+
+	revisions, err := t.list(database.DB, id)
+	if err != nil {
+		log.Printf("Error fetching revisions: %v", err)
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// getDiff compares ?from= with ?to= (by default the latest revision with the
+// one before it). ?mode=word gives word segments instead of a unified diff.
+func (t revisionTarget) getDiff(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid "+strings.ToLower(t.name)+" ID", http.StatusBadRequest)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "unified"
+	}
+	if mode != "unified" && mode != "word" {
+		http.Error(w, "Mode must be unified or word", http.StatusBadRequest)
+		return
+	}
+
+	if !t.checkReadable(w, r, id) {
+		return
+	}
+
+	revisions, err := t.list(database.DB, id)
+	if err != nil {
+		log.Printf("Error fetching revisions: %v", err)
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return
+	}
+	if len(revisions) == 0 {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	// Revisions are numbered from 1 without gaps.
+	to := len(revisions)
+	from := to - 1
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"from", &from}, {"to", &to}} {
+		value := r.URL.Query().Get(param.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > len(revisions) {
+			http.Error(w, "Revision not found", http.StatusNotFound)
+			return
+		}
+		*param.value = n
+	}
+	if from < 1 {
+		from = 1
+	}
+
+	a, b := revisions[from-1], revisions[to-1]
+	result := models.RevisionDiff{From: from, To: to, Mode: mode}
+	fromLabel, toLabel := fmt.Sprintf("revision %d", from), fmt.Sprintf("revision %d", to)
+
+	if mode == "word" {
+		if t.hasTitle {
+			result.Title = diff.Words(*a.Title, *b.Title)
+		}
+		result.Content = diff.Words(a.Content, b.Content)
+	} else {
+		if t.hasTitle {
+			result.Title = diff.Unified(*a.Title, *b.Title, fromLabel, toLabel)
+		}
+		result.Content = diff.Unified(a.Content, b.Content, fromLabel, toLabel)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseRollback reads the target ID, the revision number and the optional
+// reason of a rollback request.
+func parseRollback(w http.ResponseWriter, r *http.Request, name string) (int64, int, string, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid "+name+" ID", http.StatusBadRequest)
+		return 0, 0, "", false
+	}
+	revision, err := strconv.Atoi(vars["revision"])
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return 0, 0, "", false
+	}
+
+	var req models.RollbackRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return 0, 0, "", false
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = fmt.Sprintf("Rollback to revision %d", revision)
+	}
+	return id, revision, req.Reason, true
+}
+
+func GetPostRevisions(w http.ResponseWriter, r *http.Request) {
+	postRevisions.getRevisions(w, r)
+}
+
+func GetPostRevisionDiff(w http.ResponseWriter, r *http.Request) {
+	postRevisions.getDiff(w, r)
+}
+
+func GetCommentRevisions(w http.ResponseWriter, r *http.Request) {
+	commentRevisions.getRevisions(w, r)
+}
+
+func GetCommentRevisionDiff(w http.ResponseWriter, r *http.Request) {
+	commentRevisions.getDiff(w, r)
+}
+
+// RollbackPost restores the title and content of an earlier revision. The
+// rollback is saved as a new revision, so it can be undone the same way. The
+// route requires posts.edit.any; authors just edit their posts.
+func RollbackPost(w http.ResponseWriter, r *http.Request) {
+	postID, number, reason, ok := parseRollback(w, r, "post")
+	if !ok {
+		return
+	}
+	userID := r.Context().Value("user_id").(int64)
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to roll back post", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.Post
+	err = tx.QueryRow(
+		`SELECT id, title, content, author_id, category_id, created_at, updated_at FROM posts WHERE id = $1 FOR UPDATE`, postID,
+	).Scan(&before.ID, &before.Title, &before.Content, &before.AuthorID, &before.CategoryID, &before.CreatedAt, &before.UpdatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to roll back post", http.StatusInternalServerError)
+		return
+	}
+
+	var title, content string
+	err = tx.QueryRow(
+		"SELECT title, content FROM post_revisions WHERE post_id = $1 AND revision = $2", postID, number,
+	).Scan(&title, &content)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to roll back post", http.StatusInternalServerError)
+		return
+	}
+	if title == before.Title && content == before.Content {
+		http.Error(w, "Post already matches this revision", http.StatusBadRequest)
+		return
+	}
+
+	post := before
+	post.Title, post.Content, post.UpdatedAt = title, content, time.Now()
+	_, err = tx.Exec("UPDATE posts SET title = $1, content = $2, updated_at = $3 WHERE id = $4",
+		post.Title, post.Content, post.UpdatedAt, postID)
+	if err != nil {
+		log.Printf("Error rolling back post: %v", err)
+		http.Error(w, "Failed to roll back post", http.StatusInternalServerError)
+		return
+	}
+
+	if err := postRevisions.save(tx, postID, post.Title, post.Content, userID, reason); err != nil {
+		log.Printf("Error saving post revision: %v", err)
+		http.Error(w, "Failed to roll back post", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.PostRollback, "post", postID, before, post); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to roll back post", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to roll back post", http.StatusInternalServerError)
+		return
+	}
+
+	if post.Tags, err = postTags(database.DB, postID); err != nil {
+		log.Printf("Error fetching post tags: %v", err)
+	}
+	json.NewEncoder(w).Encode(post)
+}
+
+// RollbackComment restores the content of an earlier comment revision.
+func RollbackComment(w http.ResponseWriter, r *http.Request) {
+	commentID, number, reason, ok := parseRollback(w, r, "comment")
+	if !ok {
+		return
+	}
+	userID := r.Context().Value("user_id").(int64)
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to roll back comment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.Comment
+	err = tx.QueryRow(
+		`SELECT id, content, post_id, author_id, created_at, updated_at FROM comments WHERE id = $1 FOR UPDATE`, commentID,
+	).Scan(&before.ID, &before.Content, &before.PostID, &before.AuthorID, &before.CreatedAt, &before.UpdatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to roll back comment", http.StatusInternalServerError)
+		return
+	}
+
+	var content string
+	err = tx.QueryRow(
+		"SELECT content FROM comment_revisions WHERE comment_id = $1 AND revision = $2", commentID, number,
+	).Scan(&content)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to roll back comment", http.StatusInternalServerError)
+		return
+	}
+	if content == before.Content {
+		http.Error(w, "Comment already matches this revision", http.StatusBadRequest)
+		return
+	}
+
+	comment := before
+	comment.Content, comment.UpdatedAt = content, time.Now()
+	_, err = tx.Exec("UPDATE comments SET content = $1, updated_at = $2 WHERE id = $3",
+		comment.Content, comment.UpdatedAt, commentID)
+	if err != nil {
+		log.Printf("Error rolling back comment: %v", err)
+		http.Error(w, "Failed to roll back comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := commentRevisions.save(tx, commentID, "", comment.Content, userID, reason); err != nil {
+		log.Printf("Error saving comment revision: %v", err)
+		http.Error(w, "Failed to roll back comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.CommentRollback, "comment", commentID, before, comment); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to roll back comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to roll back comment", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(comment)
+}
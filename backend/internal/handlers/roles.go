@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"encoding/json"
+	"forum/internal/audit"
+	"forum/internal/auth"
+	"forum/internal/database"
+	"forum/internal/models"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,19}$`)
+
+// hasPermission checks a permission for the role of the current user. With
+// REQUIRE_ADMIN_2FA, a session without a second factor has none.
+func hasPermission(r *http.Request, permission string) (bool, error) {
+	role, _ := r.Context().Value("user_role").(string)
+	granted, err := auth.HasPermission(database.DB, role, permission)
+	return granted && auth.SecondFactorSatisfied(r), err
+}
+
+func allPermissions() []string {
+	permissions := make([]string, 0, len(auth.Permissions))
+	for name := range auth.Permissions {
+		permissions = append(permissions, name)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+func validatePermissions(w http.ResponseWriter, permissions []string) bool {
+	for _, permission := range permissions {
+		if !auth.ValidPermission(permission) {
+			http.Error(w, "Unknown permission: "+permission, http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+func roleExists(db sqlx.Queryer, name string) (bool, error) {
+	var exists bool
+	err := db.QueryRowx("SELECT EXISTS(SELECT 1 FROM roles WHERE name = $1)", name).Scan(&exists)
+	return exists, err
+}
+
+// checkGrantable answers 403 unless the current user holds every one of
+// permissions, so that roles.manage can't be used to hand out more than
+// the actor has. Admins hold every permission.
+func checkGrantable(w http.ResponseWriter, r *http.Request, db sqlx.Queryer, permissions []string) bool {
+	actorRole := requestRole(r)
+	if actorRole == auth.AdminRole {
+		return true
+	}
+
+	for _, permission := range permissions {
+		granted, err := auth.HasPermission(db, actorRole, permission)
+		if err != nil {
+			log.Printf("Error checking permissions: %v", err)
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return false
+		}
+		if !granted {
+			http.Error(w, "You can't grant a permission you don't have: "+permission, http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+func sortedPermissions(permissions []string) []string {
+	sorted := append([]string{}, permissions...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// lockRole loads a role with its permissions and locks it for the transaction.
+func lockRole(tx *sqlx.Tx, name string) (*models.Role, error) {
+	var role models.Role
+	err := tx.QueryRow(
+		"SELECT name, description, builtin, created_at FROM roles WHERE name = $1 FOR UPDATE", name,
+	).Scan(&role.Name, &role.Description, &role.Builtin, &role.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	role.Permissions = []string{}
+	err = tx.Select(&role.Permissions, "SELECT permission FROM role_permissions WHERE role = $1 ORDER BY permission", name)
+	return &role, err
+}
+
+func replaceRolePermissions(tx *sqlx.Tx, role string, permissions []string) error {
+	if _, err := tx.Exec("DELETE FROM role_permissions WHERE role = $1", role); err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		_, err := tx.Exec(
+			"INSERT INTO role_permissions (role, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			role, permission,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetPermissions(w http.ResponseWriter, r *http.Request) {
+	permissions := make([]models.Permission, 0, len(auth.Permissions))
+	for _, name := range allPermissions() {
+		permissions = append(permissions, models.Permission{Name: name, Description: auth.Permissions[name]})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(permissions)
+}
+
+func GetRoles(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT r.name, r.description, r.builtin, r.created_at,
+			  COALESCE(array_agg(p.permission ORDER BY p.permission) FILTER (WHERE p.permission IS NOT NULL), '{}')
+			  FROM roles r
+			  LEFT JOIN role_permissions p ON p.role = r.name
+			  GROUP BY r.name
+			  ORDER BY r.created_at, r.name`
+
+	rows, err := database.DB.Query(query)
+	if err != nil {
+		log.Printf("Error fetching roles: %v", err)
+		http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	roles := []models.Role{}
+	for rows.Next() {
+		var role models.Role
+		err := rows.Scan(&role.Name, &role.Description, &role.Builtin, &role.CreatedAt, pq.Array(&role.Permissions))
+		if err != nil {
+			http.Error(w, "Failed to scan role", http.StatusInternalServerError)
+			return
+		}
+		if role.Name == auth.AdminRole {
+			role.Permissions = allPermissions()
+		}
+		roles = append(roles, role)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+func CreateRole(w http.ResponseWriter, r *http.Request) {
+	var req models.RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if !roleNamePattern.MatchString(req.Name) {
+		http.Error(w, "Role name must be 2-20 lowercase letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+	if !validatePermissions(w, req.Permissions) {
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to create role", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkGrantable(w, r, tx, req.Permissions) {
+		return
+	}
+
+	role := models.Role{Name: req.Name, Description: req.Description, CreatedAt: time.Now()}
+	result, err := tx.Exec(
+		"INSERT INTO roles (name, description, builtin, created_at) VALUES ($1, $2, FALSE, $3) ON CONFLICT DO NOTHING",
+		role.Name, role.Description, role.CreatedAt,
+	)
+	if err != nil {
+		log.Printf("Error creating role: %v", err)
+		http.Error(w, "Failed to create role", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Role already exists", http.StatusConflict)
+		return
+	}
+
+	if err := replaceRolePermissions(tx, role.Name, req.Permissions); err != nil {
+		log.Printf("Error saving role permissions: %v", err)
+		http.Error(w, "Failed to create role", http.StatusInternalServerError)
+		return
+	}
+
+	role.Permissions = sortedPermissions(req.Permissions)
+	if err := audit.Record(tx, r, audit.RoleCreate, "role", role.Name, nil, role); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to create role", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create role", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(role)
+}
+
+// UpdateRole replaces the description and permissions of a role. Permissions
+// are checked per request, so existing sessions pick up the change at once.
+func UpdateRole(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == auth.AdminRole {
+		http.Error(w, "The admin role always has every permission", http.StatusBadRequest)
+		return
+	}
+
+	var req models.RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validatePermissions(w, req.Permissions) {
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := lockRole(tx, name)
+	if err != nil {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+
+	// Nobody edits their own role, and only someone holding all of a role's
+	// permissions may change it.
+	if name == requestRole(r) {
+		http.Error(w, "You can't change your own role", http.StatusForbidden)
+		return
+	}
+	allowed, err := auth.CanManageRole(tx, requestRole(r), name)
+	if err != nil {
+		log.Printf("Error checking role permissions: %v", err)
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Role "+name+" has permissions you don't have", http.StatusForbidden)
+		return
+	}
+	if !checkGrantable(w, r, tx, req.Permissions) {
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE roles SET description = $1 WHERE name = $2", req.Description, name); err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	if err := replaceRolePermissions(tx, name, req.Permissions); err != nil {
+		log.Printf("Error saving role permissions: %v", err)
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	role := *before
+	role.Description = req.Description
+	role.Permissions = sortedPermissions(req.Permissions)
+	if err := audit.Record(tx, r, audit.RoleUpdate, "role", name, before, role); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+func DeleteRole(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to delete role", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := lockRole(tx, name)
+	if err != nil {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+	if before.Builtin {
+		http.Error(w, "Built-in roles can't be deleted", http.StatusBadRequest)
+		return
+	}
+
+	var inUse, inCategories bool
+	err = tx.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM users WHERE role = $1),
+		 EXISTS(SELECT 1 FROM categories WHERE $1 = ANY(read_roles || post_roles || comment_roles))`, name,
+	).Scan(&inUse, &inCategories)
+	if err != nil {
+		http.Error(w, "Failed to delete role", http.StatusInternalServerError)
+		return
+	}
+	if inUse {
+		http.Error(w, "Role is still assigned to users", http.StatusConflict)
+		return
+	}
+	// Dropping the role from a category would open it to everyone.
+	if inCategories {
+		http.Error(w, "Role is still used by category access rules", http.StatusConflict)
+		return
+	}
+
+	// users.role references roles, so a concurrent assignment makes this fail
+	// instead of leaving users with a deleted role.
+	if _, err := tx.Exec("DELETE FROM roles WHERE name = $1", name); err != nil {
+		log.Printf("Error deleting role: %v", err)
+		http.Error(w, "Failed to delete role", http.StatusConflict)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.RoleDelete, "role", name, before, nil); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to delete role", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error deleting role: %v", err)
+		http.Error(w, "Failed to delete role", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"forum/internal/audit"
+	"forum/internal/auth"
+	"forum/internal/database"
+	"forum/internal/models"
+	"forum/internal/pagination"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+const selectSanction = `SELECT s.id, s.user_id, u.username, s.type, s.reason, s.issued_by, i.username,
+			  s.created_at, s.expires_at, s.revoked_at, s.revoked_by
+			  FROM sanctions s
+			  JOIN users u ON u.id = s.user_id
+			  LEFT JOIN users i ON i.id = s.issued_by`
+
+func scanSanction(row interface{ Scan(...interface{}) error }, sanction *models.Sanction) error {
+	return row.Scan(
+		&sanction.ID, &sanction.UserID, &sanction.Username, &sanction.Type, &sanction.Reason,
+		&sanction.IssuedBy, &sanction.IssuedByName,
+		&sanction.CreatedAt, &sanction.ExpiresAt, &sanction.RevokedAt, &sanction.RevokedBy,
+	)
+}
+
+// GetSanctions lists sanctions page by page, newest first. ?user_id= limits
+// them to one user and ?active=true hides expired and lifted ones.
+func GetSanctions(w http.ResponseWriter, r *http.Request) {
+	params, err := pagination.FromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var conditions []string
+	var args []interface{}
+
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		userID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		args = append(args, userID)
+		conditions = append(conditions, fmt.Sprintf("s.user_id = $%d", len(args)))
+	}
+
+	if r.URL.Query().Get("active") == "true" {
+		args = append(args, time.Now())
+		conditions = append(conditions, fmt.Sprintf("s.revoked_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > $%d)", len(args)))
+	}
+
+	if condition := params.Where("s.created_at", "s.id", &args); condition != "" {
+		conditions = append(conditions, condition)
+	}
+
+	query := selectSanction
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += params.OrderBy("s.created_at", "s.id")
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error fetching sanctions: %v", err)
+		http.Error(w, "Failed to fetch sanctions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var sanctions []models.Sanction
+	for rows.Next() {
+		var sanction models.Sanction
+		if err := scanSanction(rows, &sanction); err != nil {
+			http.Error(w, "Failed to scan sanction", http.StatusInternalServerError)
+			return
+		}
+		sanctions = append(sanctions, sanction)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pagination.NewPage(sanctions, params, func(sanction models.Sanction) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: sanction.CreatedAt, ID: sanction.ID}
+	}))
+}
+
+// checkSanctionTarget answers with an error unless the current user may
+// sanction userID, or lift a sanction of theirs. Moderators can't act on
+// each other; that takes users.manage.
+func checkSanctionTarget(w http.ResponseWriter, r *http.Request, db sqlx.Queryer, userID int64) bool {
+	var targetRole string
+	if err := db.QueryRowx("SELECT role FROM users WHERE id = $1", userID).Scan(&targetRole); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	}
+
+	targetIsStaff, err := auth.HasPermission(db, targetRole, auth.PermUsersSanction)
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return false
+	}
+	if targetIsStaff {
+		canManage, err := hasPermission(r, auth.PermUsersManage)
+		if err != nil {
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return false
+		}
+		if !canManage {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+func CreateSanction(w http.ResponseWriter, r *http.Request) {
+	issuerID := r.Context().Value("user_id").(int64)
+
+	var req models.SanctionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	switch {
+	case !auth.ValidSanctionType(req.Type):
+		http.Error(w, "Type must be ban, suspension or mute", http.StatusBadRequest)
+		return
+	case req.Reason == "":
+		http.Error(w, "Reason is required", http.StatusBadRequest)
+		return
+	case req.ExpiresAt == nil && req.Type != auth.SanctionBan:
+		http.Error(w, "Only bans can be permanent", http.StatusBadRequest)
+		return
+	case req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()):
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	case req.UserID == issuerID:
+		http.Error(w, "You can't sanction yourself", http.StatusBadRequest)
+		return
+	}
+
+	if !checkSanctionTarget(w, r, database.DB, req.UserID) {
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to create sanction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var sanctionID int64
+	err = tx.QueryRow(
+		`INSERT INTO sanctions (user_id, type, reason, issued_by, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		req.UserID, req.Type, req.Reason, issuerID, time.Now(), req.ExpiresAt,
+	).Scan(&sanctionID)
+	if err != nil {
+		log.Printf("Error creating sanction: %v", err)
+		http.Error(w, "Failed to create sanction", http.StatusInternalServerError)
+		return
+	}
+
+	// Suspensions and mutes are checked on every request and chat message;
+	// a ban also ends the sessions the user already has.
+	if req.Type == auth.SanctionBan {
+		if err := auth.RevokeUserSessions(tx, req.UserID, 0); err != nil {
+			log.Printf("Error revoking sessions of banned user %d: %v", req.UserID, err)
+			http.Error(w, "Failed to create sanction", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var sanction models.Sanction
+	if err := scanSanction(tx.QueryRow(selectSanction+` WHERE s.id = $1`, sanctionID), &sanction); err != nil {
+		http.Error(w, "Failed to fetch sanction", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.SanctionCreate, "user", req.UserID, nil, sanction); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to create sanction", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create sanction", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Type == auth.SanctionBan {
+		DisconnectUser(req.UserID, "Account is banned")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sanction)
+}
+
+// RevokeSanction lifts a sanction before it expires. It stays in the history.
+func RevokeSanction(w http.ResponseWriter, r *http.Request) {
+	sanctionID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid sanction ID", http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value("user_id").(int64)
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to revoke sanction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before models.Sanction
+	err = scanSanction(tx.QueryRow(selectSanction+` WHERE s.id = $1 AND s.revoked_at IS NULL FOR UPDATE OF s`, sanctionID), &before)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Sanction not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to revoke sanction", http.StatusInternalServerError)
+		return
+	}
+
+	// The same rules as for issuing: nobody lifts their own sanction, and
+	// only users.manage lifts one of another moderator.
+	if before.UserID == userID {
+		http.Error(w, "You can't revoke your own sanction", http.StatusForbidden)
+		return
+	}
+	if !checkSanctionTarget(w, r, tx, before.UserID) {
+		return
+	}
+
+	after := before
+	now := time.Now()
+	after.RevokedAt, after.RevokedBy = &now, &userID
+
+	_, err = tx.Exec("UPDATE sanctions SET revoked_at = $1, revoked_by = $2 WHERE id = $3", now, userID, sanctionID)
+	if err != nil {
+		log.Printf("Error revoking sanction: %v", err)
+		http.Error(w, "Failed to revoke sanction", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.SanctionRevoke, "user", before.UserID, before, after); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to revoke sanction", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to revoke sanction", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
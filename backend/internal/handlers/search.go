@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"forum/config"
+	"forum/internal/database"
+	"forum/internal/models"
+	"forum/internal/pagination"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ts_headline marks matches with control characters, so the snippet can be
+// HTML escaped before they are turned into <mark> tags.
+const (
+	headlineStart   = "\x01"
+	headlineStop    = "\x02"
+	headlineOptions = `StartSel="` + headlineStart + `", StopSel="` + headlineStop + `", MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=" … "`
+)
+
+var snippetMarks = strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>")
+
+// Search ranks posts and comments matching ?q= by relevance. Filters: type
+// (post or comment), author (username), author_id, from and to (RFC 3339).
+// The query uses web search syntax: "quoted phrases", or, -excluded.
+func Search(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	q := strings.TrimSpace(params.Get("q"))
+	if q == "" {
+		http.Error(w, "Search query is required", http.StatusBadRequest)
+		return
+	}
+
+	searchType := params.Get("type")
+	if searchType != "" && searchType != "post" && searchType != "comment" {
+		http.Error(w, "Type must be post or comment", http.StatusBadRequest)
+		return
+	}
+
+	page, err := pagination.OffsetFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to search", http.StatusInternalServerError)
+		return
+	}
+
+	args := []interface{}{config.LoadConfig().SearchLanguage, q, headlineOptions}
+	// Conditions are shared by both branches; {t} stands for the table alias.
+	var conditions []string
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+
+	// Both branches join the post, which decides who may read the match.
+	addCondition("p.category_id = ANY($%d)", pq.Array(tree.readable(requestRole(r))))
+
+	if value := params.Get("author"); value != "" {
+		addCondition("u.username = $%d", value)
+	}
+	if value := params.Get("author_id"); value != "" {
+		authorID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid author ID", http.StatusBadRequest)
+			return
+		}
+		addCondition("{t}.author_id = $%d", authorID)
+	}
+	for _, bound := range []struct{ param, format string }{
+		{"from", "{t}.created_at >= $%d"},
+		{"to", "{t}.created_at < $%d"},
+	} {
+		value := params.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "Invalid "+bound.param+" time, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+		addCondition(bound.format, t)
+	}
+
+	where := func(alias string) string {
+		clause := alias + ".search_vector @@ websearch_to_tsquery($1::regconfig, $2)"
+		for _, condition := range conditions {
+			clause += " AND " + strings.ReplaceAll(condition, "{t}", alias)
+		}
+		return clause
+	}
+
+	var branches []string
+	if searchType != "comment" {
+		branches = append(branches, `SELECT 'post' AS type, p.id, p.id AS post_id, p.title, p.content,
+				  p.author_id, u.username, p.created_at,
+				  ts_rank(p.search_vector, websearch_to_tsquery($1::regconfig, $2)) AS rank
+				  FROM posts p
+				  JOIN users u ON u.id = p.author_id
+				  WHERE `+where("p"))
+	}
+	if searchType != "post" {
+		branches = append(branches, `SELECT 'comment' AS type, c.id, c.post_id, p.title, c.content,
+				  c.author_id, u.username, c.created_at,
+				  ts_rank(c.search_vector, websearch_to_tsquery($1::regconfig, $2)) AS rank
+				  FROM comments c
+				  JOIN posts p ON p.id = c.post_id
+				  JOIN users u ON u.id = c.author_id
+				  WHERE c.deleted_at IS NULL AND `+where("c"))
+	}
+
+	// Snippets are only built for the rows of the requested page.
+	query := `SELECT type, id, post_id, title, author_id, username, created_at, rank,
+			  ts_headline($1::regconfig, content, websearch_to_tsquery($1::regconfig, $2), $3)
+			  FROM (` + strings.Join(branches, " UNION ALL ") + `
+				  ORDER BY rank DESC, created_at DESC, type, id DESC` + page.Clause() + `
+			  ) results
+			  ORDER BY rank DESC, created_at DESC, type, id DESC`
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error searching: %v", err)
+		http.Error(w, "Failed to search", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var results []models.SearchResult
+	for rows.Next() {
+		var result models.SearchResult
+		err := rows.Scan(
+			&result.Type, &result.ID, &result.PostID, &result.PostTitle, &result.AuthorID, &result.AuthorUsername,
+			&result.CreatedAt, &result.Rank, &result.Snippet,
+		)
+		if err != nil {
+			http.Error(w, "Failed to scan search result", http.StatusInternalServerError)
+			return
+		}
+		result.Snippet = snippetMarks.Replace(html.EscapeString(result.Snippet))
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pagination.NewOffsetPage(results, page))
+}
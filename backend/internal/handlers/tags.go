@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"forum/internal/audit"
+	"forum/internal/database"
+	"forum/internal/models"
+	"forum/internal/pagination"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const maxPostTags = 10
+
+var tagNamePattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}+#._-]{0,29}$`)
+
+// tagsColumn selects the sorted tag names of post alias p.
+const tagsColumn = `ARRAY(SELECT t.name FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+			  WHERE pt.post_id = p.id ORDER BY t.name)`
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// normalizeTag lowercases and trims a tag name; ok is false if it isn't valid.
+func normalizeTag(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return name, tagNamePattern.MatchString(name)
+}
+
+// normalizeTags validates the tags of a post and drops duplicates.
+func normalizeTags(w http.ResponseWriter, names []string) ([]string, bool) {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, name := range names {
+		tag, ok := normalizeTag(name)
+		if !ok {
+			http.Error(w, "Invalid tag: "+name, http.StatusBadRequest)
+			return nil, false
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxPostTags {
+		http.Error(w, fmt.Sprintf("A post can have at most %d tags", maxPostTags), http.StatusBadRequest)
+		return nil, false
+	}
+	sort.Strings(tags)
+	return tags, true
+}
+
+// setPostTags replaces the tags of a post, creating unknown tags on the way.
+func setPostTags(tx *sqlx.Tx, postID int64, tags []string) error {
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT INTO tags (name) VALUES ($1) ON CONFLICT (name) DO NOTHING", tag); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM post_tags WHERE post_id = $1", postID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		"INSERT INTO post_tags (post_id, tag_id) SELECT $1, id FROM tags WHERE name = ANY($2)",
+		postID, pq.Array(tags),
+	)
+	return err
+}
+
+func postTags(db sqlx.Queryer, postID int64) ([]string, error) {
+	tags := []string{}
+	err := sqlx.Select(db, &tags, `SELECT t.name FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.post_id = $1 ORDER BY t.name`, postID)
+	return tags, err
+}
+
+// tagFilter reads ?tags=a,b and ?match=all|any for GetPosts. It returns ""
+// without tags and appends its argument to args.
+func tagFilter(r *http.Request, args *[]interface{}) (string, error) {
+	value := r.URL.Query().Get("tags")
+	if value == "" {
+		return "", nil
+	}
+
+	seen := map[string]bool{}
+	var tags []string
+	for _, name := range strings.Split(value, ",") {
+		tag, ok := normalizeTag(name)
+		if !ok {
+			return "", fmt.Errorf("invalid tag: %s", name)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	*args = append(*args, pq.Array(tags))
+	n := len(*args)
+	switch r.URL.Query().Get("match") {
+	case "", "all":
+		return fmt.Sprintf(`(SELECT COUNT(*) FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+			WHERE pt.post_id = p.id AND t.name = ANY($%d)) = %d`, n, len(tags)), nil
+	case "any":
+		return fmt.Sprintf(`EXISTS(SELECT 1 FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+			WHERE pt.post_id = p.id AND t.name = ANY($%d))`, n), nil
+	default:
+		return "", fmt.Errorf("match must be all or any")
+	}
+}
+
+// GetTags lists tags with the number of posts the current user can see, most
+// used first. ?prefix= narrows them down for autocomplete.
+func GetTags(w http.ResponseWriter, r *http.Request) {
+	limit := pagination.DefaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > pagination.MaxLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", pagination.MaxLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+		return
+	}
+
+	prefix := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("prefix")))
+	query := `SELECT t.id, t.name, COUNT(*) AS posts_count
+			  FROM tags t
+			  JOIN post_tags pt ON pt.tag_id = t.id
+			  JOIN posts p ON p.id = pt.post_id
+			  WHERE p.category_id = ANY($1) AND t.name LIKE $2
+			  GROUP BY t.id
+			  ORDER BY posts_count DESC, t.name
+			  LIMIT $3`
+
+	rows, err := database.DB.Query(query, pq.Array(tree.readable(requestRole(r))), likeEscaper.Replace(prefix)+"%", limit)
+	if err != nil {
+		log.Printf("Error fetching tags: %v", err)
+		http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tags := []models.Tag{}
+	for rows.Next() {
+		var tag models.Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.PostsCount); err != nil {
+			http.Error(w, "Failed to scan tag", http.StatusInternalServerError)
+			return
+		}
+		tags = append(tags, tag)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+func lockTag(tx *sqlx.Tx, tagID int64) (*models.Tag, error) {
+	var tag models.Tag
+	err := tx.QueryRow(
+		`SELECT id, name, (SELECT COUNT(*) FROM post_tags WHERE tag_id = tags.id) FROM tags WHERE id = $1 FOR UPDATE`, tagID,
+	).Scan(&tag.ID, &tag.Name, &tag.PostsCount)
+	return &tag, err
+}
+
+// RenameTag changes the name of a tag. Renaming onto an existing tag is a
+// merge and has to go through MergeTag.
+func RenameTag(w http.ResponseWriter, r *http.Request) {
+	tagID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	var req models.TagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name, ok := normalizeTag(req.Name)
+	if !ok {
+		http.Error(w, "Invalid tag name", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to rename tag", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := lockTag(tx, tagID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to rename tag", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec(
+		`UPDATE tags SET name = $1 WHERE id = $2
+		 AND NOT EXISTS(SELECT 1 FROM tags WHERE name = $1 AND id <> $2)`, name, tagID,
+	)
+	if err != nil {
+		log.Printf("Error renaming tag: %v", err)
+		http.Error(w, "Failed to rename tag", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "A tag with this name already exists; merge the tags instead", http.StatusConflict)
+		return
+	}
+
+	tag := *before
+	tag.Name = name
+	if err := audit.Record(tx, r, audit.TagRename, "tag", tagID, before, tag); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to rename tag", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to rename tag", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tag)
+}
+
+// MergeTag moves the posts of a tag to target_id and deletes the tag.
+func MergeTag(w http.ResponseWriter, r *http.Request) {
+	tagID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	var req models.TagMergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.TargetID == tagID {
+		http.Error(w, "A tag can't be merged into itself", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock both tags in ID order so that opposite merges can't deadlock.
+	tags := map[int64]*models.Tag{}
+	ids := []int64{tagID, req.TargetID}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		tag, err := lockTag(tx, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Tag not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+			return
+		}
+		tags[id] = tag
+	}
+	source, target := tags[tagID], tags[req.TargetID]
+
+	_, err = tx.Exec(
+		`INSERT INTO post_tags (post_id, tag_id)
+		 SELECT post_id, $1 FROM post_tags WHERE tag_id = $2
+		 ON CONFLICT DO NOTHING`, target.ID, source.ID,
+	)
+	if err != nil {
+		log.Printf("Error merging tags: %v", err)
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM tags WHERE id = $1", source.ID); err != nil {
+		log.Printf("Error merging tags: %v", err)
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+
+	merged, err := lockTag(tx, target.ID)
+	if err != nil {
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+
+	if err := audit.Record(tx, r, audit.TagMerge, "tag", source.ID, source, merged); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merged)
+}
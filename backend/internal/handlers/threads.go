@@ -0,0 +1,533 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/internal/database"
+	"forum/internal/markdown"
+	"forum/internal/models"
+	"forum/internal/pagination"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const deletedComment = "[deleted]"
+
+// commentColumns are read by scanComment; they need comments c joined with
+// users u on the author.
+const commentColumns = `c.id, c.content, c.post_id, c.parent_id, c.path, c.deleted_at, c.created_at, c.updated_at,
+	u.id, u.username, u.email, u.role, u.created_at,
+	c.score, c.upvotes, c.downvotes, c.reaction_counts`
+
+func scanComment(row interface{ Scan(...interface{}) error }) (models.CommentResponse, error) {
+	var comment models.CommentResponse
+	var path pq.Int64Array
+	var deletedAt sql.NullTime
+	err := row.Scan(
+		&comment.ID, &comment.Content, &comment.PostID, &comment.ParentID, &path, &deletedAt,
+		&comment.CreatedAt, &comment.UpdatedAt,
+		&comment.Author.ID, &comment.Author.Username, &comment.Author.Email, &comment.Author.Role, &comment.Author.CreatedAt,
+		&comment.Score, &comment.Upvotes, &comment.Downvotes, (*reactionCounts)(&comment.Reactions),
+	)
+	if err != nil {
+		return comment, err
+	}
+
+	comment.Path = path
+	comment.Depth = len(path) - 1
+	if deletedAt.Valid {
+		comment.Deleted = true
+		comment.Content = deletedComment
+		comment.Author = models.UserResponse{}
+	} else {
+		comment.ContentHTML = markdown.Render(comment.Content)
+	}
+	return comment, nil
+}
+
+// commentOrders compare sibling comments for the ?sort= modes of a thread.
+var commentOrders = map[string]func(a, b *models.CommentResponse) bool{
+	"oldest": func(a, b *models.CommentResponse) bool {
+		return a.CreatedAt.Before(b.CreatedAt) || (a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID)
+	},
+	"newest": func(a, b *models.CommentResponse) bool {
+		return a.CreatedAt.After(b.CreatedAt) || (a.CreatedAt.Equal(b.CreatedAt) && a.ID > b.ID)
+	},
+	"top": func(a, b *models.CommentResponse) bool {
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.CreatedAt.After(b.CreatedAt) || (a.CreatedAt.Equal(b.CreatedAt) && a.ID > b.ID)
+	},
+}
+
+// commentTree nests comments under their parents, with the siblings of each
+// level in the given order. Comments whose parent isn't in the list become
+// roots.
+func commentTree(comments []models.CommentResponse, less func(a, b *models.CommentResponse) bool) []models.CommentResponse {
+	present := make(map[int64]bool, len(comments))
+	for _, comment := range comments {
+		present[comment.ID] = true
+	}
+	children := make(map[int64][]models.CommentResponse)
+	for _, comment := range comments {
+		var parentID int64
+		if comment.ParentID != nil && present[*comment.ParentID] {
+			parentID = *comment.ParentID
+		}
+		children[parentID] = append(children[parentID], comment)
+	}
+
+	var build func(parentID int64) []models.CommentResponse
+	build = func(parentID int64) []models.CommentResponse {
+		level := children[parentID]
+		sort.SliceStable(level, func(i, j int) bool { return less(&level[i], &level[j]) })
+		for i := range level {
+			level[i].Replies = build(level[i].ID)
+		}
+		return level
+	}
+	return build(0)
+}
+
+// flattenComments lists a tree depth first, so that every comment is followed
+// by its replies.
+func flattenComments(tree []models.CommentResponse) []models.CommentResponse {
+	var flat []models.CommentResponse
+	for _, comment := range tree {
+		replies := comment.Replies
+		comment.Replies = nil
+		flat = append(flat, comment)
+		flat = append(flat, flattenComments(replies)...)
+	}
+	return flat
+}
+
+// replyParent checks the comment a reply goes to and returns its path. The
+// row stays locked until the reply is committed, so that it can't be
+// deleted in between.
+func replyParent(w http.ResponseWriter, tx *sqlx.Tx, postID, parentID int64, maxDepth int) ([]int64, bool) {
+	var parentPostID int64
+	var path pq.Int64Array
+	var deletedAt sql.NullTime
+	err := tx.QueryRow(
+		"SELECT post_id, path, deleted_at FROM comments WHERE id = $1 FOR SHARE", parentID,
+	).Scan(&parentPostID, &path, &deletedAt)
+	if err == sql.ErrNoRows || (err == nil && parentPostID != postID) {
+		http.Error(w, "Parent comment not found", http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return nil, false
+	}
+	if deletedAt.Valid {
+		http.Error(w, "You can't reply to a deleted comment", http.StatusBadRequest)
+		return nil, false
+	}
+	// The parent's path has one ID per level above the reply.
+	if len(path) > maxDepth {
+		http.Error(w, "Replies can't be nested this deep", http.StatusBadRequest)
+		return nil, false
+	}
+	return path, true
+}
+
+// removeComment deletes a comment inside tx. A comment with replies is
+// blanked instead, and placeholders left without replies by the deletion
+// go as well.
+func removeComment(tx *sqlx.Tx, commentID int64, parentID *int64) error {
+	var hasReplies bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM comments WHERE parent_id = $1)", commentID).Scan(&hasReplies); err != nil {
+		return err
+	}
+
+	if hasReplies {
+		// The text goes with its revisions and attachments, which could be
+		// read separately otherwise.
+		_, err := tx.Exec("UPDATE comments SET content = '', deleted_at = $1 WHERE id = $2", time.Now(), commentID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM comment_revisions WHERE comment_id = $1", commentID); err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM attachments WHERE comment_id = $1", commentID)
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM comments WHERE id = $1", commentID); err != nil {
+		return err
+	}
+	for parentID != nil {
+		var next *int64
+		err := tx.QueryRow(
+			`DELETE FROM comments
+			 WHERE id = $1 AND deleted_at IS NOT NULL AND NOT EXISTS (SELECT 1 FROM comments WHERE parent_id = $1)
+			 RETURNING parent_id`, *parentID,
+		).Scan(&next)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		parentID = next
+	}
+	return nil
+}
+
+// A page of threads holds about pageReplies replies, shared between its
+// threads, but every thread gets at least minThreadReplies.
+const (
+	pageReplies      = 1000
+	minThreadReplies = 20
+)
+
+// threadQuery selects a page of threads: top-level comments together with
+// their replies. The limit counts threads, not comments; replies beyond a
+// thread's share are left out and counted in MoreReplies of its top-level
+// comment.
+type threadQuery struct {
+	sort  string
+	less  func(a, b *models.CommentResponse) bool
+	tree  bool
+	limit int
+	// The oldest and newest sorts page by the top-level comment after or
+	// before a cursor. Top pages by offset, since scores keep changing.
+	after, before *pagination.Cursor
+	offset        int
+	beforeOffset  *int
+	// around is a comment whose thread the page is centred on.
+	around int64
+}
+
+// threadQueryFromRequest reads ?sort= (newest, oldest or top), ?view= (flat
+// or tree), ?limit= and one of ?cursor=, ?before= and ?around=.
+func threadQueryFromRequest(w http.ResponseWriter, r *http.Request) (threadQuery, bool) {
+	params := r.URL.Query()
+	q := threadQuery{sort: params.Get("sort")}
+	if q.sort == "" {
+		q.sort = "newest"
+	}
+	var ok bool
+	if q.less, ok = commentOrders[q.sort]; !ok {
+		http.Error(w, "Sort must be oldest, newest or top", http.StatusBadRequest)
+		return q, false
+	}
+
+	switch params.Get("view") {
+	case "", "flat":
+	case "tree":
+		q.tree = true
+	default:
+		http.Error(w, "View must be flat or tree", http.StatusBadRequest)
+		return q, false
+	}
+
+	given := 0
+	for _, name := range []string{"cursor", "before", "around"} {
+		if params.Get(name) != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		http.Error(w, "Only one of cursor, before and around can be given", http.StatusBadRequest)
+		return q, false
+	}
+
+	var err error
+	if q.sort == "top" {
+		var page pagination.Offset
+		if page, err = pagination.OffsetFromRequest(r); err == nil {
+			q.limit, q.offset = page.Limit, page.Offset
+		}
+		if value := params.Get("before"); value != "" && err == nil {
+			var end int
+			if end, err = pagination.DecodeOffset(value); err == nil {
+				q.beforeOffset = &end
+			}
+		}
+	} else {
+		var page pagination.Params
+		if page, err = pagination.FromRequest(r); err == nil {
+			q.limit, q.after = page.Limit, page.After
+		}
+		if value := params.Get("before"); value != "" && err == nil {
+			q.before, err = pagination.Decode(value)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return q, false
+	}
+
+	if value := params.Get("around"); value != "" {
+		if q.around, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+			return q, false
+		}
+	}
+	return q, true
+}
+
+// threadRoots lists up to n top-level comments of a post by creation time,
+// starting next to anchor, or at it when inclusive is set.
+func threadRoots(postID int64, ascending bool, anchor *pagination.Cursor, inclusive bool, n int) ([]pagination.Cursor, error) {
+	order, op := "DESC", "<"
+	if ascending {
+		order, op = "ASC", ">"
+	}
+	if inclusive {
+		op += "="
+	}
+
+	args := []interface{}{postID}
+	query := "SELECT c.created_at, c.id FROM comments c WHERE c.post_id = $1 AND c.parent_id IS NULL"
+	if anchor != nil {
+		args = append(args, anchor.CreatedAt, anchor.ID)
+		query += fmt.Sprintf(" AND (c.created_at, c.id) %s ($2, $3)", op)
+	}
+	query += fmt.Sprintf(" ORDER BY c.created_at %[1]s, c.id %[1]s LIMIT %[2]d", order, n)
+	return scanRoots(database.DB.Query(query, args...))
+}
+
+// topRoots lists top-level comments by score.
+func topRoots(postID int64, offset, n int) ([]pagination.Cursor, error) {
+	return scanRoots(database.DB.Query(fmt.Sprintf(
+		`SELECT c.created_at, c.id FROM comments c WHERE c.post_id = $1 AND c.parent_id IS NULL
+		 ORDER BY c.score DESC, c.created_at DESC, c.id DESC LIMIT %d OFFSET %d`, n, offset,
+	), postID))
+}
+
+func scanRoots(rows *sql.Rows, err error) ([]pagination.Cursor, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roots []pagination.Cursor
+	for rows.Next() {
+		var root pagination.Cursor
+		if err := rows.Scan(&root.CreatedAt, &root.ID); err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, rows.Err()
+}
+
+func reverseRoots(roots []pagination.Cursor) {
+	for i, j := 0, len(roots)-1; i < j; i, j = i+1, j-1 {
+		roots[i], roots[j] = roots[j], roots[i]
+	}
+}
+
+// pageRoots finds the top-level comments of the requested page and the
+// cursors next to it. found is false when the comment to centre on isn't
+// one of the post.
+func (q threadQuery) pageRoots(postID int64) (roots []pagination.Cursor, next, prev *string, found bool, err error) {
+	var anchor pagination.Cursor
+	if q.around != 0 {
+		// path starts with the ID of the top-level comment.
+		err = database.DB.QueryRow(
+			`SELECT t.created_at, t.id FROM comments c JOIN comments t ON t.id = c.path[1]
+			 WHERE c.id = $1 AND c.post_id = $2`, q.around, postID,
+		).Scan(&anchor.CreatedAt, &anchor.ID)
+		if err == sql.ErrNoRows {
+			return nil, nil, nil, false, nil
+		}
+		if err != nil {
+			return nil, nil, nil, false, err
+		}
+	}
+
+	if q.sort == "top" {
+		offset, n := q.offset, q.limit
+		switch {
+		case q.beforeOffset != nil:
+			offset = *q.beforeOffset - q.limit
+			if offset < 0 {
+				offset = 0
+			}
+			n = *q.beforeOffset - offset
+		case q.around != 0:
+			var position int
+			err = database.DB.QueryRow(
+				`SELECT COUNT(*) FROM comments c, comments t
+				 WHERE t.id = $2 AND c.post_id = $1 AND c.parent_id IS NULL
+				 AND (c.score, c.created_at, c.id) > (t.score, t.created_at, t.id)`, postID, anchor.ID,
+			).Scan(&position)
+			if err != nil {
+				return nil, nil, nil, false, err
+			}
+			offset = position - q.limit/2
+			if offset < 0 {
+				offset = 0
+			}
+		}
+
+		if roots, err = topRoots(postID, offset, n+1); err != nil {
+			return nil, nil, nil, false, err
+		}
+		if len(roots) > n {
+			roots = roots[:n]
+			cursor := pagination.EncodeOffset(offset + n)
+			next = &cursor
+		}
+		if offset > 0 {
+			cursor := pagination.EncodeOffset(offset)
+			prev = &cursor
+		}
+		return roots, next, prev, true, nil
+	}
+
+	ascending := q.sort == "oldest"
+	hasNext, hasPrev := false, false
+	switch {
+	case q.before != nil:
+		if roots, err = threadRoots(postID, !ascending, q.before, false, q.limit+1); err != nil {
+			return nil, nil, nil, false, err
+		}
+		if hasPrev = len(roots) > q.limit; hasPrev {
+			roots = roots[:q.limit]
+		}
+		reverseRoots(roots)
+		hasNext = true
+
+	case q.around != 0:
+		half := q.limit / 2
+		earlier, err := threadRoots(postID, !ascending, &anchor, false, half+1)
+		if err != nil {
+			return nil, nil, nil, false, err
+		}
+		if hasPrev = len(earlier) > half; hasPrev {
+			earlier = earlier[:half]
+		}
+		reverseRoots(earlier)
+		rest := q.limit - len(earlier)
+		later, err := threadRoots(postID, ascending, &anchor, true, rest+1)
+		if err != nil {
+			return nil, nil, nil, false, err
+		}
+		if hasNext = len(later) > rest; hasNext {
+			later = later[:rest]
+		}
+		roots = append(earlier, later...)
+
+	default:
+		if roots, err = threadRoots(postID, ascending, q.after, false, q.limit+1); err != nil {
+			return nil, nil, nil, false, err
+		}
+		if hasNext = len(roots) > q.limit; hasNext {
+			roots = roots[:q.limit]
+		}
+		hasPrev = q.after != nil
+	}
+
+	if len(roots) > 0 {
+		if hasNext {
+			cursor := roots[len(roots)-1].Encode()
+			next = &cursor
+		}
+		if hasPrev {
+			cursor := roots[0].Encode()
+			prev = &cursor
+		}
+	}
+	return roots, next, prev, true, nil
+}
+
+// threadRow scans the columns of scanComment followed by the size of the
+// comment's thread.
+type threadRow struct {
+	rows       *sql.Rows
+	threadSize *int
+}
+
+func (r threadRow) Scan(dest ...interface{}) error {
+	return r.rows.Scan(append(dest, r.threadSize)...)
+}
+
+// loadThreads returns a page of the threads of a post, answering the request
+// itself when it fails.
+func loadThreads(w http.ResponseWriter, r *http.Request, postID int64, q threadQuery) (pagination.Page[models.CommentResponse], bool) {
+	page := pagination.Page[models.CommentResponse]{Items: []models.CommentResponse{}}
+
+	roots, next, prev, found, err := q.pageRoots(postID)
+	if err != nil {
+		log.Printf("Error fetching comments: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return page, false
+	}
+	if !found {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return page, false
+	}
+	page.NextCursor, page.PrevCursor = next, prev
+	if len(roots) == 0 {
+		return page, true
+	}
+
+	ids := make([]int64, len(roots))
+	for i, root := range roots {
+		ids[i] = root.ID
+	}
+	perThread := pageReplies / len(roots)
+	if perThread < minThreadReplies {
+		perThread = minThreadReplies
+	}
+
+	// Ordered by path, every reply comes after its parent, so the first
+	// ones of a thread always form a connected tree.
+	rows, err := database.DB.Query(`SELECT `+commentColumns+`, c.thread_size
+		FROM (SELECT c.*,
+				ROW_NUMBER() OVER (PARTITION BY c.path[1] ORDER BY c.path) AS position,
+				COUNT(*) OVER (PARTITION BY c.path[1]) AS thread_size
+			  FROM comments c
+			  WHERE c.post_id = $1 AND c.path[1] = ANY($2)) c
+		JOIN users u ON c.author_id = u.id
+		WHERE c.position <= $3`, postID, pq.Array(ids), perThread+1)
+	if err != nil {
+		log.Printf("Error fetching comments: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return page, false
+	}
+	defer rows.Close()
+
+	var comments []models.CommentResponse
+	for rows.Next() {
+		var threadSize int
+		comment, err := scanComment(threadRow{rows, &threadSize})
+		if err != nil {
+			http.Error(w, "Failed to scan comment", http.StatusInternalServerError)
+			return page, false
+		}
+		if comment.ParentID == nil && threadSize > perThread+1 {
+			comment.MoreReplies = threadSize - perThread - 1
+		}
+		comments = append(comments, comment)
+	}
+	if err := withCommentAttachments(comments); err != nil {
+		log.Printf("Error fetching attachments: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return page, false
+	}
+	if err := withCommentVotes(r, comments); err != nil {
+		log.Printf("Error fetching votes: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return page, false
+	}
+
+	page.Items = commentTree(comments, q.less)
+	if !q.tree {
+		page.Items = flattenComments(page.Items)
+	}
+	return page, true
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"forum/config"
+	"forum/internal/database"
+	"forum/internal/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// voteTarget describes the vote and reaction tables of posts or comments.
+// The totals in the target table are kept up to date by triggers.
+type voteTarget struct {
+	name      string // for error messages
+	table     string
+	votes     string
+	reactions string
+	column    string
+	// ownerQuery returns the author and the category of the target.
+	ownerQuery string
+}
+
+var (
+	postVotes = voteTarget{
+		name: "Post", table: "posts", votes: "post_votes", reactions: "post_reactions", column: "post_id",
+		ownerQuery: "SELECT author_id, category_id FROM posts WHERE id = $1",
+	}
+	commentVotes = voteTarget{
+		name: "Comment", table: "comments", votes: "comment_votes", reactions: "comment_reactions", column: "comment_id",
+		ownerQuery: "SELECT c.author_id, p.category_id FROM comments c JOIN posts p ON p.id = c.post_id WHERE c.id = $1 AND c.deleted_at IS NULL",
+	}
+)
+
+// reactionCounts scans the reaction_counts JSONB column.
+type reactionCounts map[string]int
+
+func (c *reactionCounts) Scan(src interface{}) error {
+	data, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected reaction counts type %T", src)
+	}
+	return json.Unmarshal(data, (*map[string]int)(c))
+}
+
+// viewerID returns the current user, or 0 for guests.
+func viewerID(r *http.Request) int64 {
+	userID, _ := r.Context().Value("user_id").(int64)
+	return userID
+}
+
+// viewerVotes loads the votes and reactions a user gave to posts or comments,
+// keyed by their ID.
+func (t voteTarget) viewerVotes(db sqlx.Queryer, userID int64, ids []int64) (map[int64]int, map[int64]string, error) {
+	votes := make(map[int64]int)
+	reactions := make(map[int64]string)
+	if userID == 0 || len(ids) == 0 {
+		return votes, reactions, nil
+	}
+
+	rows, err := db.Query(fmt.Sprintf(
+		`SELECT %[2]s, value::text, 'vote' FROM %[1]s WHERE user_id = $1 AND %[2]s = ANY($2)
+		 UNION ALL
+		 SELECT %[2]s, emoji, 'reaction' FROM %[3]s WHERE user_id = $1 AND %[2]s = ANY($2)`,
+		t.votes, t.column, t.reactions,
+	), userID, pq.Array(ids))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var value, kind string
+		if err := rows.Scan(&id, &value, &kind); err != nil {
+			return nil, nil, err
+		}
+		if kind == "vote" {
+			votes[id], _ = strconv.Atoi(value)
+		} else {
+			reactions[id] = value
+		}
+	}
+	return votes, reactions, rows.Err()
+}
+
+// fill sets MyVote and MyReaction on the votes of the listed targets.
+func (t voteTarget) fill(r *http.Request, ids []int64, votesOf func(i int) *models.Votes) error {
+	votes, reactions, err := t.viewerVotes(database.DB, viewerID(r), ids)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		v := votesOf(i)
+		if v.Reactions == nil {
+			v.Reactions = map[string]int{}
+		}
+		v.MyVote = votes[id]
+		if emoji, ok := reactions[id]; ok {
+			v.MyReaction = &emoji
+		}
+	}
+	return nil
+}
+
+func withPostVotes(r *http.Request, posts []models.PostResponse) error {
+	ids := make([]int64, len(posts))
+	for i, post := range posts {
+		ids[i] = post.ID
+	}
+	return postVotes.fill(r, ids, func(i int) *models.Votes { return &posts[i].Votes })
+}
+
+func withCommentVotes(r *http.Request, comments []models.CommentResponse) error {
+	ids := make([]int64, len(comments))
+	for i, comment := range comments {
+		ids[i] = comment.ID
+	}
+	return commentVotes.fill(r, ids, func(i int) *models.Votes { return &comments[i].Votes })
+}
+
+// summary reads the totals of a target and the current user's share of them.
+func (t voteTarget) summary(r *http.Request, id int64) (models.Votes, error) {
+	var votes models.Votes
+	err := database.DB.QueryRow(
+		fmt.Sprintf("SELECT score, upvotes, downvotes, reaction_counts FROM %s WHERE id = $1", t.table), id,
+	).Scan(&votes.Score, &votes.Upvotes, &votes.Downvotes, (*reactionCounts)(&votes.Reactions))
+	if err != nil {
+		return votes, err
+	}
+	err = t.fill(r, []int64{id}, func(int) *models.Votes { return &votes })
+	return votes, err
+}
+
+// target reads the ID from the URL and makes sure the current user may see
+// the target. Unless allowOwn is set, authors can't vote for what they wrote.
+func (t voteTarget) target(w http.ResponseWriter, r *http.Request, allowOwn bool) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid "+strings.ToLower(t.name)+" ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var authorID, categoryID int64
+	err = database.DB.QueryRow(t.ownerQuery, id).Scan(&authorID, &categoryID)
+	if err == sql.ErrNoRows {
+		http.Error(w, t.name+" not found", http.StatusNotFound)
+		return 0, false
+	}
+	if err != nil {
+		log.Printf("Error fetching %s: %v", strings.ToLower(t.name), err)
+		http.Error(w, "Failed to save vote", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	tree, err := loadCategories(database.DB)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		http.Error(w, "Failed to save vote", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !tree.canRead(categoryID, requestRole(r)) {
+		http.Error(w, t.name+" not found", http.StatusNotFound)
+		return 0, false
+	}
+
+	if !allowOwn && authorID == viewerID(r) {
+		http.Error(w, "You can't vote for your own "+strings.ToLower(t.name), http.StatusForbidden)
+		return 0, false
+	}
+	return id, true
+}
+
+// respond answers with the totals after a change.
+func (t voteTarget) respond(w http.ResponseWriter, r *http.Request, id int64) {
+	votes, err := t.summary(r, id)
+	if err != nil {
+		log.Printf("Error fetching votes: %v", err)
+		http.Error(w, "Failed to fetch votes", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(votes)
+}
+
+// vote sets the current user's vote: 1 for up, -1 for down.
+func (t voteTarget) vote(w http.ResponseWriter, r *http.Request) {
+	var req models.VoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Value != 1 && req.Value != -1 {
+		http.Error(w, "Value must be 1 or -1", http.StatusBadRequest)
+		return
+	}
+
+	id, ok := t.target(w, r, false)
+	if !ok {
+		return
+	}
+
+	_, err := database.DB.Exec(fmt.Sprintf(
+		`INSERT INTO %[1]s (%[2]s, user_id, value, created_at) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (%[2]s, user_id) DO UPDATE SET value = EXCLUDED.value, created_at = EXCLUDED.created_at
+		 WHERE %[1]s.value <> EXCLUDED.value`,
+		t.votes, t.column,
+	), id, viewerID(r), req.Value, time.Now())
+	if err != nil {
+		log.Printf("Error saving vote: %v", err)
+		http.Error(w, "Failed to save vote", http.StatusInternalServerError)
+		return
+	}
+	t.respond(w, r, id)
+}
+
+func (t voteTarget) unvote(w http.ResponseWriter, r *http.Request) {
+	id, ok := t.target(w, r, false)
+	if !ok {
+		return
+	}
+
+	_, err := database.DB.Exec(
+		fmt.Sprintf("DELETE FROM %s WHERE %s = $1 AND user_id = $2", t.votes, t.column), id, viewerID(r),
+	)
+	if err != nil {
+		log.Printf("Error deleting vote: %v", err)
+		http.Error(w, "Failed to delete vote", http.StatusInternalServerError)
+		return
+	}
+	t.respond(w, r, id)
+}
+
+// react sets the current user's reaction, replacing the one they gave before.
+func (t voteTarget) react(w http.ResponseWriter, r *http.Request) {
+	var req models.ReactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !allowedReaction(req.Emoji) {
+		http.Error(w, "Unknown reaction", http.StatusBadRequest)
+		return
+	}
+
+	id, ok := t.target(w, r, true)
+	if !ok {
+		return
+	}
+
+	_, err := database.DB.Exec(fmt.Sprintf(
+		`INSERT INTO %[1]s (%[2]s, user_id, emoji, created_at) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (%[2]s, user_id) DO UPDATE SET emoji = EXCLUDED.emoji, created_at = EXCLUDED.created_at
+		 WHERE %[1]s.emoji <> EXCLUDED.emoji`,
+		t.reactions, t.column,
+	), id, viewerID(r), req.Emoji, time.Now())
+	if err != nil {
+		log.Printf("Error saving reaction: %v", err)
+		http.Error(w, "Failed to save reaction", http.StatusInternalServerError)
+		return
+	}
+	t.respond(w, r, id)
+}
+
+func (t voteTarget) unreact(w http.ResponseWriter, r *http.Request) {
+	id, ok := t.target(w, r, true)
+	if !ok {
+		return
+	}
+
+	_, err := database.DB.Exec(
+		fmt.Sprintf("DELETE FROM %s WHERE %s = $1 AND user_id = $2", t.reactions, t.column), id, viewerID(r),
+	)
+	if err != nil {
+		log.Printf("Error deleting reaction: %v", err)
+		http.Error(w, "Failed to delete reaction", http.StatusInternalServerError)
+		return
+	}
+	t.respond(w, r, id)
+}
+
+func allowedReaction(emoji string) bool {
+	for _, allowed := range config.LoadConfig().Reactions {
+		if emoji == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// GetReactions lists the emojis that can be used as reactions.
+func GetReactions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config.LoadConfig().Reactions)
+}
+
+func VotePost(w http.ResponseWriter, r *http.Request) {
+	postVotes.vote(w, r)
+}
+
+func UnvotePost(w http.ResponseWriter, r *http.Request) {
+	postVotes.unvote(w, r)
+}
+
+func ReactToPost(w http.ResponseWriter, r *http.Request) {
+	postVotes.react(w, r)
+}
+
+func UnreactToPost(w http.ResponseWriter, r *http.Request) {
+	postVotes.unreact(w, r)
+}
+
+func VoteComment(w http.ResponseWriter, r *http.Request) {
+	commentVotes.vote(w, r)
+}
+
+func UnvoteComment(w http.ResponseWriter, r *http.Request) {
+	commentVotes.unvote(w, r)
+}
+
+func ReactToComment(w http.ResponseWriter, r *http.Request) {
+	commentVotes.react(w, r)
+}
+
+func UnreactToComment(w http.ResponseWriter, r *http.Request) {
+	commentVotes.unreact(w, r)
+}
@@ -0,0 +1,290 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// ErrInvalidImage wraps the reasons an image is refused. Retrying won't help
+// with any of them.
+var ErrInvalidImage = errors.New("invalid image")
+
+// Types lists the content types the pipeline handles.
+var Types = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Limits guard the decoder against decompression bombs: small files that
+// expand into huge bitmaps. They are checked on the header, before any
+// pixel is decoded.
+type Limits struct {
+	MaxPixels int // width × height, summed over the frames of a GIF
+	MaxSide   int
+}
+
+// ThumbnailSize is the box a thumbnail is fitted into.
+type ThumbnailSize struct {
+	Name string
+	Max  int // longest side in pixels
+}
+
+var ThumbnailSizes = []ThumbnailSize{
+	{"small", 160},
+	{"medium", 480},
+	{"large", 1280},
+}
+
+// Encoded is an encoded image without metadata.
+type Encoded struct {
+	Name        string // thumbnail size; empty for the original
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// Result is the processed original and its thumbnails. Thumbnails that
+// would not be smaller than the original are left out.
+type Result struct {
+	Original   Encoded
+	Thumbnails []Encoded
+}
+
+const (
+	jpegQuality      = 90
+	thumbnailQuality = 82
+)
+
+// Process decodes an uploaded image and encodes it again, which drops EXIF,
+// GPS, XMP and any other metadata. JPEGs are turned upright first, since the
+// orientation tag goes away with the rest. WebP is stored as JPEG, or PNG
+// when it has transparency, as there is no WebP encoder.
+func Process(data []byte, contentType string, limits Limits) (*Result, error) {
+	if !Types[contentType] {
+		return nil, fmt.Errorf("%w: unsupported type %s", ErrInvalidImage, contentType)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	frames := 1
+	if contentType == "image/gif" {
+		if frames, err = gifFrameCount(data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+		}
+	}
+	if err := limits.check(config.Width, config.Height, frames); err != nil {
+		return nil, err
+	}
+
+	if contentType == "image/gif" {
+		return processGIF(data)
+	}
+
+	var img image.Image
+	switch contentType {
+	case "image/jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	case "image/png":
+		img, err = png.Decode(bytes.NewReader(data))
+	case "image/webp":
+		img, err = webp.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if contentType == "image/jpeg" {
+		img = orient(img, exifOrientation(data))
+	}
+
+	result := &Result{}
+	outType := contentType
+	if contentType == "image/webp" {
+		outType = "image/jpeg"
+		if !opaque(img) {
+			outType = "image/png"
+		}
+	}
+	if result.Original, err = encode(img, outType, jpegQuality); err != nil {
+		return nil, err
+	}
+	if result.Thumbnails, err = thumbnails(img, outType); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (l Limits) check(width, height, frames int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("%w: empty image", ErrInvalidImage)
+	}
+	if width > l.MaxSide || height > l.MaxSide {
+		return fmt.Errorf("%w: %dx%d is larger than %d pixels per side", ErrInvalidImage, width, height, l.MaxSide)
+	}
+	// Compare in int64 so that the product can't overflow on 32-bit builds.
+	if int64(width)*int64(height)*int64(frames) > int64(l.MaxPixels) {
+		return fmt.Errorf("%w: %dx%d with %d frames exceeds %d pixels", ErrInvalidImage, width, height, frames, l.MaxPixels)
+	}
+	return nil
+}
+
+// processGIF keeps animations. The encoder writes only the frames, their
+// palettes and the loop count, so comments and application data are gone.
+func processGIF(data []byte) (*Result, error) {
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return nil, fmt.Errorf("error encoding gif: %v", err)
+	}
+	result := &Result{Original: Encoded{
+		Data:        buf.Bytes(),
+		ContentType: "image/gif",
+		Width:       anim.Config.Width,
+		Height:      anim.Config.Height,
+	}}
+
+	// Thumbnails are stills of the first frame, drawn on the logical screen.
+	first := image.NewNRGBA(image.Rect(0, 0, anim.Config.Width, anim.Config.Height))
+	draw.Draw(first, anim.Image[0].Bounds(), anim.Image[0], anim.Image[0].Bounds().Min, draw.Over)
+	outType := "image/jpeg"
+	if !opaque(first) {
+		outType = "image/png"
+	}
+	if result.Thumbnails, err = thumbnails(first, outType); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func thumbnails(img image.Image, contentType string) ([]Encoded, error) {
+	bounds := img.Bounds()
+	var thumbs []Encoded
+	for _, size := range ThumbnailSizes {
+		width, height := fit(bounds.Dx(), bounds.Dy(), size.Max)
+		if width >= bounds.Dx() && height >= bounds.Dy() {
+			continue
+		}
+
+		dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+		thumb, err := encode(dst, contentType, thumbnailQuality)
+		if err != nil {
+			return nil, err
+		}
+		thumb.Name = size.Name
+		thumbs = append(thumbs, thumb)
+	}
+	return thumbs, nil
+}
+
+// fit scales width and height down so that the longer side is at most max.
+func fit(width, height, max int) (int, int) {
+	if width <= max && height <= max {
+		return width, height
+	}
+	if width >= height {
+		return max, maxInt(1, height*max/width)
+	}
+	return maxInt(1, width*max/height), max
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func encode(img image.Image, contentType string, quality int) (Encoded, error) {
+	var buf bytes.Buffer
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case "image/png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	default:
+		return Encoded{}, fmt.Errorf("can't encode %s", contentType)
+	}
+	if err != nil {
+		return Encoded{}, fmt.Errorf("error encoding %s: %v", contentType, err)
+	}
+	return Encoded{
+		Data:        buf.Bytes(),
+		ContentType: contentType,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+	}, nil
+}
+
+// opaque reports whether every pixel of img is fully opaque.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// orient applies an EXIF orientation (1-8) so that the image is upright.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated left, turn right
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated right, turn left
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, color.NRGBAModel.Convert(img.At(bounds.Min.X+sx, bounds.Min.Y+sy)))
+		}
+	}
+	return dst
+}
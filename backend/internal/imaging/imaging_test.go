@@ -0,0 +1,214 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+// pngHeader returns a PNG that ends after its IHDR chunk: enough for the
+// header to be read, but not a single pixel to decode.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 6 // 8-bit RGBA
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)-4))
+	buf.Write(ihdr)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf.Bytes()
+}
+
+func TestProcessChecksLimitsBeforeDecoding(t *testing.T) {
+	limits := Limits{MaxPixels: 1000000, MaxSide: 10000}
+	tests := []struct {
+		name          string
+		width, height uint32
+		want          string
+	}{
+		{"side", 100000, 10, "larger than"},
+		{"pixels", 5000, 5000, "exceeds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Process(pngHeader(tt.width, tt.height), "image/png", limits)
+			if !errors.Is(err, ErrInvalidImage) || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Process error = %v, want an invalid image error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessCountsGIFFrames(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for n := 0; n < 50; n++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 100, 100), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each frame is within the limit; all 50 together are not.
+	_, err := Process(buf.Bytes(), "image/gif", Limits{MaxPixels: 200000, MaxSide: 1000})
+	if !errors.Is(err, ErrInvalidImage) || !strings.Contains(err.Error(), "50 frames") {
+		t.Fatalf("Process error = %v, want the 50 frames to exceed the limit", err)
+	}
+
+	if _, err := Process(buf.Bytes(), "image/gif", Limits{MaxPixels: 500000, MaxSide: 1000}); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+}
+
+// exifSegment returns an APP1 segment with an orientation tag and a GPS
+// sub-IFD holding a latitude reference.
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 56)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+
+	order.PutUint16(tiff[8:], 2)
+	order.PutUint16(tiff[10:], 0x0112) // Orientation
+	order.PutUint16(tiff[12:], 3)      // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+	order.PutUint16(tiff[22:], 0x8825) // GPS IFD
+	order.PutUint16(tiff[24:], 4)      // LONG
+	order.PutUint32(tiff[26:], 1)
+	order.PutUint32(tiff[30:], 38)
+
+	order.PutUint16(tiff[38:], 1)
+	order.PutUint16(tiff[40:], 0x0001) // GPSLatitudeRef
+	order.PutUint16(tiff[42:], 2)      // ASCII
+	order.PutUint32(tiff[44:], 2)
+	copy(tiff[48:], "N\x00")
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+6+len(tiff)))
+	segment = append(segment, "Exif\x00\x00"...)
+	return append(segment, tiff...)
+}
+
+// withSegment inserts a segment right after the start of image marker.
+func withSegment(jpg, segment []byte) []byte {
+	data := append([]byte{}, jpg[:2]...)
+	data = append(data, segment...)
+	return append(data, jpg[2:]...)
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// hasSegment reports whether a JPEG has a segment with marker before the
+// start of the scan.
+func hasSegment(data []byte, marker byte) bool {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF && data[i+1] != 0xDA; {
+		if data[i+1] == marker {
+			return true
+		}
+		i += 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+	}
+	return false
+}
+
+func TestProcessStripsEXIF(t *testing.T) {
+	data := withSegment(encodeJPEG(t, image.NewRGBA(image.Rect(0, 0, 20, 10))), exifSegment(binary.BigEndian, 6))
+	if !hasSegment(data, 0xE1) {
+		t.Fatal("test image has no APP1 segment")
+	}
+
+	result, err := Process(data, "image/jpeg", Limits{MaxPixels: 1000000, MaxSide: 1000})
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if hasSegment(result.Original.Data, 0xE1) {
+		t.Error("processed image still has an APP1 segment")
+	}
+	if bytes.Contains(result.Original.Data, []byte("Exif\x00\x00")) {
+		t.Error("processed image still has EXIF data")
+	}
+	// Orientation 6 is applied before the tag is dropped.
+	if result.Original.Width != 10 || result.Original.Height != 20 {
+		t.Errorf("size = %dx%d, want 10x20", result.Original.Width, result.Original.Height)
+	}
+}
+
+func TestEXIFOrientation(t *testing.T) {
+	// The top left pixel of a 3x2 image is marked; want is where it ends up
+	// once the image is upright.
+	tests := []struct {
+		orientation   uint16
+		width, height int
+		want          image.Point
+	}{
+		{1, 3, 2, image.Pt(0, 0)},
+		{2, 3, 2, image.Pt(2, 0)},
+		{3, 3, 2, image.Pt(2, 1)},
+		{4, 3, 2, image.Pt(0, 1)},
+		{5, 2, 3, image.Pt(0, 0)},
+		{6, 2, 3, image.Pt(1, 0)},
+		{7, 2, 3, image.Pt(1, 2)},
+		{8, 2, 3, image.Pt(0, 2)},
+	}
+
+	jpg := encodeJPEG(t, image.NewRGBA(image.Rect(0, 0, 3, 2)))
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	marked := color.NRGBA{R: 255, A: 255}
+	src.Set(0, 0, marked)
+
+	for _, tt := range tests {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			data := withSegment(jpg, exifSegment(order, tt.orientation))
+			if got := exifOrientation(data); got != int(tt.orientation) {
+				t.Errorf("exifOrientation(%d, %v) = %d", tt.orientation, order, got)
+			}
+		}
+
+		img := orient(src, int(tt.orientation))
+		if img.Bounds().Dx() != tt.width || img.Bounds().Dy() != tt.height {
+			t.Errorf("orient(%d) size = %dx%d, want %dx%d", tt.orientation, img.Bounds().Dx(), img.Bounds().Dy(), tt.width, tt.height)
+			continue
+		}
+		if got := color.NRGBAModel.Convert(img.At(tt.want.X, tt.want.Y)); got != marked {
+			t.Errorf("orient(%d) pixel at %v = %v, want the marked one", tt.orientation, tt.want, got)
+		}
+	}
+
+	invalid := map[string][]byte{
+		"no exif":           jpg,
+		"orientation 0":     withSegment(jpg, exifSegment(binary.BigEndian, 0)),
+		"orientation 9":     withSegment(jpg, exifSegment(binary.BigEndian, 9)),
+		"truncated segment": withSegment(jpg, exifSegment(binary.BigEndian, 6)[:20]),
+		"not a jpeg":        []byte("GIF89a"),
+	}
+	for name, data := range invalid {
+		if got := exifOrientation(data); got != 1 {
+			t.Errorf("exifOrientation(%s) = %d, want 1", name, got)
+		}
+	}
+}
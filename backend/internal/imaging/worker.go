@@ -0,0 +1,303 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"forum/internal/storage"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	pollInterval = 5 * time.Second
+	// lockTimeout is how long a claimed job stays hidden from other workers.
+	// A worker that dies mid-job leaves it to be picked up again after that.
+	lockTimeout = 5 * time.Minute
+	maxAttempts = 5
+)
+
+// Attachment statuses. Images are "processing" until the worker has stripped
+// their metadata; only then can they be downloaded.
+const (
+	StatusReady      = "ready"
+	StatusProcessing = "processing"
+	StatusFailed     = "failed"
+)
+
+var wake = make(chan struct{}, 1)
+
+// Enqueue adds a processing job for an attachment within the transaction that
+// creates it. Call Wake after the commit to start on it right away.
+func Enqueue(tx sqlx.Execer, attachmentID int64) error {
+	_, err := tx.Exec("INSERT INTO image_jobs (attachment_id, run_at) VALUES ($1, $2)", attachmentID, time.Now())
+	return err
+}
+
+// Wake nudges an idle worker of this instance. Workers of other instances
+// find the job on their next poll.
+func Wake() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// RunWorkers processes queued images with n workers until stop is closed.
+// Jobs live in the image_jobs table, so any instance can take them and they
+// survive restarts.
+func RunWorkers(db *sqlx.DB, store storage.BlobStore, limits Limits, n int, stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &worker{db: db, store: store, limits: limits}
+			w.run(stop)
+		}()
+	}
+	wg.Wait()
+}
+
+type worker struct {
+	db     *sqlx.DB
+	store  storage.BlobStore
+	limits Limits
+}
+
+func (w *worker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Drain the queue before waiting again.
+		for {
+			found, err := w.runJob()
+			if err != nil {
+				log.Printf("Image worker: %v", err)
+			}
+			if !found || err != nil {
+				break
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// runJob claims and processes one due job. It reports whether there was one.
+func (w *worker) runJob() (bool, error) {
+	var attachmentID int64
+	var attempts int
+	err := w.db.QueryRow(
+		`UPDATE image_jobs SET attempts = attempts + 1, locked_until = $1
+		 WHERE attachment_id = (
+			SELECT attachment_id FROM image_jobs
+			WHERE run_at <= $2 AND (locked_until IS NULL OR locked_until < $2)
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING attachment_id, attempts`,
+		time.Now().Add(lockTimeout), time.Now(),
+	).Scan(&attachmentID, &attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error claiming image job: %v", err)
+	}
+
+	err = w.process(attachmentID)
+	if err == nil {
+		return true, nil
+	}
+
+	if errors.Is(err, ErrInvalidImage) || attempts >= maxAttempts {
+		log.Printf("Image processing of attachment %d failed: %v", attachmentID, err)
+		return true, w.fail(attachmentID)
+	}
+
+	// Back off exponentially: 30s, 1m, 2m, 4m.
+	delay := 30 * time.Second << (attempts - 1)
+	_, dbErr := w.db.Exec(
+		"UPDATE image_jobs SET run_at = $1, locked_until = NULL, last_error = $2 WHERE attachment_id = $3",
+		time.Now().Add(delay), err.Error(), attachmentID,
+	)
+	if dbErr != nil {
+		return true, fmt.Errorf("error rescheduling image job: %v", dbErr)
+	}
+	return true, fmt.Errorf("attachment %d, attempt %d: %v", attachmentID, attempts, err)
+}
+
+func (w *worker) process(attachmentID int64) error {
+	var key, contentType, filename string
+	err := w.db.QueryRow(
+		"SELECT storage_key, content_type, filename FROM attachments WHERE id = $1", attachmentID,
+	).Scan(&key, &contentType, &filename)
+	if err == sql.ErrNoRows {
+		// Deleted while queued; the job row went with it.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error loading attachment: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout/2)
+	defer cancel()
+
+	body, err := w.store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error reading blob: %v", err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading blob: %v", err)
+	}
+
+	result, err := Process(data, contentType, w.limits)
+	if err != nil {
+		return err
+	}
+
+	for i := range result.Thumbnails {
+		thumb := &result.Thumbnails[i]
+		if err := w.put(ctx, key+"-"+thumb.Name, thumb); err != nil {
+			return err
+		}
+	}
+	// The clean version goes next to the upload, which stays untouched until
+	// save switches the attachment over. A retry before that still finds the
+	// upload with the content type it was stored with.
+	if err := w.put(ctx, cleanKey(key), &result.Original); err != nil {
+		return err
+	}
+
+	if result.Original.ContentType != contentType {
+		filename = replaceExtension(filename, result.Original.ContentType)
+	}
+	return w.save(attachmentID, key, filename, result)
+}
+
+func cleanKey(key string) string {
+	return key + "-clean"
+}
+
+func (w *worker) put(ctx context.Context, key string, encoded *Encoded) error {
+	if err := w.store.Put(ctx, key, bytes.NewReader(encoded.Data), int64(len(encoded.Data)), encoded.ContentType); err != nil {
+		return fmt.Errorf("error storing image: %v", err)
+	}
+	return nil
+}
+
+func (w *worker) save(attachmentID int64, key, filename string, result *Result) error {
+	tx, err := w.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error saving processed image: %v", err)
+	}
+	defer tx.Rollback()
+
+	original := result.Original
+	res, err := tx.Exec(
+		`UPDATE attachments SET status = $1, storage_key = $2, filename = $3, content_type = $4, size = $5, sha256 = $6,
+			width = $7, height = $8
+		 WHERE id = $9`,
+		StatusReady, cleanKey(key), filename, original.ContentType, len(original.Data), hash(original.Data),
+		original.Width, original.Height, attachmentID,
+	)
+	if err != nil {
+		return fmt.Errorf("error saving processed image: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Deleted during processing, which queued the upload for deletion
+		// but not the clean version and the thumbnails.
+		keys := []string{cleanKey(key)}
+		for _, thumb := range result.Thumbnails {
+			keys = append(keys, key+"-"+thumb.Name)
+		}
+		for _, orphan := range keys {
+			_, err := tx.Exec(
+				"INSERT INTO blob_deletions (storage_key) VALUES ($1) ON CONFLICT DO NOTHING", orphan,
+			)
+			if err != nil {
+				return fmt.Errorf("error queueing thumbnail deletion: %v", err)
+			}
+		}
+		return tx.Commit()
+	}
+
+	// Nothing refers to the upload any more.
+	_, err = tx.Exec("INSERT INTO blob_deletions (storage_key) VALUES ($1) ON CONFLICT DO NOTHING", key)
+	if err != nil {
+		return fmt.Errorf("error queueing upload deletion: %v", err)
+	}
+
+	for _, thumb := range result.Thumbnails {
+		_, err := tx.Exec(
+			`INSERT INTO attachment_thumbnails (attachment_id, name, storage_key, content_type, width, height, size, sha256)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			 ON CONFLICT (attachment_id, name) DO UPDATE SET content_type = EXCLUDED.content_type,
+				width = EXCLUDED.width, height = EXCLUDED.height, size = EXCLUDED.size, sha256 = EXCLUDED.sha256`,
+			attachmentID, thumb.Name, key+"-"+thumb.Name, thumb.ContentType, thumb.Width, thumb.Height, len(thumb.Data), hash(thumb.Data),
+		)
+		if err != nil {
+			return fmt.Errorf("error saving thumbnail: %v", err)
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM image_jobs WHERE attachment_id = $1", attachmentID); err != nil {
+		return fmt.Errorf("error finishing image job: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (w *worker) fail(attachmentID int64) error {
+	tx, err := w.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error marking image as failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE attachments SET status = $1 WHERE id = $2", StatusFailed, attachmentID); err != nil {
+		return fmt.Errorf("error marking image as failed: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM image_jobs WHERE attachment_id = $1", attachmentID); err != nil {
+		return fmt.Errorf("error finishing image job: %v", err)
+	}
+	return tx.Commit()
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func replaceExtension(filename, contentType string) string {
+	ext := ".jpg"
+	if contentType == "image/png" {
+		ext = ".png"
+	}
+	return strings.TrimSuffix(filename, path.Ext(filename)) + ext
+}
@@ -0,0 +1,77 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	netmail "net/mail"
+	"time"
+
+	"forum/config"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing email. Handlers only depend on this interface so
+// that the SMTP transport can be swapped for a local outbox in development.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// NewMailer picks an implementation based on config.MailDriver:
+// "smtp", "db" (mail_outbox table) or "file" (default).
+func NewMailer(cfg *config.Config, db *sqlx.DB) Mailer {
+	switch cfg.MailDriver {
+	case "smtp":
+		return &SMTPMailer{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.MailFrom,
+		}
+	case "db":
+		return NewDBOutbox(db)
+	default:
+		return &FileOutbox{Dir: cfg.MailOutboxDir, From: cfg.MailFrom}
+	}
+}
+
+var ErrInvalidAddress = errors.New("invalid email address")
+
+// ParseAddress checks that s is a single bare address such as
+// "user@example.com". Display names and anything around the address are
+// rejected, so that the address can be written into a header as is.
+func ParseAddress(s string) (string, error) {
+	addr, err := netmail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != s {
+		return "", ErrInvalidAddress
+	}
+	return addr.Address, nil
+}
+
+// format renders msg as an RFC 5322 message with a UTF-8 plain text body.
+func format(from string, msg Message) ([]byte, error) {
+	to, err := ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("error formatting mail to %q: %v", msg.To, err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(msg.Body)
+	return buf.Bytes(), nil
+}
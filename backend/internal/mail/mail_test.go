@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	valid := []string{"user@example.com", "first.last+tag@sub.example.org"}
+	for _, s := range valid {
+		if _, err := ParseAddress(s); err != nil {
+			t.Errorf("ParseAddress(%q): %v", s, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"not an address",
+		"User <user@example.com>",
+		" user@example.com",
+		"user@example.com\r\nBcc: victim@example.com",
+		"user@example.com, other@example.com",
+	}
+	for _, s := range invalid {
+		if _, err := ParseAddress(s); err == nil {
+			t.Errorf("ParseAddress(%q) accepted", s)
+		}
+	}
+}
+
+func TestFileOutboxRejectsHeaderInjection(t *testing.T) {
+	dir := t.TempDir()
+	outbox := &FileOutbox{Dir: dir, From: "forum@example.com"}
+
+	err := outbox.Send(Message{To: "user@example.com\r\nBcc: victim@example.com", Subject: "Hi", Body: "Hello"})
+	if err == nil {
+		t.Fatal("Send accepted an address with a header line")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.eml")); len(files) != 0 {
+		t.Fatalf("wrote %d messages", len(files))
+	}
+
+	if err := outbox.Send(Message{To: "user@example.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("wrote %d messages, want 1", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "To: user@example.com\r\n") {
+		t.Fatalf("unexpected message:\n%s", data)
+	}
+}
@@ -0,0 +1,58 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// FileOutbox writes every message as an .eml file instead of sending it.
+type FileOutbox struct {
+	Dir  string
+	From string
+}
+
+func (o *FileOutbox) Send(msg Message) error {
+	data, err := format(o.From, msg)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(o.Dir, 0o755); err != nil {
+		return fmt.Errorf("error creating outbox directory: %v", err)
+	}
+
+	name := fmt.Sprintf("%d.eml", time.Now().UnixNano())
+	if err := os.WriteFile(filepath.Join(o.Dir, name), data, 0o644); err != nil {
+		return fmt.Errorf("error writing outbox message: %v", err)
+	}
+	return nil
+}
+
+// DBOutbox stores messages in the mail_outbox table, where a relay or a
+// developer can pick them up.
+type DBOutbox struct {
+	db *sqlx.DB
+}
+
+func NewDBOutbox(db *sqlx.DB) *DBOutbox {
+	return &DBOutbox{db: db}
+}
+
+func (o *DBOutbox) Send(msg Message) error {
+	if _, err := ParseAddress(msg.To); err != nil {
+		return fmt.Errorf("error saving outbox message to %q: %v", msg.To, err)
+	}
+
+	_, err := o.db.Exec(
+		"INSERT INTO mail_outbox (recipient, subject, body, created_at) VALUES ($1, $2, $3, $4)",
+		msg.To, msg.Subject, msg.Body, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("error saving outbox message: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package mail
+
+import (
+	"fmt"
+	"net/smtp"
+)
+
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	data, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+	if err := smtp.SendMail(addr, auth, m.From, []string{msg.To}, data); err != nil {
+		return fmt.Errorf("error sending mail to %s: %v", msg.To, err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package markdown
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"html"
+	"io"
+	"log"
+	"regexp"
+	"sync"
+
+	"forum/config"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/extension"
+)
+
+// Renderer turns CommonMark with GitHub extensions into sanitised HTML and
+// keeps the most recently rendered texts in memory.
+type Renderer struct {
+	markdown goldmark.Markdown
+	policy   *bluemonday.Policy
+
+	mu       sync.Mutex
+	capacity int
+	entries  map[[32]byte]*list.Element
+	order    *list.List // front is the most recently used
+}
+
+type cacheEntry struct {
+	key  [32]byte
+	html string
+}
+
+func NewRenderer(cacheSize int) *Renderer {
+	return &Renderer{
+		markdown: goldmark.New(
+			// Raw HTML in the source is dropped, since goldmark is not told
+			// to render it unsafely.
+			goldmark.WithExtensions(
+				extension.Linkify,
+				extension.Strikethrough,
+				extension.TaskList,
+				// Alignment as an attribute, so that the policy needn't allow style.
+				extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)),
+				highlighting.NewHighlighting(
+					highlighting.WithGuessLanguage(false),
+					highlighting.WithFormatOptions(chromahtml.WithClasses(true)),
+				),
+			),
+		),
+		policy:   newPolicy(),
+		capacity: cacheSize,
+		entries:  make(map[[32]byte]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// newPolicy allows only what the renderer produces. Highlighted code is
+// styled through classes, so no style attributes are needed.
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+
+	p.AllowElements(
+		"p", "br", "hr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote",
+		"ul", "li", "em", "strong", "del", "code", "pre", "span",
+		"table", "thead", "tbody", "tr",
+	)
+	p.AllowAttrs("start").Matching(regexp.MustCompile(`^\d+$`)).OnElements("ol")
+	p.AllowElements("ol")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-zA-Z0-9 _-]+$`)).OnElements("pre", "code", "span")
+	p.AllowAttrs("align").Matching(regexp.MustCompile(`^(left|center|right)$`)).OnElements("th", "td")
+	p.AllowElements("th", "td")
+
+	// Task list items.
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^(|checked|disabled)$`)).OnElements("input")
+
+	p.AllowStandardURLs()
+	p.AllowAttrs("href", "title").OnElements("a")
+	p.AllowAttrs("src", "alt", "title").OnElements("img")
+	p.RequireNoFollowOnLinks(true)
+	p.RequireNoReferrerOnLinks(true)
+
+	return p
+}
+
+// Render returns the HTML for a Markdown source.
+func (r *Renderer) Render(source string) string {
+	key := sha256.Sum256([]byte(source))
+
+	r.mu.Lock()
+	if element, ok := r.entries[key]; ok {
+		r.order.MoveToFront(element)
+		rendered := element.Value.(*cacheEntry).html
+		r.mu.Unlock()
+		return rendered
+	}
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := r.markdown.Convert([]byte(source), &buf); err != nil {
+		log.Printf("Error rendering markdown: %v", err)
+		return "<p>" + html.EscapeString(source) + "</p>\n"
+	}
+	rendered := string(r.policy.SanitizeBytes(buf.Bytes()))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[key]; !ok && r.capacity > 0 {
+		r.entries[key] = r.order.PushFront(&cacheEntry{key: key, html: rendered})
+		if r.order.Len() > r.capacity {
+			oldest := r.order.Back()
+			r.order.Remove(oldest)
+			delete(r.entries, oldest.Value.(*cacheEntry).key)
+		}
+	}
+	return rendered
+}
+
+var (
+	instance *Renderer
+	once     sync.Once
+)
+
+func defaultRenderer() *Renderer {
+	once.Do(func() {
+		instance = NewRenderer(config.LoadConfig().MarkdownCacheSize)
+	})
+	return instance
+}
+
+// Render renders source with the shared renderer.
+func Render(source string) string {
+	return defaultRenderer().Render(source)
+}
+
+// WriteCSS writes the stylesheet for the classes of highlighted code blocks.
+func WriteCSS(w io.Writer) error {
+	style := styles.Get(config.LoadConfig().MarkdownHighlightStyle)
+	return chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(w, style)
+}
@@ -0,0 +1,97 @@
+package markdown
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestRenderRemovesUnsafeMarkup(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		banned []string
+	}{
+		{"script", "<script>alert(1)</script>", []string{"<script", "alert"}},
+		{"javascript link", "[click](javascript:alert(1))", []string{"<a", "href"}},
+		{"javascript autolink", "<javascript:alert(1)>", []string{"<a", "href"}},
+		{"raw html", `<div class="x"><iframe src="https://evil.example"></iframe></div>`, []string{"<div", "<iframe"}},
+		{"event handler", `<img src="x.png" onerror="alert(1)">`, []string{"onerror", "<img"}},
+		{"inline event handler", `text <b onmouseover="alert(1)">bold</b>`, []string{"onmouseover", "<b"}},
+		{"style", `<span style="color: red">red</span>`, []string{"style"}},
+		{"style in code", "```go\nfunc main() {}\n```", []string{"style"}},
+	}
+
+	r := NewRenderer(0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered := r.Render(tt.source)
+			for _, banned := range tt.banned {
+				if strings.Contains(rendered, banned) {
+					t.Errorf("Render(%q) = %q, contains %q", tt.source, rendered, banned)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderKeepsExtensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{
+			"table",
+			"| a | b |\n|:-|-:|\n| 1 | 2 |",
+			[]string{"<table>", `<th align="left">a</th>`, `<td align="right">2</td>`},
+		},
+		{
+			"task list",
+			"- [x] done\n- [ ] todo",
+			[]string{`<input checked="" disabled="" type="checkbox"> done`, `<input disabled="" type="checkbox"> todo`},
+		},
+		{
+			"highlighted code",
+			"```go\nfunc main() {}\n```",
+			[]string{`<pre class="chroma">`, `<span class="kd">func</span>`},
+		},
+		{
+			"link",
+			"[forum](https://example.com)",
+			[]string{`href="https://example.com"`, `rel="nofollow noreferrer"`},
+		},
+	}
+
+	r := NewRenderer(0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered := r.Render(tt.source)
+			for _, want := range tt.want {
+				if !strings.Contains(rendered, want) {
+					t.Errorf("Render(%q) = %q, want it to contain %q", tt.source, rendered, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderEvictsLeastRecentlyUsed(t *testing.T) {
+	r := NewRenderer(2)
+	r.Render("a")
+	r.Render("b")
+	r.Render("a")
+	r.Render("c")
+
+	if r.order.Len() != 2 || len(r.entries) != 2 {
+		t.Fatalf("cache holds %d entries in the list and %d in the map, want 2", r.order.Len(), len(r.entries))
+	}
+	for source, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := r.entries[sha256.Sum256([]byte(source))]; ok != want {
+			t.Errorf("%q cached = %v, want %v", source, ok, want)
+		}
+	}
+	if r.order.Front().Value.(*cacheEntry).key != sha256.Sum256([]byte("c")) {
+		t.Errorf("most recent entry is not the one for %q", "c")
+	}
+}
@@ -2,21 +2,42 @@ package middleware
 
 import (
 	"context"
-	"fmt"
 	"forum/config"
+	"forum/internal/auth"
+	"forum/internal/database"
 	"log"
 	"net/http"
 	"strings"
-
-	"github.com/dgrijalva/jwt-go"
 )
 
 var cfg = config.LoadConfig()
 
-type Claims struct {
-	UserID int64  `json:"user_id"`
-	Role   string `json:"role"`
-	jwt.StandardClaims
+// parseToken validates a bearer credential. Personal access tokens are looked
+// up in the database; anything else must be a JWT access token.
+func parseToken(tokenString string) (*auth.Claims, error) {
+	if auth.IsPersonalAccessToken(tokenString) {
+		pat, err := auth.LookupPersonalAccessToken(database.DB, tokenString)
+		if err != nil {
+			return nil, err
+		}
+		return &auth.Claims{UserID: pat.UserID, Role: pat.Role, Scopes: pat.Scopes}, nil
+	}
+	return auth.ValidateToken(tokenString)
+}
+
+// allows reports whether the credential may perform an action needing scope.
+// Session tokens carry no scopes and are not restricted.
+func allows(claims *auth.Claims, scope string) bool {
+	return claims.Scopes == nil || auth.ScopesAllow(claims.Scopes, scope)
+}
+
+func withClaims(r *http.Request, claims *auth.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
+	ctx = context.WithValue(ctx, "user_role", claims.Role)
+	ctx = context.WithValue(ctx, "session_id", claims.SessionID)
+	ctx = context.WithValue(ctx, "mfa", claims.MFA)
+	ctx = context.WithValue(ctx, "scopes", claims.Scopes)
+	return r.WithContext(ctx)
 }
 
 func AuthMiddleware(next http.Handler) http.Handler {
@@ -35,46 +56,46 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		tokenString := parts[1]
-		log.Printf("Received token: %s", tokenString)
-		log.Printf("Using JWT secret: %s", cfg.JWTSecret)
-
-		claims := &struct {
-			UserID int64  `json:"user_id"`
-			Role   string `json:"role"`
-			jwt.StandardClaims
-		}{}
-
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				log.Printf("Auth error: Unexpected signing method: %v", token.Header["alg"])
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(cfg.JWTSecret), nil
-		})
-
+		claims, err := parseToken(parts[1])
 		if err != nil {
 			log.Printf("Auth error: Token validation failed: %v", err)
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		if !token.Valid {
-			log.Println("Auth error: Token is invalid")
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		scope := auth.ScopeWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			scope = auth.ScopeRead
+		}
+		if !allows(claims, scope) {
+			http.Error(w, "Token does not have the required scope", http.StatusForbidden)
+			return
+		}
+
+		if !checkSanctions(w, r, claims) {
 			return
 		}
 
 		log.Printf("Auth success: User ID %d, Role %s", claims.UserID, claims.Role)
 
-		// Add user info to context
-		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
-		ctx = context.WithValue(ctx, "user_role", claims.Role)
+		next.ServeHTTP(w, withClaims(r, claims))
+	})
+}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
+// OptionalAuth authenticates the request when it carries a token and lets
+// guests through otherwise. Public pages use it to show what the role may see.
+func OptionalAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		AuthMiddleware(next).ServeHTTP(w, r)
 	})
 }
 
+// AdminMiddleware guards the admin panel: the role needs admin.access, and the
+// individual routes check their own permissions on top of that.
 func AdminMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -84,22 +105,38 @@ func AdminMiddleware(next http.Handler) http.Handler {
 		}
 
 		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
-		claims := &Claims{}
-
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.JWTSecret), nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := parseToken(tokenString)
+		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		if claims.Role != "admin" {
+		if !checkSanctions(w, r, claims) {
+			return
+		}
+
+		granted, err := auth.HasPermission(database.DB, claims.Role, auth.PermAdminAccess)
+		if err != nil {
+			log.Printf("Failed to check admin access for role %s: %v", claims.Role, err)
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return
+		}
+		if !granted {
 			http.Error(w, "Admin access required", http.StatusForbidden)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		if !allows(claims, auth.ScopeAdmin) {
+			http.Error(w, "Token does not have the required scope", http.StatusForbidden)
+			return
+		}
+
+		// Admin-scoped personal access tokens can only be created from an MFA session.
+		if cfg.RequireAdmin2FA && claims.Scopes == nil && !claims.MFA {
+			http.Error(w, "Two-factor authentication required for admin access", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, withClaims(r, claims))
 	})
 }
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"forum/internal/auth"
+	"forum/internal/database"
+	"log"
+	"net/http"
+)
+
+// RequireVerifiedEmail blocks accounts with an unconfirmed email when
+// config.RequireEmailVerification is on. It must run after AuthMiddleware.
+func RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.RequireEmailVerification {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userID := r.Context().Value("user_id").(int64)
+		verified, err := auth.IsEmailVerified(database.DB, userID)
+		if err != nil {
+			log.Printf("Failed to check email verification for user %d: %v", userID, err)
+			http.Error(w, "Failed to check email verification", http.StatusInternalServerError)
+			return
+		}
+
+		if !verified {
+			http.Error(w, "Email address is not verified", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
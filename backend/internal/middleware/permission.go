@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"forum/internal/auth"
+	"forum/internal/database"
+	"log"
+	"net/http"
+)
+
+// RequirePermission only lets through users whose role grants permission.
+// It must run after AuthMiddleware or AdminMiddleware.
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value("user_role").(string)
+
+			granted, err := auth.HasPermission(database.DB, role, permission)
+			if err != nil {
+				log.Printf("Failed to check permission %s for role %s: %v", permission, role, err)
+				http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+				return
+			}
+
+			if !granted {
+				http.Error(w, "Permission denied", http.StatusForbidden)
+				return
+			}
+			if !auth.SecondFactorSatisfied(r) {
+				http.Error(w, "Two-factor authentication required", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
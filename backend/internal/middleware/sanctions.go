@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"forum/internal/auth"
+	"forum/internal/database"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// accountPath reports whether the request manages the caller's own account,
+// which suspended users may still do.
+func accountPath(path string) bool {
+	return path == "/api/logout" ||
+		path == "/api/change-password" ||
+		strings.HasPrefix(path, "/api/email/") ||
+		strings.HasPrefix(path, "/api/profile")
+}
+
+// checkSanctions answers with 403 and returns false for banned users, and for
+// suspended users on anything but reads and their own account settings.
+// Mutes only apply to chat and are enforced there.
+func checkSanctions(w http.ResponseWriter, r *http.Request, claims *auth.Claims) bool {
+	sanction, err := auth.ActiveSanction(database.DB, claims.UserID, auth.SanctionBan, auth.SanctionSuspension)
+	if err != nil {
+		log.Printf("Failed to check sanctions of user %d: %v", claims.UserID, err)
+		http.Error(w, "Failed to check account status", http.StatusInternalServerError)
+		return false
+	}
+	if sanction == nil {
+		return true
+	}
+
+	readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead || accountPath(r.URL.Path)
+	if sanction.Type == auth.SanctionSuspension && readOnly {
+		return true
+	}
+
+	http.Error(w, sanction.Message(), http.StatusForbidden)
+	return false
+}
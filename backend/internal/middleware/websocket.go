@@ -1,13 +1,9 @@
 package middleware
 
 import (
-	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"strings"
-
-	"github.com/dgrijalva/jwt-go"
 )
 
 func WebSocketAuthMiddleware(next http.Handler) http.Handler {
@@ -62,37 +58,19 @@ func WebSocketAuthMiddleware(next http.Handler) http.Handler {
 			token = parts[1]
 		}
 
-		claims := &struct {
-			UserID int64  `json:"user_id"`
-			Role   string `json:"role"`
-			jwt.StandardClaims
-		}{}
-
-		parsedToken, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				log.Printf("WebSocket auth error: Unexpected signing method: %v", token.Header["alg"])
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(cfg.JWTSecret), nil
-		})
-
+		claims, err := parseToken(token)
 		if err != nil {
 			log.Printf("WebSocket auth error: Token validation failed: %v", err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		if !parsedToken.Valid {
-			log.Println("WebSocket auth error: Token is invalid")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if !checkSanctions(w, r, claims) {
 			return
 		}
 
 		log.Printf("WebSocket auth success: User ID %d, Role %s", claims.UserID, claims.Role)
 
-		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
-		ctx = context.WithValue(ctx, "user_role", claims.Role)
-
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, withClaims(r, claims))
 	})
 }
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+type AccessToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+type AccessTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// CreatedAccessToken is returned once on creation; the plaintext token is
+// never stored and can't be shown again.
+type CreatedAccessToken struct {
+	AccessToken
+	Token string `json:"token"`
+}
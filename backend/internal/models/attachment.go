@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// Attachment is a file uploaded to a post or a comment. URL and Thumbnails
+// hold download endpoints relative to the API host; images get thumbnails
+// by size name ("small", "medium", "large") once Status is "ready".
+type Attachment struct {
+	ID          int64             `json:"id"`
+	PostID      *int64            `json:"post_id,omitempty"`
+	CommentID   *int64            `json:"comment_id,omitempty"`
+	UploaderID  *int64            `json:"uploader_id"`
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	Size        int64             `json:"size"`
+	Status      string            `json:"status"`
+	Width       *int              `json:"width,omitempty"`
+	Height      *int              `json:"height,omitempty"`
+	URL         string            `json:"url"`
+	Thumbnails  map[string]string `json:"thumbnails"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
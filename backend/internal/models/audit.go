@@ -0,0 +1,53 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AuditEntry struct {
+	ID            int64           `json:"id"`
+	ActorID       *int64          `json:"actor_id"`
+	ActorUsername *string         `json:"actor_username"`
+	Action        string          `json:"action"`
+	TargetType    string          `json:"target_type"`
+	TargetID      string          `json:"target_id"`
+	Before        json.RawMessage `json:"before,omitempty"`
+	After         json.RawMessage `json:"after,omitempty"`
+	IP            string          `json:"ip"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// CSVRecord returns the entry as a CSV row; snapshots stay JSON.
+func (e *AuditEntry) CSVRecord() []string {
+	var actorID, actorUsername string
+	if e.ActorID != nil {
+		actorID = strconv.FormatInt(*e.ActorID, 10)
+	}
+	if e.ActorUsername != nil {
+		actorUsername = *e.ActorUsername
+	}
+
+	record := []string{
+		strconv.FormatInt(e.ID, 10),
+		e.CreatedAt.UTC().Format(time.RFC3339),
+		actorID,
+		actorUsername,
+		e.Action,
+		e.TargetType,
+		e.TargetID,
+		e.IP,
+		string(e.Before),
+		string(e.After),
+	}
+
+	// Keep spreadsheets from evaluating user-controlled values as formulas.
+	for i, field := range record {
+		if field != "" && strings.ContainsRune("=+-@", rune(field[0])) {
+			record[i] = "'" + field
+		}
+	}
+	return record
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+)
+
+// Category is a section of the forum. The role lists restrict who may read,
+// post and comment in it; empty lists restrict nobody.
+type Category struct {
+	ID           int64     `json:"id"`
+	ParentID     *int64    `json:"parent_id"`
+	Slug         string    `json:"slug"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	Position     int       `json:"position"`
+	ReadRoles    []string  `json:"read_roles"`
+	PostRoles    []string  `json:"post_roles"`
+	CommentRoles []string  `json:"comment_roles"`
+	CreatedAt    time.Time `json:"created_at"`
+	// Whether the current user may post and comment here.
+	CanPost    bool `json:"can_post"`
+	CanComment bool `json:"can_comment"`
+}
+
+type CategoryRequest struct {
+	ParentID     *int64   `json:"parent_id"`
+	Slug         string   `json:"slug"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Position     int      `json:"position"`
+	ReadRoles    []string `json:"read_roles"`
+	PostRoles    []string `json:"post_roles"`
+	CommentRoles []string `json:"comment_roles"`
+}
@@ -4,6 +4,7 @@ import "time"
 
 type ChatMessage struct {
 	ID        int       `json:"id"`
+	RoomID    int64     `json:"room_id"`
 	Content   string    `json:"content"`
 	UserID    int       `json:"user_id"`
 	Username  string    `json:"username"`
@@ -29,3 +30,59 @@ type ChatMessageResponse struct {
 	User      UserResponse `json:"user"`
 	CreatedAt time.Time    `json:"created_at"`
 }
+
+// ChatRoom is a chat channel with its own history. Private rooms are open to
+// their members only.
+type ChatRoom struct {
+	ID          int64     `json:"id"`
+	Slug        string    `json:"slug"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Private     bool      `json:"private"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type ChatRoomRequest struct {
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Private     bool   `json:"private"`
+}
+
+type ChatRoomMember struct {
+	UserID    int64     `json:"user_id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ChatRoomMemberRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+// Types of chat commands and events. A message is both: the command sends
+// it, the event delivers it to the room.
+const (
+	ChatJoin    = "join"
+	ChatLeave   = "leave"
+	ChatSend    = "message"
+	ChatHistory = "history"
+	ChatLeft    = "left"
+	ChatError   = "error"
+)
+
+// ChatCommand is sent by chat clients. A join answers with the history of
+// the room; messages can only be sent to joined rooms.
+type ChatCommand struct {
+	Type string `json:"type"`
+	Room string `json:"room"` // slug
+	ChatMessageRequest
+}
+
+// ChatEvent is sent to chat clients.
+type ChatEvent struct {
+	Type     string        `json:"type"`
+	Room     string        `json:"room,omitempty"`
+	Messages []ChatMessage `json:"messages,omitempty"`
+	Message  *ChatMessage  `json:"message,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
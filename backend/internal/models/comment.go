@@ -8,16 +8,31 @@ type Comment struct {
 	ID        int64     `json:"id"`
 	Content   string    `json:"content"`
 	PostID    int64     `json:"post_id"`
+	ParentID  *int64    `json:"parent_id"`
 	AuthorID  int64     `json:"author_id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// CommentResponse is a comment as clients see it. Path holds the IDs from the
+// top-level comment down to this one. Deleted comments that still have
+// replies keep their place in the thread with the content and author removed.
 type CommentResponse struct {
-	ID        int64        `json:"id"`
-	Content   string       `json:"content"`
-	PostID    int64        `json:"post_id"`
-	Author    UserResponse `json:"author"`
-	CreatedAt time.Time    `json:"created_at"`
-	UpdatedAt time.Time    `json:"updated_at"`
+	ID          int64             `json:"id"`
+	Content     string            `json:"content"`
+	ContentHTML string            `json:"content_html"`
+	PostID      int64             `json:"post_id"`
+	ParentID    *int64            `json:"parent_id"`
+	Depth       int               `json:"depth"`
+	Path        []int64           `json:"path"`
+	Deleted     bool              `json:"deleted"`
+	Author      UserResponse      `json:"author"`
+	Attachments []Attachment      `json:"attachments"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Replies     []CommentResponse `json:"replies,omitempty"`
+	// MoreReplies is set on a top-level comment when a page of threads
+	// leaves out some of its replies.
+	MoreReplies int `json:"more_replies,omitempty"`
+	Votes
 }
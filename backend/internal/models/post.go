@@ -5,21 +5,28 @@ import (
 )
 
 type Post struct {
-	ID        int64     `json:"id"`
-	Title     string    `json:"title"`
-	Content   string    `json:"content"`
-	AuthorID  int64     `json:"author_id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         int64     `json:"id"`
+	Title      string    `json:"title"`
+	Content    string    `json:"content"`
+	AuthorID   int64     `json:"author_id"`
+	CategoryID int64     `json:"category_id"`
+	Tags       []string  `json:"tags"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 type PostResponse struct {
 	ID            int64        `json:"id"`
 	Title         string       `json:"title"`
 	Content       string       `json:"content"`
+	ContentHTML   string       `json:"content_html"`
 	AuthorID      int64        `json:"author_id"`
 	Author        UserResponse `json:"author"`
+	CategoryID    int64        `json:"category_id"`
+	Tags          []string     `json:"tags"`
+	Attachments   []Attachment `json:"attachments"`
 	CreatedAt     time.Time    `json:"created_at"`
 	UpdatedAt     time.Time    `json:"updated_at"`
 	CommentsCount int          `json:"comments_count"`
+	Votes
 }
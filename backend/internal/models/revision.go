@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// Revision is a saved version of a post or comment. Comments have no title.
+type Revision struct {
+	Revision       int       `json:"revision"`
+	Title          *string   `json:"title,omitempty"`
+	Content        string    `json:"content"`
+	EditorID       *int64    `json:"editor_id"`
+	EditorUsername *string   `json:"editor_username"`
+	Reason         string    `json:"reason"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// RevisionDiff compares two revisions. Title and Content hold a unified diff
+// string or a list of word segments, depending on the requested mode.
+type RevisionDiff struct {
+	From    int         `json:"from"`
+	To      int         `json:"to"`
+	Mode    string      `json:"mode"`
+	Title   interface{} `json:"title,omitempty"`
+	Content interface{} `json:"content"`
+}
+
+type RollbackRequest struct {
+	Reason string `json:"reason"`
+}
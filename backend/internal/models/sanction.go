@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+type Sanction struct {
+	ID           int64      `json:"id"`
+	UserID       int64      `json:"user_id"`
+	Username     string     `json:"username"`
+	Type         string     `json:"type"`
+	Reason       string     `json:"reason"`
+	IssuedBy     *int64     `json:"issued_by"`
+	IssuedByName *string    `json:"issued_by_username"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy    *int64     `json:"revoked_by,omitempty"`
+}
+
+// SanctionRequest creates a sanction. Without expires_at a ban is permanent;
+// suspensions and mutes always need an expiry.
+type SanctionRequest struct {
+	UserID    int64      `json:"user_id"`
+	Type      string     `json:"type"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
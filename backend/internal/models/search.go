@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// SearchResult is a post or comment matching a search query. Snippet is HTML
+// escaped, with the matched words wrapped in <mark>.
+type SearchResult struct {
+	Type           string    `json:"type"`
+	ID             int64     `json:"id"`
+	PostID         int64     `json:"post_id"`
+	PostTitle      string    `json:"post_title"`
+	Snippet        string    `json:"snippet"`
+	Rank           float32   `json:"rank"`
+	AuthorID       int64     `json:"author_id"`
+	AuthorUsername string    `json:"author_username"`
+	CreatedAt      time.Time `json:"created_at"`
+}
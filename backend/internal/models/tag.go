@@ -0,0 +1,16 @@
+package models
+
+type Tag struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	PostsCount int    `json:"posts_count"`
+}
+
+type TagRequest struct {
+	Name string `json:"name"`
+}
+
+// TagMergeRequest moves every post of a tag to the target tag.
+type TagMergeRequest struct {
+	TargetID int64 `json:"target_id"`
+}
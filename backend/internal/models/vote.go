@@ -0,0 +1,20 @@
+package models
+
+// Votes are the vote and reaction totals of a post or comment together with
+// what the current user gave it. MyVote is 0 when they haven't voted.
+type Votes struct {
+	Score      int            `json:"score"`
+	Upvotes    int            `json:"upvotes"`
+	Downvotes  int            `json:"downvotes"`
+	Reactions  map[string]int `json:"reactions"`
+	MyVote     int            `json:"my_vote"`
+	MyReaction *string        `json:"my_reaction"`
+}
+
+type VoteRequest struct {
+	Value int `json:"value"`
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji"`
+}
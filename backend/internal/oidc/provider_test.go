@@ -0,0 +1,147 @@
+package oidc_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/oidc"
+	"forum/internal/oidc/oidctest"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func newTestIdP(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	t.Helper()
+	idp, err := oidctest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+
+	provider := oidc.NewProvider(idp.URL, "forum", "secret", "http://forum.test/api/oidc/callback", []string{"openid", "email"}, "groups")
+	return idp, provider
+}
+
+// login runs the code flow against the IdP and returns the identity.
+func login(t *testing.T, idp *oidctest.Server, provider *oidc.Provider, nonce string) (*oidc.Identity, error) {
+	t.Helper()
+	authURL, err := provider.AuthCodeURL("state", "nonce", "verifier")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, state, err := idp.Code(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	if state != "state" {
+		t.Fatalf("state = %q, want %q", state, "state")
+	}
+	return provider.Exchange(code, "verifier", nonce)
+}
+
+func TestExchange(t *testing.T) {
+	idp, provider := newTestIdP(t)
+	idp.Claims = oidctest.Static(jwt.MapClaims{
+		"sub":            "alice-id",
+		"email":          "alice@example.com",
+		"email_verified": "true",
+		"groups":         []string{"forum-admins", "staff"},
+		"amr":            []string{"pwd", "otp"},
+	})
+
+	identity, err := login(t, idp, provider, "nonce")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Subject != "alice-id" || identity.Email != "alice@example.com" || !identity.EmailVerified {
+		t.Errorf("identity = %+v", identity)
+	}
+	if strings.Join(identity.Groups, ",") != "forum-admins,staff" {
+		t.Errorf("Groups = %v", identity.Groups)
+	}
+	if strings.Join(identity.AMR, ",") != "pwd,otp" {
+		t.Errorf("AMR = %v", identity.AMR)
+	}
+}
+
+func TestExchangeRejectsInvalidIDTokens(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		nonce  string
+		want   string
+	}{
+		{"wrong nonce", nil, "other", "nonce"},
+		{"wrong audience", jwt.MapClaims{"aud": "someone-else"}, "nonce", "not issued for this client"},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example"}, "nonce", "issuer"},
+		{"no subject", jwt.MapClaims{"sub": nil}, "nonce", "no subject"},
+		{"no exp", jwt.MapClaims{"exp": nil}, "nonce", "no expiry"},
+		{"expired", jwt.MapClaims{"exp": now.Add(-2 * time.Minute).Unix()}, "nonce", "expired"},
+		{"no iat", jwt.MapClaims{"iat": nil}, "nonce", "no issue time"},
+		{"iat in the future", jwt.MapClaims{"iat": now.Add(5 * time.Minute).Unix()}, "nonce", "in the future"},
+		{"nbf in the future", jwt.MapClaims{"nbf": now.Add(5 * time.Minute).Unix()}, "nonce", "not valid yet"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp, provider := newTestIdP(t)
+			claims := jwt.MapClaims{"sub": "alice-id"}
+			for name, value := range tt.claims {
+				claims[name] = value
+			}
+			idp.Claims = oidctest.Static(claims)
+
+			_, err := login(t, idp, provider, tt.nonce)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Exchange error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeAllowsClockSkew(t *testing.T) {
+	idp, provider := newTestIdP(t)
+	idp.Claims = oidctest.Static(jwt.MapClaims{
+		"sub": "alice-id",
+		"iat": time.Now().Add(30 * time.Second).Unix(),
+		"exp": time.Now().Add(-30 * time.Second).Unix(),
+	})
+
+	if _, err := login(t, idp, provider, "nonce"); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+}
+
+func TestExchangeRejectsWrongCode(t *testing.T) {
+	tests := []struct {
+		name        string
+		verifier    string
+		redirectURL string
+	}{
+		{"wrong verifier", "other-verifier", "http://forum.test/api/oidc/callback"},
+		{"wrong redirect URI", "verifier", "http://evil.test/callback"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp, provider := newTestIdP(t)
+			idp.Claims = oidctest.Static(jwt.MapClaims{"sub": "alice-id"})
+
+			authURL, err := provider.AuthCodeURL("state", "nonce", "verifier")
+			if err != nil {
+				t.Fatalf("AuthCodeURL: %v", err)
+			}
+			code, _, err := idp.Code(authURL)
+			if err != nil {
+				t.Fatalf("authorize: %v", err)
+			}
+
+			other := oidc.NewProvider(idp.URL, "forum", "secret", tt.redirectURL, []string{"openid", "email"}, "groups")
+			if _, err := other.Exchange(code, tt.verifier, "nonce"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+				t.Fatalf("Exchange error = %v, want invalid_grant", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor points at the last item of a page. Lists are ordered newest first
+// by (created_at, id), so the id breaks ties between equal timestamps.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int64
+}
+
+// Encode returns the cursor in the opaque form handed to clients.
+func (c Cursor) Encode() string {
+	raw := fmt.Sprintf("%d.%d", c.CreatedAt.UnixMicro(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func Decode(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	micros, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	// Timestamps are stored without a time zone and read back as UTC.
+	return &Cursor{CreatedAt: time.UnixMicro(micros).UTC(), ID: id}, nil
+}
+
+// Params are the ?limit= and ?cursor= query parameters of a list request.
+type Params struct {
+	Limit int
+	After *Cursor
+}
+
+// FromRequest reads the pagination parameters; the error is meant for the client.
+func FromRequest(r *http.Request) (Params, error) {
+	params := Params{Limit: DefaultLimit}
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			return params, fmt.Errorf("limit must be between 1 and %d", MaxLimit)
+		}
+		params.Limit = limit
+	}
+
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := Decode(value)
+		if err != nil {
+			return params, err
+		}
+		params.After = cursor
+	}
+
+	return params, nil
+}
+
+// Where returns the keyset condition for the given columns, or "" on the
+// first page, and appends its arguments to args.
+func (p Params) Where(createdAtColumn, idColumn string, args *[]interface{}) string {
+	if p.After == nil {
+		return ""
+	}
+	*args = append(*args, p.After.CreatedAt, p.After.ID)
+	return fmt.Sprintf("(%s, %s) < ($%d, $%d)", createdAtColumn, idColumn, len(*args)-1, len(*args))
+}
+
+// OrderBy returns the ORDER BY and LIMIT clause. One extra row is fetched to
+// find out whether there is a next page.
+func (p Params) OrderBy(createdAtColumn, idColumn string) string {
+	return fmt.Sprintf(" ORDER BY %s DESC, %s DESC LIMIT %d", createdAtColumn, idColumn, p.Limit+1)
+}
+
+// Offset paginates results without a stable keyset, such as search results
+// ordered by relevance. Its cursor is as opaque to clients as a Cursor.
+type Offset struct {
+	Limit  int
+	Offset int
+}
+
+// OffsetFromRequest reads ?limit= and ?cursor= for offset pagination.
+func OffsetFromRequest(r *http.Request) (Offset, error) {
+	params := Offset{Limit: DefaultLimit}
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			return params, fmt.Errorf("limit must be between 1 and %d", MaxLimit)
+		}
+		params.Limit = limit
+	}
+
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		offset, err := DecodeOffset(value)
+		if err != nil {
+			return params, err
+		}
+		params.Offset = offset
+	}
+
+	return params, nil
+}
+
+// EncodeOffset returns the cursor of an offset.
+func EncodeOffset(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("o.%d", offset)))
+}
+
+func DecodeOffset(s string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !strings.HasPrefix(string(raw), "o.") {
+		return 0, ErrInvalidCursor
+	}
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(raw), "o."))
+	if err != nil || offset < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return offset, nil
+}
+
+// Clause returns the LIMIT and OFFSET clause, again with one extra row.
+func (o Offset) Clause() string {
+	return fmt.Sprintf(" LIMIT %d OFFSET %d", o.Limit+1, o.Offset)
+}
+
+// Page is the response envelope of every list endpoint. NextCursor is null on
+// the last page. PrevCursor is only set by lists that can be entered in the
+// middle, such as comments around a linked one.
+type Page[T any] struct {
+	Items      []T     `json:"items"`
+	NextCursor *string `json:"next_cursor"`
+	PrevCursor *string `json:"prev_cursor,omitempty"`
+}
+
+// NewPage trims the extra row fetched by OrderBy and sets the next cursor.
+func NewPage[T any](items []T, p Params, cursorOf func(T) Cursor) Page[T] {
+	page := Page[T]{Items: items}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	if len(page.Items) > p.Limit {
+		page.Items = page.Items[:p.Limit]
+		next := cursorOf(page.Items[p.Limit-1]).Encode()
+		page.NextCursor = &next
+	}
+	return page
+}
+
+// NewOffsetPage is NewPage for offset pagination.
+func NewOffsetPage[T any](items []T, o Offset) Page[T] {
+	page := Page[T]{Items: items}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	if len(page.Items) > o.Limit {
+		page.Items = page.Items[:o.Limit]
+		next := EncodeOffset(o.Offset + o.Limit)
+		page.NextCursor = &next
+	}
+	return page
+}
@@ -0,0 +1,110 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursors := []Cursor{
+		{CreatedAt: time.Date(2024, 3, 1, 12, 30, 45, 123456000, time.UTC), ID: 42},
+		{CreatedAt: time.Unix(0, 0).UTC(), ID: 0},
+		{CreatedAt: time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), ID: 1<<63 - 1},
+	}
+	for _, want := range cursors {
+		got, err := Decode(want.Encode())
+		if err != nil {
+			t.Fatalf("Decode(%v): %v", want, err)
+		}
+		if !got.CreatedAt.Equal(want.CreatedAt) || got.ID != want.ID {
+			t.Errorf("Decode(Encode(%v)) = %v", want, *got)
+		}
+	}
+
+	// Precision beyond microseconds, which Postgres doesn't store, is dropped.
+	got, err := Decode(Cursor{CreatedAt: time.Unix(1, 999), ID: 1}.Encode())
+	if err != nil || !got.CreatedAt.Equal(time.Unix(1, 0)) {
+		t.Errorf("Decode = %v, %v", got, err)
+	}
+}
+
+func TestDecodeRejectsMalformedCursors(t *testing.T) {
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+	cursors := []string{
+		"",
+		"not base64!",
+		encode("1700000000000000"),
+		encode("abc.42"),
+		encode("1700000000000000.abc"),
+		encode("1700000000000000.42.7"),
+		encode("o.20"),
+		base64.StdEncoding.EncodeToString([]byte("1700000000000000.42")),
+	}
+	for _, cursor := range cursors {
+		if _, err := Decode(cursor); err != ErrInvalidCursor {
+			t.Errorf("Decode(%q) error = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+
+	offsets := []string{"", "!!", encode("20"), encode("o.-1"), encode("o.x")}
+	for _, cursor := range offsets {
+		if _, err := DecodeOffset(cursor); err != ErrInvalidCursor {
+			t.Errorf("DecodeOffset(%q) error = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
+
+func TestWhereNumbersPlaceholdersAfterArgs(t *testing.T) {
+	after := &Cursor{CreatedAt: time.Unix(100, 0).UTC(), ID: 7}
+	params := Params{Limit: 10, After: after}
+
+	args := []interface{}{"general", true}
+	where := params.Where("p.created_at", "p.id", &args)
+	if want := "(p.created_at, p.id) < ($3, $4)"; where != want {
+		t.Errorf("Where = %q, want %q", where, want)
+	}
+	if len(args) != 4 || args[2] != after.CreatedAt || args[3] != after.ID {
+		t.Errorf("args = %v", args)
+	}
+
+	args = nil
+	if where := (Params{Limit: 10}).Where("p.created_at", "p.id", &args); where != "" || len(args) != 0 {
+		t.Errorf("first page Where = %q with args %v, want no condition", where, args)
+	}
+
+	if orderBy := params.OrderBy("p.created_at", "p.id"); orderBy != " ORDER BY p.created_at DESC, p.id DESC LIMIT 11" {
+		t.Errorf("OrderBy = %q", orderBy)
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := func(n int) []Cursor {
+		var items []Cursor
+		for i := 0; i < n; i++ {
+			items = append(items, Cursor{CreatedAt: base.Add(-time.Duration(i) * time.Minute), ID: int64(100 - i)})
+		}
+		return items
+	}
+	cursorOf := func(c Cursor) Cursor { return c }
+	params := Params{Limit: 3}
+
+	page := NewPage(rows(3), params, cursorOf)
+	if len(page.Items) != 3 || page.NextCursor != nil {
+		t.Errorf("with exactly limit rows: %d items, next cursor %v; want 3 and none", len(page.Items), page.NextCursor)
+	}
+
+	page = NewPage(rows(4), params, cursorOf)
+	if len(page.Items) != 3 || page.NextCursor == nil {
+		t.Fatalf("with limit+1 rows: %d items, next cursor %v; want 3 and one", len(page.Items), page.NextCursor)
+	}
+	next, err := Decode(*page.NextCursor)
+	if err != nil || *next != page.Items[2] {
+		t.Errorf("next cursor = %v, %v; want the last item %v", next, err, page.Items[2])
+	}
+
+	if page := NewPage(nil, params, cursorOf); page.Items == nil || len(page.Items) != 0 || page.NextCursor != nil {
+		t.Errorf("empty page = %+v, want no items and no cursor", page)
+	}
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepSize is how many keys the memory limiter holds before it drops stale ones.
+const sweepSize = 10000
+
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type MemoryLimiter struct {
+	policy  Policy
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+func NewMemoryLimiter(policy Policy) *MemoryLimiter {
+	return &MemoryLimiter{
+		policy:  policy,
+		entries: make(map[string]*entry),
+	}
+}
+
+func (l *MemoryLimiter) Check(key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return 0, nil
+	}
+	if wait := time.Until(e.lockedUntil); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+func (l *MemoryLimiter) Fail(key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.entries) >= sweepSize {
+		l.sweep(now)
+	}
+
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.lastFailure) > l.policy.Window {
+		e = &entry{}
+		l.entries[key] = e
+	}
+
+	e.failures++
+	e.lastFailure = now
+	wait := l.policy.lockout(e.failures)
+	e.lockedUntil = now.Add(wait)
+	return wait, nil
+}
+
+func (l *MemoryLimiter) Reset(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+	return nil
+}
+
+// sweep drops keys whose failures have aged out. Callers must hold l.mu.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	for key, e := range l.entries {
+		if now.Sub(e.lastFailure) > l.policy.Window && !now.Before(e.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
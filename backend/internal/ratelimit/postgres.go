@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PostgresLimiter keeps counters in the login_attempts table so that every
+// server instance sees the same lockouts.
+type PostgresLimiter struct {
+	db     *sqlx.DB
+	policy Policy
+}
+
+func NewPostgresLimiter(db *sqlx.DB, policy Policy) *PostgresLimiter {
+	return &PostgresLimiter{db: db, policy: policy}
+}
+
+func (l *PostgresLimiter) Check(key string) (time.Duration, error) {
+	var lockedUntil sql.NullTime
+	err := l.db.QueryRow("SELECT locked_until FROM login_attempts WHERE key = $1", key).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if wait := time.Until(lockedUntil.Time); lockedUntil.Valid && wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+func (l *PostgresLimiter) Fail(key string) (time.Duration, error) {
+	now := time.Now()
+
+	// The counter restarts when the previous failure is older than the window.
+	var failures int
+	err := l.db.QueryRow(
+		`INSERT INTO login_attempts (key, failures, last_failure_at)
+		 VALUES ($1, 1, $2)
+		 ON CONFLICT (key) DO UPDATE SET
+		   failures = CASE WHEN login_attempts.last_failure_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+		   last_failure_at = $2
+		 RETURNING failures`,
+		key, now, now.Add(-l.policy.Window),
+	).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := l.policy.lockout(failures)
+	if wait > 0 {
+		_, err = l.db.Exec("UPDATE login_attempts SET locked_until = $1 WHERE key = $2", now.Add(wait), key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return wait, nil
+}
+
+func (l *PostgresLimiter) Reset(key string) error {
+	return l.ResetTx(l.db, key)
+}
+
+func (l *PostgresLimiter) ResetTx(tx sqlx.Execer, key string) error {
+	_, err := tx.Exec("DELETE FROM login_attempts WHERE key = $1", key)
+	return err
+}
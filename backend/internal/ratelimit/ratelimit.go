@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"time"
+
+	"forum/config"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Limiter tracks failed attempts per key and tells callers how long a key is
+// locked out. Keys are opaque; callers namespace them ("account:", "ip:").
+type Limiter interface {
+	// Check returns how long the key is still locked, or 0 if it may try now.
+	Check(key string) (time.Duration, error)
+	// Fail records a failed attempt and returns the resulting lockout.
+	Fail(key string) (time.Duration, error)
+	// Reset forgets all failures of the key.
+	Reset(key string) error
+}
+
+// TxLimiter is a Limiter that keeps its counters in the database, so that a
+// reset can be part of a transaction.
+type TxLimiter interface {
+	Limiter
+	ResetTx(tx sqlx.Execer, key string) error
+}
+
+// Policy describes the backoff: the first Threshold failures are free, after
+// that every failure locks the key for BaseDelay doubled per extra failure,
+// capped at MaxDelay. Failures older than Window are forgotten.
+type Policy struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+}
+
+func (p Policy) lockout(failures int) time.Duration {
+	if failures <= p.Threshold {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.Threshold + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// NewLimiter returns a Postgres-backed limiter for backend "postgres", which
+// is shared by every instance, and an in-memory one otherwise.
+func NewLimiter(backend string, db *sqlx.DB, policy Policy) Limiter {
+	if backend == "postgres" {
+		return NewPostgresLimiter(db, policy)
+	}
+	return NewMemoryLimiter(policy)
+}
+
+// NewLoginLimiters builds the per-account and per-address limiters used by
+// the login endpoints. Addresses get a higher threshold because of NAT.
+func NewLoginLimiters(cfg *config.Config, db *sqlx.DB) (account, ip Limiter) {
+	policy := Policy{
+		Threshold: cfg.LoginAccountThreshold,
+		BaseDelay: cfg.LoginLockoutBase,
+		MaxDelay:  cfg.LoginLockoutMax,
+		Window:    cfg.LoginFailureWindow,
+	}
+	account = NewLimiter(cfg.LoginLimiter, db, policy)
+
+	policy.Threshold = cfg.LoginIPThreshold
+	ip = NewLimiter(cfg.LoginLimiter, db, policy)
+	return account, ip
+}
+
+// NewMailLimiters builds the per-recipient and per-address limiters for
+// endpoints that send email on request. Every request counts as a failure,
+// so a recipient can't be flooded.
+func NewMailLimiters(cfg *config.Config, db *sqlx.DB) (recipient, ip Limiter) {
+	policy := Policy{
+		Threshold: cfg.MailRecipientThreshold,
+		BaseDelay: cfg.MailLockoutBase,
+		MaxDelay:  cfg.MailLockoutMax,
+		Window:    cfg.MailRequestWindow,
+	}
+	recipient = NewLimiter(cfg.LoginLimiter, db, policy)
+
+	policy.Threshold = cfg.MailIPThreshold
+	ip = NewLimiter(cfg.LoginLimiter, db, policy)
+	return recipient, ip
+}
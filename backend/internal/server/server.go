@@ -1,9 +1,14 @@
 package server
 
 import (
+	"forum/config"
 	"forum/internal/auth"
 	"forum/internal/handlers"
+	"forum/internal/mail"
 	"forum/internal/middleware"
+	"forum/internal/ratelimit"
+	"forum/internal/storage"
+	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -28,36 +33,135 @@ func (s *Server) SetupRoutes() {
 	router := s.Router
 
 	// Auth service
-	authService := auth.NewAuthService(s.DB)
+	cfg := config.LoadConfig()
+	accountLimiter, ipLimiter := ratelimit.NewLoginLimiters(cfg, s.DB)
+	mailLimiter, mailIPLimiter := ratelimit.NewMailLimiters(cfg, s.DB)
+	authService := auth.NewAuthService(s.DB, mail.NewMailer(cfg, s.DB), accountLimiter, ipLimiter, mailLimiter, mailIPLimiter)
+	router.HandleFunc("/.well-known/jwks.json", auth.JWKS).Methods("GET")
 	router.HandleFunc("/api/register", authService.Register).Methods("POST")
 	router.HandleFunc("/api/login", authService.Login).Methods("POST")
+	router.HandleFunc("/api/login/2fa", authService.LoginTwoFactor).Methods("POST")
+	router.HandleFunc("/api/oidc/login", authService.OIDCLogin).Methods("GET")
+	router.HandleFunc("/api/oidc/callback", authService.OIDCCallback).Methods("GET")
+	router.HandleFunc("/api/token/refresh", authService.RefreshToken).Methods("POST")
+	router.HandleFunc("/api/password/forgot", authService.ForgotPassword).Methods("POST")
+	router.HandleFunc("/api/password/reset", authService.ResetPassword).Methods("POST")
+	router.HandleFunc("/api/email/verify", authService.VerifyEmail).Methods("POST")
+	router.Handle("/api/email/resend", middleware.AuthMiddleware(http.HandlerFunc(authService.ResendVerification))).Methods("POST")
+	router.Handle("/api/logout", middleware.AuthMiddleware(http.HandlerFunc(authService.Logout))).Methods("POST")
 
 	// Profile routes
 	profileHandler := handlers.NewProfileHandler(s.DB)
 	router.Handle("/api/profile", middleware.AuthMiddleware(http.HandlerFunc(profileHandler.GetUserProfile))).Methods("GET")
 	router.Handle("/api/profile/stats", middleware.AuthMiddleware(http.HandlerFunc(profileHandler.GetUserStats))).Methods("GET")
 	router.Handle("/api/profile/password", middleware.AuthMiddleware(http.HandlerFunc(profileHandler.ChangePassword))).Methods("PUT")
+	router.Handle("/api/profile/tokens", middleware.AuthMiddleware(http.HandlerFunc(profileHandler.GetAccessTokens))).Methods("GET")
+	router.Handle("/api/profile/tokens", middleware.AuthMiddleware(http.HandlerFunc(profileHandler.CreateAccessToken))).Methods("POST")
+	router.Handle("/api/profile/tokens/{id}", middleware.AuthMiddleware(http.HandlerFunc(profileHandler.RevokeAccessToken))).Methods("DELETE")
+	router.Handle("/api/profile/2fa/setup", middleware.AuthMiddleware(http.HandlerFunc(authService.SetupTwoFactor))).Methods("POST")
+	router.Handle("/api/profile/2fa/confirm", middleware.AuthMiddleware(http.HandlerFunc(authService.ConfirmTwoFactor))).Methods("POST")
+	router.Handle("/api/profile/2fa/recovery-codes", middleware.AuthMiddleware(http.HandlerFunc(authService.RegenerateRecoveryCodes))).Methods("POST")
+	router.Handle("/api/profile/2fa/disable", middleware.AuthMiddleware(http.HandlerFunc(authService.DisableTwoFactor))).Methods("POST")
 
 	// Posts routes
-	router.HandleFunc("/api/posts", handlers.GetPosts).Methods("GET")
-	router.HandleFunc("/api/posts/{id}", handlers.GetPost).Methods("GET")
-	router.Handle("/api/posts", middleware.AuthMiddleware(http.HandlerFunc(handlers.CreatePost))).Methods("POST")
+	router.Handle("/api/posts", middleware.OptionalAuth(http.HandlerFunc(handlers.GetPosts))).Methods("GET")
+	router.Handle("/api/posts/{id}", middleware.OptionalAuth(http.HandlerFunc(handlers.GetPost))).Methods("GET")
+	router.Handle("/api/posts", middleware.AuthMiddleware(middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.CreatePost)))).Methods("POST")
 	router.Handle("/api/posts/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.UpdatePost))).Methods("PUT")
 	router.Handle("/api/posts/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.DeletePost))).Methods("DELETE")
+	router.Handle("/api/posts/{id}/revisions", middleware.OptionalAuth(http.HandlerFunc(handlers.GetPostRevisions))).Methods("GET")
+	router.Handle("/api/posts/{id}/revisions/diff", middleware.OptionalAuth(http.HandlerFunc(handlers.GetPostRevisionDiff))).Methods("GET")
+	router.Handle("/api/posts/{id}/revisions/{revision}/rollback", middleware.AuthMiddleware(middleware.RequirePermission(auth.PermPostsEditAny)(http.HandlerFunc(handlers.RollbackPost)))).Methods("POST")
+
+	// Attachments routes
+	blobs, err := storage.NewBlobStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	attachmentHandler := handlers.NewAttachmentHandler(s.DB, blobs)
+	router.Handle("/api/posts/{id}/attachments", middleware.AuthMiddleware(middleware.RequireVerifiedEmail(http.HandlerFunc(attachmentHandler.UploadPostAttachment)))).Methods("POST")
+	router.Handle("/api/comments/{id}/attachments", middleware.AuthMiddleware(middleware.RequireVerifiedEmail(http.HandlerFunc(attachmentHandler.UploadCommentAttachment)))).Methods("POST")
+	router.Handle("/api/attachments/{id}", middleware.OptionalAuth(http.HandlerFunc(attachmentHandler.DownloadAttachment))).Methods("GET")
+	router.Handle("/api/attachments/{id}/thumbnails/{name}", middleware.OptionalAuth(http.HandlerFunc(attachmentHandler.DownloadThumbnail))).Methods("GET")
+	router.Handle("/api/attachments/{id}", middleware.AuthMiddleware(http.HandlerFunc(attachmentHandler.DeleteAttachment))).Methods("DELETE")
+
+	// Votes routes
+	router.HandleFunc("/api/reactions", handlers.GetReactions).Methods("GET")
+	router.Handle("/api/posts/{id}/vote", middleware.AuthMiddleware(middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.VotePost)))).Methods("PUT")
+	router.Handle("/api/posts/{id}/vote", middleware.AuthMiddleware(http.HandlerFunc(handlers.UnvotePost))).Methods("DELETE")
+	router.Handle("/api/posts/{id}/reaction", middleware.AuthMiddleware(middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.ReactToPost)))).Methods("PUT")
+	router.Handle("/api/posts/{id}/reaction", middleware.AuthMiddleware(http.HandlerFunc(handlers.UnreactToPost))).Methods("DELETE")
+	router.Handle("/api/comments/{id}/vote", middleware.AuthMiddleware(middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.VoteComment)))).Methods("PUT")
+	router.Handle("/api/comments/{id}/vote", middleware.AuthMiddleware(http.HandlerFunc(handlers.UnvoteComment))).Methods("DELETE")
+	router.Handle("/api/comments/{id}/reaction", middleware.AuthMiddleware(middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.ReactToComment)))).Methods("PUT")
+	router.Handle("/api/comments/{id}/reaction", middleware.AuthMiddleware(http.HandlerFunc(handlers.UnreactToComment))).Methods("DELETE")
+
+	// Categories routes
+	router.Handle("/api/categories", middleware.OptionalAuth(http.HandlerFunc(handlers.GetCategories))).Methods("GET")
+
+	// Tags routes
+	router.Handle("/api/tags", middleware.OptionalAuth(http.HandlerFunc(handlers.GetTags))).Methods("GET")
+
+	// Search routes
+	router.Handle("/api/search", middleware.OptionalAuth(http.HandlerFunc(handlers.Search))).Methods("GET")
+
+	// Markdown routes
+	router.HandleFunc("/api/markdown/highlight.css", handlers.HighlightCSS).Methods("GET")
 
 	// Comments routes
-	router.HandleFunc("/api/posts/{post_id}/comments", handlers.GetComments).Methods("GET")
-	router.Handle("/api/posts/{post_id}/comments", middleware.AuthMiddleware(http.HandlerFunc(handlers.CreateComment))).Methods("POST")
+	router.Handle("/api/posts/{post_id}/comments", middleware.OptionalAuth(http.HandlerFunc(handlers.GetComments))).Methods("GET")
+	router.Handle("/api/posts/{post_id}/comments", middleware.AuthMiddleware(middleware.RequireVerifiedEmail(http.HandlerFunc(handlers.CreateComment)))).Methods("POST")
 	router.Handle("/api/comments/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.UpdateComment))).Methods("PUT")
 	router.Handle("/api/comments/{id}", middleware.AuthMiddleware(http.HandlerFunc(handlers.DeleteComment))).Methods("DELETE")
+	router.Handle("/api/comments/{id}/revisions", middleware.OptionalAuth(http.HandlerFunc(handlers.GetCommentRevisions))).Methods("GET")
+	router.Handle("/api/comments/{id}/revisions/diff", middleware.OptionalAuth(http.HandlerFunc(handlers.GetCommentRevisionDiff))).Methods("GET")
+	router.Handle("/api/comments/{id}/revisions/{revision}/rollback", middleware.AuthMiddleware(middleware.RequirePermission(auth.PermCommentsEditAny)(http.HandlerFunc(handlers.RollbackComment)))).Methods("POST")
+
+	// Chat routes
+	router.Handle("/api/chat/rooms", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetChatRooms))).Methods("GET")
 
 	// Admin routes
 	adminRouter := router.PathPrefix("/api/admin").Subrouter()
 	adminRouter.Use(middleware.AdminMiddleware)
-	adminRouter.HandleFunc("/users", handlers.GetAllUsers).Methods("GET")
-	adminRouter.HandleFunc("/users/{id}", handlers.GetUser).Methods("GET")
-	adminRouter.HandleFunc("/users/{id}", handlers.UpdateUser).Methods("PUT")
-	adminRouter.HandleFunc("/users/{id}", handlers.DeleteUser).Methods("DELETE")
+	usersRouter := adminRouter.PathPrefix("/users").Subrouter()
+	usersRouter.Use(middleware.RequirePermission(auth.PermUsersManage))
+	usersRouter.HandleFunc("", handlers.GetAllUsers).Methods("GET")
+	usersRouter.HandleFunc("/{id}", handlers.GetUser).Methods("GET")
+	usersRouter.HandleFunc("/{id}", handlers.UpdateUser).Methods("PUT")
+	usersRouter.HandleFunc("/{id}", handlers.DeleteUser).Methods("DELETE")
+	usersRouter.HandleFunc("/{id}/unlock", authService.UnlockUser).Methods("POST")
+	sanctionsRouter := adminRouter.PathPrefix("/sanctions").Subrouter()
+	sanctionsRouter.Use(middleware.RequirePermission(auth.PermUsersSanction))
+	sanctionsRouter.HandleFunc("", handlers.GetSanctions).Methods("GET")
+	sanctionsRouter.HandleFunc("", handlers.CreateSanction).Methods("POST")
+	sanctionsRouter.HandleFunc("/{id}", handlers.RevokeSanction).Methods("DELETE")
+	adminRouter.Handle("/audit", middleware.RequirePermission(auth.PermAuditRead)(http.HandlerFunc(handlers.GetAuditLog))).Methods("GET")
+	adminRouter.Handle("/permissions", middleware.RequirePermission(auth.PermRolesManage)(http.HandlerFunc(handlers.GetPermissions))).Methods("GET")
+	rolesRouter := adminRouter.PathPrefix("/roles").Subrouter()
+	rolesRouter.Use(middleware.RequirePermission(auth.PermRolesManage))
+	rolesRouter.HandleFunc("", handlers.GetRoles).Methods("GET")
+	rolesRouter.HandleFunc("", handlers.CreateRole).Methods("POST")
+	rolesRouter.HandleFunc("/{name}", handlers.UpdateRole).Methods("PUT")
+	rolesRouter.HandleFunc("/{name}", handlers.DeleteRole).Methods("DELETE")
+	categoriesRouter := adminRouter.PathPrefix("/categories").Subrouter()
+	categoriesRouter.Use(middleware.RequirePermission(auth.PermCategoriesManage))
+	categoriesRouter.HandleFunc("", handlers.GetAllCategories).Methods("GET")
+	categoriesRouter.HandleFunc("", handlers.CreateCategory).Methods("POST")
+	categoriesRouter.HandleFunc("/{id}", handlers.UpdateCategory).Methods("PUT")
+	categoriesRouter.HandleFunc("/{id}", handlers.DeleteCategory).Methods("DELETE")
+	tagsRouter := adminRouter.PathPrefix("/tags").Subrouter()
+	tagsRouter.Use(middleware.RequirePermission(auth.PermTagsManage))
+	tagsRouter.HandleFunc("/{id}", handlers.RenameTag).Methods("PUT")
+	tagsRouter.HandleFunc("/{id}/merge", handlers.MergeTag).Methods("POST")
+	chatRoomsRouter := adminRouter.PathPrefix("/chat/rooms").Subrouter()
+	chatRoomsRouter.Use(middleware.RequirePermission(auth.PermChatManage))
+	chatRoomsRouter.HandleFunc("", handlers.GetAllChatRooms).Methods("GET")
+	chatRoomsRouter.HandleFunc("", handlers.CreateChatRoom).Methods("POST")
+	chatRoomsRouter.HandleFunc("/{id}", handlers.UpdateChatRoom).Methods("PUT")
+	chatRoomsRouter.HandleFunc("/{id}", handlers.DeleteChatRoom).Methods("DELETE")
+	chatRoomsRouter.HandleFunc("/{id}/members", handlers.GetChatRoomMembers).Methods("GET")
+	chatRoomsRouter.HandleFunc("/{id}/members", handlers.AddChatRoomMember).Methods("POST")
+	chatRoomsRouter.HandleFunc("/{id}/members/{user_id}", handlers.RemoveChatRoomMember).Methods("DELETE")
 	adminRouter.HandleFunc("/posts", handlers.GetAllPosts).Methods("GET")
 	adminRouter.HandleFunc("/comments", handlers.GetAllComments).Methods("GET")
 }
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"forum/config"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps the files behind attachments. Keys are slash-separated
+// paths chosen by the caller; the store doesn't interpret them.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Get returns ErrNotFound for unknown keys.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds for keys that are already gone.
+	Delete(ctx context.Context, key string) error
+}
+
+// NewBlobStore picks an implementation based on config.StorageDriver:
+// "s3" (any S3-compatible service) or "local" (default).
+func NewBlobStore(cfg *config.Config) (BlobStore, error) {
+	switch cfg.StorageDriver {
+	case "s3":
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required for the s3 storage driver")
+		}
+		return &S3Store{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PathStyle: cfg.S3PathStyle,
+		}, nil
+	case "local", "":
+		return &LocalStore{Dir: cfg.StorageDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.StorageDriver)
+	}
+}
+
+const (
+	sweepInterval  = time.Minute
+	sweepBatchSize = 100
+)
+
+// RunBlobSweeper removes the files of deleted attachments. The database
+// queues their keys in blob_deletions, so files go away however the rows
+// were deleted, including cascades from posts and comments.
+func RunBlobSweeper(db *sqlx.DB, store BlobStore, stop <-chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := sweep(db, store); err != nil {
+				log.Printf("Failed to remove deleted blobs: %v", err)
+			}
+		}
+	}
+}
+
+func sweep(db *sqlx.DB, store BlobStore) error {
+	var keys []string
+	err := db.Select(&keys, "SELECT storage_key FROM blob_deletions ORDER BY created_at LIMIT $1", sweepBatchSize)
+	if err != nil {
+		return fmt.Errorf("error loading blob deletions: %v", err)
+	}
+
+	for _, key := range keys {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := store.Delete(ctx, key)
+		cancel()
+		if err != nil {
+			// Keep the key and try again on the next run.
+			log.Printf("Failed to delete blob %s: %v", key, err)
+			continue
+		}
+		if _, err := db.Exec("DELETE FROM blob_deletions WHERE storage_key = $1", key); err != nil {
+			return fmt.Errorf("error removing blob deletion: %v", err)
+		}
+	}
+	return nil
+}
@@ -5,22 +5,26 @@ import { useAuthStore } from './auth'
 export const useCommentsStore = defineStore('comments', {
   state: () => ({
     comments: [],
+    nextCursor: null,
     loading: false,
     error: null
   }),
 
   actions: {
-    async fetchComments(postId) {
+    // Comments come in pages of threads; with more set the next page is
+    // appended to the loaded ones.
+    async fetchComments(postId, more = false) {
       this.loading = true
       this.error = null
       try {
         const authStore = useAuthStore()
         const response = await axios.get(`http://localhost:8081/api/posts/${postId}/comments`, {
-          headers: {
-            'Authorization': `Bearer ${authStore.token}`
-          }
+          params: more && this.nextCursor ? { cursor: this.nextCursor } : {},
+          headers: authStore.token ? { 'Authorization': `Bearer ${authStore.token}` } : {}
         })
-        this.comments = response.data || []
+        const items = Array.isArray(response.data.items) ? response.data.items : []
+        this.comments = more ? [...this.comments, ...items] : items
+        this.nextCursor = response.data.next_cursor
       } catch (error) {
         console.error('Failed to fetch comments:', error)
         this.error = error.response?.data || error.message
@@ -114,6 +118,7 @@ export const useCommentsStore = defineStore('comments', {
 
     clearComments() {
       this.comments = []
+      this.nextCursor = null
       this.error = null
       this.loading = false
     }
@@ -15,12 +15,11 @@ export const usePostsStore = defineStore('posts', {
       this.loading = true
       try {
         const authStore = useAuthStore()
+        // Guests get the public view; a token also shows restricted categories.
         const response = await axios.get('http://localhost:8081/api/posts', {
-          headers: {
-            'Authorization': `Bearer ${authStore.token}`
-          }
+          headers: authStore.token ? { 'Authorization': `Bearer ${authStore.token}` } : {}
         })
-        this.posts = Array.isArray(response.data) ? response.data : []
+        this.posts = Array.isArray(response.data.items) ? response.data.items : []
       } catch (error) {
         this.error = error.message
         this.posts = []
@@ -34,9 +33,7 @@ export const usePostsStore = defineStore('posts', {
       try {
         const authStore = useAuthStore()
         const response = await axios.get(`http://localhost:8081/api/posts/${id}`, {
-          headers: {
-            'Authorization': `Bearer ${authStore.token}`
-          }
+          headers: authStore.token ? { 'Authorization': `Bearer ${authStore.token}` } : {}
         })
         this.currentPost = response.data
       } catch (error) {
@@ -47,6 +44,20 @@ export const usePostsStore = defineStore('posts', {
       }
     },
 
+    // value is 1 or -1; 0 takes the vote back. The answer carries the new totals.
+    async votePost(id, value) {
+      const authStore = useAuthStore()
+      const url = `http://localhost:8081/api/posts/${id}/vote`
+      const headers = { 'Authorization': `Bearer ${authStore.token}` }
+      const response = value === 0
+        ? await axios.delete(url, { headers })
+        : await axios.put(url, { value }, { headers })
+      if (this.currentPost?.id === id) {
+        Object.assign(this.currentPost, response.data)
+      }
+      return response.data
+    },
+
     async createPost(postData) {
       this.loading = true
       try {